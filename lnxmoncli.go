@@ -3,40 +3,126 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
-var SETTINGS = struct {
-	VERSION string
-	DEBUG   bool
-	API     string
-	PROJECT string
-	TOKEN   string
-}{
-	VERSION: "20220710",
-	DEBUG:   false,
-	API:     "http://127.0.0.1:1234/api",
-	PROJECT: "DEFAULT",
-	TOKEN:   "123456",
+// The keys of the config file are the names of the fields in lower case, e.g.
+// "nic_include", see LoadConfig()
+type Settings struct {
+	VERSION         string `json:"-"`
+	DEBUG           bool
+	API             string
+	PROJECT         string
+	TOKEN           string
+	NIC_INCLUDE     string
+	NIC_EXCLUDE     string
+	MOUNT_INCLUDE   string
+	MOUNT_EXCLUDE   string
+	TOP             int
+	WATCH_PROCESSES []WatchProcess
+	CGROUP_DEPTH    int
+	ROOTFS          string `json:"-"`
+	PROCFS          string `json:"-"`
+	SYSFS           string `json:"-"`
+	HOST_ID         string
+	LABELS          map[string]string
+	HOST_INTERVAL   int
+	METRIC_INTERVAL int
+	COLLECTORS      map[string]Collector
+	SPOOL_DIR       string
+	SPOOL_SIZE      int
+	REPORT_INTERVAL int
+	SAMPLE_INTERVAL int
+	RAW_COUNTERS    bool
+	LISTEN          string
+	CUSTOM_SCRIPTS  []CustomScript
+	TEXTFILE_DIR    string
+	STATSD_ADDRESS  string
+	STATSD_SOCKET   string
+	LOG_WATCHES     []LogWatch
+	LOG_SAMPLES     int
+	// NIC_INCLUDE, NIC_EXCLUDE, MOUNT_INCLUDE and MOUNT_EXCLUDE compiled, nil
+	// if empty, see CompileFilters()
+	nic_include   *regexp.Regexp
+	nic_exclude   *regexp.Regexp
+	mount_include *regexp.Regexp
+	mount_exclude *regexp.Regexp
 }
 
+var SETTINGS = Settings{
+	VERSION:         "20220710",
+	DEBUG:           false,
+	API:             "http://127.0.0.1:1234/api",
+	PROJECT:         "DEFAULT",
+	TOKEN:           "123456",
+	NIC_INCLUDE:     "",
+	NIC_EXCLUDE:     "^lo$",
+	MOUNT_INCLUDE:   "",
+	MOUNT_EXCLUDE:   "",
+	TOP:             10,
+	CGROUP_DEPTH:    1,
+	ROOTFS:          "/",
+	PROCFS:          "/proc",
+	SYSFS:           "/sys",
+	HOST_ID:         "",
+	LABELS:          map[string]string{},
+	HOST_INTERVAL:   300,
+	METRIC_INTERVAL: 60,
+	COLLECTORS:      map[string]Collector{},
+	SPOOL_DIR:       "/var/lib/lnxmon/spool",
+	SPOOL_SIZE:      64,
+	REPORT_INTERVAL: 0,
+	SAMPLE_INTERVAL: 0,
+	RAW_COUNTERS:    false,
+	LISTEN:          "",
+	TEXTFILE_DIR:    "",
+	STATSD_ADDRESS:  "",
+	STATSD_SOCKET:   "",
+	LOG_SAMPLES:     0,
+}
+
+// Held while SETTINGS is read, and by a reload on SIGHUP while it replaces
+// SETTINGS, which is only for a moment, see REPORT_MUTEX.
+var SETTINGS_MUTEX sync.RWMutex
+
+// Held by the reporting loops instead of SETTINGS_MUTEX, for as long as a
+// report takes, and by a reload on SIGHUP before SETTINGS_MUTEX, so that a
+// reload never happens in the middle of a report. A reload waiting for a slow
+// report holds up the next reports only, not the sampling or /metrics.
+var REPORT_MUTEX sync.RWMutex
+
 func Skip(err error) {
 	if err != nil {
 		log.Println(err)
@@ -65,6 +151,59 @@ func TimeTaken(started time.Time, action string) {
 	log.Printf("%v took %v\n", action, elapsed)
 }
 
+// The paths of the host, which differ from the ones of lnxmoncli when it runs
+// in a container with the root of the host mounted, e.g. --rootfs=/host
+func HostRoot(path string) string {
+	return filepath.Join(SETTINGS.ROOTFS, path)
+}
+
+func HostProc(path string) string {
+	return filepath.Join(SETTINGS.PROCFS, path)
+}
+
+func HostSys(path string) string {
+	return filepath.Join(SETTINGS.SYSFS, path)
+}
+
+// The mounts of the host are the ones of its init process, since lnxmoncli has
+// its own mount namespace in a container.
+func GetMountsPath() string {
+	if SETTINGS.ROOTFS == "/" {
+		return HostProc("/mounts")
+	}
+	return HostProc("/1/mounts")
+}
+
+// The network stats of the host are the ones of its init process too, since
+// /proc/net is the one of the network namespace of lnxmoncli, e.g. dev,
+// sockstat or tcp.
+func GetNetPath(name string) string {
+	if SETTINGS.ROOTFS == "/" {
+		return HostProc("/net/" + name)
+	}
+	return HostProc("/1/net/" + name)
+}
+
+// The pid of lnxmoncli as seen by the procfs of the host, which differs from
+// os.Getpid() in a container.
+func GetSelfPid() int64 {
+	var err error
+
+	var link string
+	link, err = os.Readlink(HostProc("/self"))
+	if err != nil {
+		return int64(os.Getpid())
+	}
+
+	var pid int64
+	pid, err = strconv.ParseInt(filepath.Base(link), 10, 64)
+	if err != nil {
+		return int64(os.Getpid())
+	}
+
+	return pid
+}
+
 func ExecCmd(command string) (string, error) {
 	var err error
 
@@ -106,11 +245,17 @@ func ExecCmdWithTimeout(command string, args ...time.Duration) (string, error) {
 	cmd = exec.Command("sh", "-c", command)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	// In a process group of its own, so that the children of sh are killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	cmd.Start()
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
 
+	// Buffered, as nobody receives from it after a timeout
 	var done chan error
-	done = make(chan error)
+	done = make(chan error, 1)
 	go func() { done <- cmd.Wait() }()
 
 	var timeout <-chan time.Time
@@ -118,20 +263,43 @@ func ExecCmdWithTimeout(command string, args ...time.Duration) (string, error) {
 
 	select {
 	case <-timeout:
-		cmd.Process.Kill()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 		return "", errors.New(fmt.Sprintf("command timed out after %d secs", duration))
 	case err = <-done:
 		var output string
 		if err == nil {
 			output = stdout.String()
 		} else {
-			output = stderr.String()
+			// A Nagios plugin prints its state to stdout, and exits non-zero
+			output = stdout.String() + stderr.String()
 		}
 		return output, err
 	}
 }
 
 func HttpPost(api string, data []byte) int64 {
+	return HttpPostWithEncoding(api, data, "")
+}
+
+// Compressed with gzip, for the batches of /api/report_host_metrics
+func HttpPostGzip(api string, data []byte) int64 {
+	var err error
+
+	var buffer bytes.Buffer
+
+	var gzip_writer *gzip.Writer
+	gzip_writer = gzip.NewWriter(&buffer)
+	_, err = gzip_writer.Write(data)
+	Throw(err)
+	err = gzip_writer.Close()
+	Throw(err)
+
+	log.Printf("gzip: %d bytes to %d bytes\n", len(data), buffer.Len())
+
+	return HttpPostWithEncoding(api, buffer.Bytes(), "gzip")
+}
+
+func HttpPostWithEncoding(api string, data []byte, content_encoding string) int64 {
 	defer Catch()
 	defer TimeTaken(time.Now(), api)
 
@@ -143,6 +311,9 @@ func HttpPost(api string, data []byte) int64 {
 
 	request.Header.Set("Content-Type", "application/json; charset=utf-8")
 	request.Header.Set("token", SETTINGS.TOKEN)
+	if content_encoding != "" {
+		request.Header.Set("Content-Encoding", content_encoding)
+	}
 
 	var client *http.Client
 	client = &http.Client{Timeout: 30 * time.Second}
@@ -170,12 +341,42 @@ func HttpPost(api string, data []byte) int64 {
 	return http_status_code
 }
 
+// The code identifying the host, --host-id if set, otherwise derived from
+// /etc/machine-id or the DMI product_uuid, so that it survives a rename of the
+// host. Falls back to GetLegacyCode() when none of them is available.
 func GetCode() string {
-	var err error
+	if SETTINGS.HOST_ID != "" {
+		return SETTINGS.HOST_ID
+	}
+
+	var machine_id string
+	machine_id = GetMachineId()
+
+	if machine_id == "" {
+		return GetLegacyCode()
+	}
+
+	// The machine id must not be exposed as is, see machine-id(5)
+	var mac hash.Hash
+	mac = hmac.New(sha256.New, []byte("lnxmon"))
+	mac.Write([]byte(machine_id))
+
+	var code string
+	code = fmt.Sprintf("%x", mac.Sum(nil)[:16])
+
+	return code
+}
+
+// The code of the agents before the machine id, md5 of the hostname, which is
+// sent along with the code for the server to link the history to the new one.
+// Empty with --host-id, which has nothing to do with the hostname.
+func GetLegacyCode() string {
+	if SETTINGS.HOST_ID != "" {
+		return ""
+	}
 
 	var hostname string
-	hostname, err = os.Hostname()
-	Throw(err)
+	hostname = GetHostname()
 
 	var md5sum [16]byte
 	md5sum = md5.Sum([]byte(hostname))
@@ -186,63 +387,253 @@ func GetCode() string {
 	return code
 }
 
+// /etc/machine-id, /var/lib/dbus/machine-id, then the DMI product_uuid which is
+// only readable by root. Empty if none of them is usable.
+func GetMachineId() string {
+	var paths []string
+	paths = []string{
+		HostRoot("/etc/machine-id"),
+		HostRoot("/var/lib/dbus/machine-id"),
+		HostSys("/class/dmi/id/product_uuid"),
+	}
+
+	var path string
+	for _, path = range paths {
+		var content []byte
+		var err error
+		content, err = ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var machine_id string
+		machine_id = strings.ToLower(strings.TrimSpace(string(content)))
+		machine_id = strings.Replace(machine_id, "-", "", -1)
+
+		// Not yet initialized by systemd, or a placeholder of the firmware
+		if machine_id == "" || machine_id == "uninitialized" || strings.Trim(machine_id, "0") == "" || strings.Trim(machine_id, "f") == "" {
+			continue
+		}
+
+		return machine_id
+	}
+
+	return ""
+}
+
+// The hostname of the host rather than the one of the container, which is
+// read from /etc/hostname of the host when --rootfs is set.
 func GetHostname() string {
 	var err error
 
 	var hostname string
-	hostname, err = os.Hostname()
+	if SETTINGS.ROOTFS == "/" {
+		hostname, err = os.Hostname()
+		Throw(err)
+		return hostname
+	}
+
+	var content []byte
+	content, err = ioutil.ReadFile(HostRoot("/etc/hostname"))
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		hostname = strings.TrimSpace(string(content))
+		return hostname
+	}
+
+	// In the UTS namespace of lnxmoncli, which is the one of the host only with
+	// hostNetwork or --uts=host
+	content, err = ioutil.ReadFile(HostProc("/sys/kernel/hostname"))
 	Throw(err)
+	hostname = strings.TrimSpace(string(content))
 
 	return hostname
 }
 
+// The addresses of all the interfaces but loopback, IPv4 first, then the IPv6
+// ones but link-local.
+//
+// With --rootfs they are read from the network namespace of the init process
+// of the host, like GetNetPath(), since lnxmoncli may run in a container
+// without the network of the host.
 func GetIp() string {
 	var err error
 
-	var cmd string
-	var cmd_result string
+	var addrs []net.IP
+	if SETTINGS.ROOTFS == "/" {
+		var addrs2 []net.Addr
+		addrs2, err = net.InterfaceAddrs()
+		Throw(err)
+
+		var addr2 net.Addr
+		for _, addr2 = range addrs2 {
+			var ip_net *net.IPNet
+			var ok bool
+			ip_net, ok = addr2.(*net.IPNet)
+			if ok {
+				addrs = append(addrs, ip_net.IP)
+			}
+		}
+	} else {
+		addrs = ReadNetAddrs()
+	}
+
+	var ips []string
+	var ips6 []string
+
+	var addr net.IP
+	for _, addr = range addrs {
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if addr.To4() != nil {
+			ips = append(ips, addr.String())
+		} else {
+			ips6 = append(ips6, addr.String())
+		}
+	}
+
+	var ip string
+	ip = strings.Join(append(ips, ips6...), ",")
+
+	return ip
+}
+
+// The local addresses of the host, IPv4 from fib_trie, where each one is
+// listed as a /32 host LOCAL route, then IPv6 from if_inet6.
+//
+// |-- 10.0.0.5
+// /32 host LOCAL
+//
+// fe800000000000000000000000000001 02 40 20 80 eth0
+//
+// https://www.kernel.org/doc/Documentation/networking/fib_trie.txt
+func ReadNetAddrs() []net.IP {
+	var err error
+
+	var addrs []net.IP
+
+	var seen map[string]bool
+	seen = make(map[string]bool)
+
+	var content []byte
+	content, err = ioutil.ReadFile(GetNetPath("fib_trie"))
+	Throw(err)
+
+	var lines []string
+	lines = strings.Split(string(content), "\n")
+
+	var i int
+	for i = 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "/32 host LOCAL" {
+			continue
+		}
+
+		var fields []string
+		fields = strings.Fields(lines[i-1])
+		if len(fields) != 2 || fields[0] != "|--" || seen[fields[1]] {
+			continue
+		}
+		seen[fields[1]] = true
+
+		var ip net.IP
+		ip = net.ParseIP(fields[1])
+		if ip != nil {
+			addrs = append(addrs, ip)
+		}
+	}
 
-	cmd = "ip -family inet address"
-	cmd_result, err = ExecCmdWithTimeout(cmd)
+	// Missing without IPv6
+	content, err = ioutil.ReadFile(GetNetPath("if_inet6"))
 	if err != nil {
-		log.Println("cmd:", cmd)
-		log.Println("cmd_result:", cmd_result)
+		return addrs
+	}
+
+	var line string
+	for _, line = range strings.Split(string(content), "\n") {
+		var fields []string
+		fields = strings.Fields(line)
+		if len(fields) != 6 {
+			continue
+		}
+
+		var ip []byte
+		ip, err = hex.DecodeString(fields[0])
+		if err != nil || len(ip) != net.IPv6len {
+			continue
+		}
+
+		addrs = append(addrs, net.IP(ip))
 	}
+
+	return addrs
+}
+
+// The addresses of each interface, including loopback and link-local, e.g.
+// eth0=10.0.0.5/24,fe80::1/64;lo=127.0.0.1/8,::1/128
+//
+// Unlike GetIp(), these are the interfaces of the network namespace of
+// lnxmoncli, i.e. of the host only with the network of the host.
+func GetInterfaces() string {
+	var err error
+
+	var interfaces []net.Interface
+	interfaces, err = net.Interfaces()
 	Throw(err)
 
-	var re *regexp.Regexp
-	var re_result [][]string
+	var interfaces2 []string
 
-	re = regexp.MustCompile(`inet\s*(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})`)
-	re_result = re.FindAllStringSubmatch(cmd_result, -1)
+	var interface2 net.Interface
+	for _, interface2 = range interfaces {
+		var addrs []net.Addr
+		addrs, err = interface2.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
 
-	var ips []string
-	var value []string
+		var addrs2 []string
 
-	for _, value = range re_result {
-		if value[1] != "127.0.0.1" {
-			ips = append(ips, value[1])
+		var addr net.Addr
+		for _, addr = range addrs {
+			addrs2 = append(addrs2, addr.String())
 		}
+
+		interfaces2 = append(interfaces2, interface2.Name+"="+strings.Join(addrs2, ","))
 	}
 
-	var ip string
-	ip = strings.Join(ips, ",")
+	return strings.Join(interfaces2, ";")
+}
 
-	return ip
+// The labels of the config file, sorted by key, e.g. env=prod,role=web
+func GetLabels() string {
+	var keys []string
+
+	var key string
+	for key = range SETTINGS.LABELS {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var labels []string
+	for _, key = range keys {
+		labels = append(labels, key+"="+SETTINGS.LABELS[key])
+	}
+
+	return strings.Join(labels, ",")
 }
 
 func GetOsType() string {
 	var err error
 
 	var filename string
-	filename = "/etc/issue"
-	_, err = os.Stat("/etc/centos-release")
+	filename = HostRoot("/etc/issue")
+	_, err = os.Stat(HostRoot("/etc/centos-release"))
 	if err == nil {
-		filename = "/etc/centos-release"
+		filename = HostRoot("/etc/centos-release")
 	} else {
-		_, err = os.Stat("/etc/redhat-release")
+		_, err = os.Stat(HostRoot("/etc/redhat-release"))
 		if err == nil {
-			filename = "/etc/redhat-release"
+			filename = HostRoot("/etc/redhat-release")
 		} else {
 		}
 	}
@@ -262,22 +653,28 @@ func GetOsType() string {
 	return os_type
 }
 
+// e.g. 64-bit 5.15.0-76-generic x86_64, as `getconf LONG_BIT; uname -rm` did
 func GetArchitecture() string {
 	var err error
 
-	var cmd string
-	var cmd_result string
+	var utsname syscall.Utsname
+	err = syscall.Uname(&utsname)
+	Throw(err)
 
-	cmd = `getconf LONG_BIT |head -c -1; echo -n "-bit "; uname -rm`
-	cmd_result, err = ExecCmdWithTimeout(cmd)
-	if err != nil {
-		log.Println("cmd:", cmd)
-		log.Println("cmd_result:", cmd_result)
+	// The fields are [65]int8 or [65]uint8 depending on the architecture
+	var release []byte
+	var machine []byte
+
+	var i int
+	for i = 0; i < len(utsname.Release) && utsname.Release[i] != 0; i++ {
+		release = append(release, byte(utsname.Release[i]))
+	}
+	for i = 0; i < len(utsname.Machine) && utsname.Machine[i] != 0; i++ {
+		machine = append(machine, byte(utsname.Machine[i]))
 	}
-	Throw(err)
 
 	var architecture string
-	architecture = strings.TrimSpace(cmd_result)
+	architecture = fmt.Sprintf("%d-bit %s %s", strconv.IntSize, string(release), string(machine))
 
 	return architecture
 }
@@ -286,7 +683,7 @@ func GetCpuProcessors() int64 {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/cpuinfo")
+	file, err = os.Open(HostProc("/cpuinfo"))
 	defer file.Close()
 	Throw(err)
 
@@ -310,7 +707,7 @@ func GetMemSize() int64 {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/meminfo")
+	file, err = os.Open(HostProc("/meminfo"))
 	defer file.Close()
 	Throw(err)
 
@@ -342,7 +739,7 @@ func GetSwapSize() int64 {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/meminfo")
+	file, err = os.Open(HostProc("/meminfo"))
 	defer file.Close()
 	Throw(err)
 
@@ -374,7 +771,7 @@ func GetDiskSize() int64 {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/mounts")
+	file, err = os.Open(GetMountsPath())
 	defer file.Close()
 	Throw(err)
 
@@ -394,8 +791,17 @@ func GetDiskSize() int64 {
 			var mount_point string
 			mount_point = strings.Fields(text)[1]
 
+			if !IsMountIncluded(mount_point) {
+				continue
+			}
+
+			// Not mounted under --rootfs
 			var stat syscall.Statfs_t
-			syscall.Statfs(mount_point, &stat)
+			err = syscall.Statfs(HostRoot(mount_point), &stat)
+			if err != nil || stat.Blocks == 0 {
+				Skip(err)
+				continue
+			}
 
 			disk_size += uint64(stat.Bsize) * stat.Blocks
 		}
@@ -414,17 +820,25 @@ func GetDiskSize() int64 {
 	return disk_size2
 }
 
-func GetUptime() float64 {
+// Seconds since boot, which is monotonic and includes the time suspended
+func ReadUptime() float64 {
 	var err error
 
 	var content []byte
-	content, err = ioutil.ReadFile("/proc/uptime")
+	content, err = ioutil.ReadFile(HostProc("/uptime"))
 	Throw(err)
 
 	var uptime float64
 	uptime, err = strconv.ParseFloat(strings.Fields(string(content))[0], 64)
 	Throw(err)
 
+	return uptime
+}
+
+func GetUptime() float64 {
+	var uptime float64
+	uptime = ReadUptime()
+
 	// days
 	uptime = math.Round(uptime/(3600*24)*100) / 100
 
@@ -435,7 +849,7 @@ func GetLoadavg() (float64, float64, float64) {
 	var err error
 
 	var content []byte
-	content, err = ioutil.ReadFile("/proc/loadavg")
+	content, err = ioutil.ReadFile(HostProc("/loadavg"))
 	Throw(err)
 
 	var fields []string
@@ -460,6 +874,98 @@ func GetLoadavg() (float64, float64, float64) {
 	return loadavg_1m, loadavg_5m, loadavg_15m
 }
 
+var PSI_RESOURCES = []string{"cpu", "memory", "io"}
+
+// /proc/pressure/cpu, /proc/pressure/memory, /proc/pressure/io
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+// full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//
+// Keys such as psi_cpu_some_avg10, psi_io_full_total, total is in usec.
+//
+// Not supported before Linux 4.20, or if booted with psi=0, in which case the
+// values are 0. There is no cpu full before Linux 5.13.
+//
+// https://www.kernel.org/doc/html/latest/accounting/psi.html
+func GetPressure() (bool, map[string]float64) {
+	var err error
+
+	var pressure map[string]float64
+	pressure = make(map[string]float64)
+
+	var resource string
+	for _, resource = range PSI_RESOURCES {
+		var kind string
+		for _, kind = range []string{"some", "full"} {
+			pressure[fmt.Sprintf("psi_%s_%s_avg10", resource, kind)] = 0
+			pressure[fmt.Sprintf("psi_%s_%s_avg60", resource, kind)] = 0
+			pressure[fmt.Sprintf("psi_%s_%s_total", resource, kind)] = 0
+		}
+	}
+
+	var supported bool
+	for _, resource = range PSI_RESOURCES {
+		var content []byte
+		content, err = ioutil.ReadFile(HostProc("/pressure/" + resource))
+		if err != nil {
+			continue
+		}
+		supported = true
+
+		var line string
+		for _, line = range strings.Split(string(content), "\n") {
+			var fields []string
+			fields = strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+
+			var field string
+			for _, field = range fields[1:] {
+				var index int
+				index = strings.Index(field, "=")
+				if index == -1 {
+					continue
+				}
+
+				var key string
+				key = fmt.Sprintf("psi_%s_%s_%s", resource, fields[0], field[:index])
+
+				var ok bool
+				_, ok = pressure[key]
+				if !ok {
+					continue
+				}
+
+				var value float64
+				value, err = strconv.ParseFloat(field[index+1:], 64)
+				Skip(err)
+				pressure[key] = value
+			}
+		}
+	}
+
+	return supported, pressure
+}
+
+var CPU_FIELDS = []string{
+	"user",
+	"nice",
+	"system",
+	"idle",
+	"iowait",
+	"irq",
+	"softirq",
+	"steal",
+	"guest",
+	"guest_nice",
+}
+
+type CpuStat struct {
+	Name   string
+	Fields []int64
+}
+
+//  0: cpu, cpu0, cpu1, ...
 //  1: user
 //  2: nice
 //  3: system
@@ -471,155 +977,277 @@ func GetLoadavg() (float64, float64, float64) {
 //  9: guest
 // 10: guest_nice
 //
+// Older kernels have fewer columns, the missing ones are left as 0.
+//
 // https://www.kernel.org/doc/Documentation/filesystems/proc.txt
-func GetCpuUsage() (float64, float64) {
-	var CalculateCpuUsage func() (int64, int64, int64)
-	CalculateCpuUsage = func() (int64, int64, int64) {
-		var err error
+func ReadCpuStat() []CpuStat {
+	var err error
 
-		var file *os.File
-		file, err = os.Open("/proc/stat")
-		defer file.Close()
-		Throw(err)
+	var file *os.File
+	file, err = os.Open(HostProc("/stat"))
+	defer file.Close()
+	Throw(err)
 
-		var scanner *bufio.Scanner
-		scanner = bufio.NewScanner(file)
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(file)
 
+	var cpu_stats []CpuStat
+	for scanner.Scan() {
 		var fields []string
-		for scanner.Scan() {
-			fields = strings.Fields(scanner.Text())
-			break
+		fields = strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
 		}
-		err = scanner.Err()
-		Throw(err)
 
-		var user int64
-		var nice int64
-		var system int64
-		var idle int64
-		var iowait int64
-		var irq int64
-		var softirq int64
+		var cpu_stat CpuStat
+		cpu_stat = CpuStat{
+			Name:   fields[0],
+			Fields: make([]int64, len(CPU_FIELDS)),
+		}
 
-		user, err = strconv.ParseInt(fields[1], 10, 64)
-		Throw(err)
-		nice, err = strconv.ParseInt(fields[2], 10, 64)
-		Throw(err)
-		system, err = strconv.ParseInt(fields[3], 10, 64)
-		Throw(err)
-		idle, err = strconv.ParseInt(fields[4], 10, 64)
-		Throw(err)
-		iowait, err = strconv.ParseInt(fields[5], 10, 64)
-		Throw(err)
-		irq, err = strconv.ParseInt(fields[6], 10, 64)
-		Throw(err)
-		softirq, err = strconv.ParseInt(fields[7], 10, 64)
-		Throw(err)
+		var i int
+		for i = 1; i < len(fields) && i <= len(CPU_FIELDS); i++ {
+			cpu_stat.Fields[i-1], err = strconv.ParseInt(fields[i], 10, 64)
+			Throw(err)
+		}
+
+		cpu_stats = append(cpu_stats, cpu_stat)
+	}
+	err = scanner.Err()
+	Throw(err)
 
-		var used int64
-		var total int64
+	return cpu_stats
+}
+
+// guest and guest_nice are already accounted in user and nice, so they are
+// not added to the total.
+func CalculateCpuPercents(cpu_stat CpuStat, cpu_stat2 CpuStat) []float64 {
+	var deltas []int64
+	deltas = make([]int64, len(CPU_FIELDS))
 
-		used = user + nice + system
-		total = user + nice + system + idle + iowait + irq + softirq
+	var total int64
 
-		return used, iowait, total
+	var i int
+	for i = range CPU_FIELDS {
+		deltas[i] = cpu_stat2.Fields[i] - cpu_stat.Fields[i]
+		if CPU_FIELDS[i] != "guest" && CPU_FIELDS[i] != "guest_nice" {
+			total += deltas[i]
+		}
 	}
 
-	var used int64
-	var iowait int64
-	var total int64
-	var used2 int64
-	var iowait2 int64
-	var total2 int64
+	var percents []float64
+	percents = make([]float64, len(CPU_FIELDS))
+
+	if total > 0 {
+		for i = range CPU_FIELDS {
+			percents[i] = math.Round(float64(deltas[i])/float64(total)*100*100) / 100
+		}
+	}
 
-	used, iowait, total = CalculateCpuUsage()
-	time.Sleep(1 * time.Second)
-	used2, iowait2, total2 = CalculateCpuUsage()
+	return percents
+}
+
+// cpu_usage: cpu_used, cpu_user, cpu_nice, cpu_system, cpu_idle, cpu_iowait,
+// cpu_irq, cpu_softirq, cpu_steal, cpu_guest, cpu_guest_nice
+//
+// cpu_cores: cpu0_user_nice_system_idle_iowait_irq_softirq_steal_guest_guest_nice,cpu1_...
+func GetCpuUsage(snapshot Snapshot, snapshot2 Snapshot) (map[string]float64, string) {
+	var cpu_stats []CpuStat
+	var cpu_stats2 []CpuStat
+
+	cpu_stats = snapshot.CpuStats
+	cpu_stats2 = snapshot2.CpuStats
+
+	var cpu_usage map[string]float64
+	cpu_usage = make(map[string]float64)
+
+	var cores []string
+
+	var cpu_stat CpuStat
+	var cpu_stat2 CpuStat
+	for _, cpu_stat2 = range cpu_stats2 {
+		var is_found bool
+		for _, cpu_stat = range cpu_stats {
+			if cpu_stat.Name == cpu_stat2.Name {
+				is_found = true
+				break
+			}
+		}
+
+		// CPU hotplug
+		if !is_found {
+			continue
+		}
 
-	var cpu_used float64
-	var cpu_iowait float64
+		var percents []float64
+		percents = CalculateCpuPercents(cpu_stat, cpu_stat2)
 
-	cpu_used = float64(used2-used) / float64(total2-total)
-	cpu_iowait = float64(iowait2-iowait) / float64(total2-total)
+		if cpu_stat2.Name == "cpu" {
+			var i int
+			for i = range CPU_FIELDS {
+				cpu_usage["cpu_"+CPU_FIELDS[i]] = percents[i]
+			}
+
+			// user + nice + system
+			cpu_usage["cpu_used"] = math.Round((percents[0]+percents[1]+percents[2])*100) / 100
+		} else {
+			var core string
+			core = cpu_stat2.Name
+
+			var percent float64
+			for _, percent = range percents {
+				core = fmt.Sprintf("%s_%.2f", core, percent)
+			}
 
-	// var cpu_usage string
-	// cpu_usage = fmt.Sprintf("%.2f,%.2f", cpu_used*100, cpu_iowait*100)
-	// return cpu_usage
+			cores = append(cores, core)
+		}
+	}
 
-	cpu_used = math.Round(cpu_used*100*100) / 100
-	cpu_iowait = math.Round(cpu_iowait*100*100) / 100
+	var cpu_cores string
+	cpu_cores = strings.Join(cores, ",")
 
-	return cpu_used, cpu_iowait
+	return cpu_usage, cpu_cores
 }
 
+// Keyed by the exact names, e.g. Cached and SwapCached are different keys.
+// The values are in KiB, except for HugePages_Total, HugePages_Free, etc.
+// which are numbers of pages.
+//
 // https://www.kernel.org/doc/Documentation/filesystems/proc.txt
-func GetMemUsage() (float64, float64) {
+func ReadMemInfo() map[string]int64 {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/meminfo")
+	file, err = os.Open(HostProc("/meminfo"))
 	defer file.Close()
 	Throw(err)
 
 	var scanner *bufio.Scanner
 	scanner = bufio.NewScanner(file)
 
-	var mem_total int64
-	var memfree int64
-	var buffers int64
-	var cached int64
-	var swap_total int64
-	var swap_free int64
+	var mem_info map[string]int64
+	mem_info = make(map[string]int64)
 
 	for scanner.Scan() {
 		var text string
 		text = scanner.Text()
 
-		if strings.HasPrefix(text, "MemTotal:") {
-			mem_total, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
-		} else if strings.HasPrefix(text, "MemFree") {
-			memfree, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
-		} else if strings.HasPrefix(text, "Buffers") {
-			buffers, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
-		} else if strings.HasPrefix(text, "Cached") {
-			cached, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
-		} else if strings.HasPrefix(text, "SwapTotal") {
-			swap_total, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
-		} else if strings.HasPrefix(text, "SwapFree") {
-			swap_free, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
-			Throw(err)
+		var index int
+		index = strings.Index(text, ":")
+		if index == -1 {
+			continue
 		}
-	}
-	err = scanner.Err()
-	Throw(err)
-
-	// GiB
-	// var mem_total2 float64
-	// var swap_total2 float64
-	// mem_total2 = math.Round(float64(mem_total) / (1024 * 1024))
-	// swap_total2 = math.Round(float64(swap_total) / (1024 * 1024))
+
+		var fields []string
+		fields = strings.Fields(text[index+1:])
+		if len(fields) == 0 {
+			continue
+		}
+
+		var value int64
+		value, err = strconv.ParseInt(fields[0], 10, 64)
+		Throw(err)
+
+		mem_info[text[:index]] = value
+	}
+	err = scanner.Err()
+	Throw(err)
+
+	return mem_info
+}
+
+// MemAvailable is estimated by the kernel since Linux 3.14, as free does.
+// Before that, it is estimated as MemFree + Buffers + Cached + SReclaimable -
+// Shmem, since shmem is counted in Cached but can not be reclaimed.
+func GetMemAvailable(mem_info map[string]int64) int64 {
+	var mem_available int64
+	var ok bool
+
+	mem_available, ok = mem_info["MemAvailable"]
+	if ok {
+		return mem_available
+	}
+
+	return mem_info["MemFree"] + mem_info["Buffers"] + mem_info["Cached"] + mem_info["SReclaimable"] - mem_info["Shmem"]
+}
+
+func GetMemUsage() (float64, float64) {
+	var mem_info map[string]int64
+	mem_info = ReadMemInfo()
+
+	var mem_total int64
+	var mem_available int64
+	var swap_total int64
+	var swap_free int64
+
+	mem_total = mem_info["MemTotal"]
+	mem_available = GetMemAvailable(mem_info)
+	swap_total = mem_info["SwapTotal"]
+	swap_free = mem_info["SwapFree"]
 
 	var mem_used float64
 	var swap_used float64
 
-	mem_used = float64(mem_total-memfree-buffers-cached) / float64(mem_total) * 100
+	mem_used = float64(mem_total-mem_available) / float64(mem_total) * 100
 	swap_used = float64(swap_total-swap_free) / (float64(swap_total) + 0.1) * 100
 
-	// var mem_usage string
-	// mem_usage = fmt.Sprintf("%.0f,%.2f,%.0f,%.2f", mem_total2, mem_used, swap_total2, swap_used)
-	// return mem_usage
-
 	mem_used = math.Round(mem_used*100) / 100
 	swap_used = math.Round(swap_used*100) / 100
 
 	return mem_used, swap_used
 }
 
+// mem_breakdown (MiB), the composition of MemTotal:
+// mem_apps, mem_hugepages_total, mem_buffers, mem_cached (without shmem),
+// mem_shmem, mem_slab, mem_free
+//
+// and the others:
+// mem_available, mem_slab_reclaimable, mem_dirty, mem_writeback,
+// mem_hugepages_used, mem_committed_as
+func GetMemBreakdown() map[string]float64 {
+	var mem_info map[string]int64
+	mem_info = ReadMemInfo()
+
+	var hugepages_total int64
+	var hugepages_used int64
+
+	// KiB
+	hugepages_total = mem_info["HugePages_Total"] * mem_info["Hugepagesize"]
+	hugepages_used = (mem_info["HugePages_Total"] - mem_info["HugePages_Free"]) * mem_info["Hugepagesize"]
+
+	// The hugepages are reserved, they are neither free nor cached
+	var apps int64
+	apps = mem_info["MemTotal"] - mem_info["MemFree"] - mem_info["Buffers"] - mem_info["Cached"] - mem_info["Slab"] - hugepages_total
+	if apps < 0 {
+		apps = 0
+	}
+
+	var to_mib func(value int64) float64
+	to_mib = func(value int64) float64 {
+		return math.Round(float64(value)/1024*100) / 100
+	}
+
+	var mem_breakdown map[string]float64
+	mem_breakdown = map[string]float64{
+		"mem_apps":             to_mib(apps),
+		"mem_hugepages_total":  to_mib(hugepages_total),
+		"mem_buffers":          to_mib(mem_info["Buffers"]),
+		"mem_cached":           to_mib(mem_info["Cached"] - mem_info["Shmem"]),
+		"mem_shmem":            to_mib(mem_info["Shmem"]),
+		"mem_slab":             to_mib(mem_info["Slab"]),
+		"mem_free":             to_mib(mem_info["MemFree"]),
+		"mem_available":        to_mib(GetMemAvailable(mem_info)),
+		"mem_slab_reclaimable": to_mib(mem_info["SReclaimable"]),
+		"mem_dirty":            to_mib(mem_info["Dirty"]),
+		"mem_writeback":        to_mib(mem_info["Writeback"]),
+		"mem_hugepages_used":   to_mib(hugepages_used),
+		"mem_committed_as":     to_mib(mem_info["Committed_AS"]),
+	}
+
+	return mem_breakdown
+}
+
 // type Statfs_t struct {
 //     Type    int64
 //     Bsize   int64
@@ -641,7 +1269,7 @@ func GetDiskUsage() (string, float64, float64) {
 	var err error
 
 	var file *os.File
-	file, err = os.Open("/proc/mounts")
+	file, err = os.Open(GetMountsPath())
 	defer file.Close()
 	Throw(err)
 
@@ -664,8 +1292,17 @@ func GetDiskUsage() (string, float64, float64) {
 			var mount_point string
 			mount_point = strings.Fields(text)[1]
 
+			if !IsMountIncluded(mount_point) {
+				continue
+			}
+
+			// Not mounted under --rootfs
 			var stat syscall.Statfs_t
-			syscall.Statfs(mount_point, &stat)
+			err = syscall.Statfs(HostRoot(mount_point), &stat)
+			if err != nil || stat.Blocks == 0 {
+				Skip(err)
+				continue
+			}
 
 			var disk_total float64
 			var disk_used float64
@@ -722,128 +1359,195 @@ func GetDiskUsage() (string, float64, float64) {
 //
 // https://www.kernel.org/doc/Documentation/iostats.txt
 // https://www.kernel.org/doc/Documentation/ABI/testing/procfs-diskstats
-func GetDiskIoRate() (float64, float64, int64) {
-	var CalculateDiskIoRate func(re *regexp.Regexp) (int64, int64, int64)
-	CalculateDiskIoRate = func(re *regexp.Regexp) (int64, int64, int64) {
-		var err error
+func ReadDiskStat() map[string][]int64 {
+	var err error
 
-		var file *os.File
-		file, err = os.Open("/proc/diskstats")
-		defer file.Close()
-		Throw(err)
+	var file *os.File
+	file, err = os.Open(HostProc("/diskstats"))
+	defer file.Close()
+	Throw(err)
 
-		var scanner *bufio.Scanner
-		scanner = bufio.NewScanner(file)
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(file)
 
-		var rsectors int64
-		var wsectors int64
-		var ios int64
+	var disk_stats map[string][]int64
+	disk_stats = make(map[string][]int64)
 
-		for scanner.Scan() {
-			var text string
-			text = scanner.Text()
+	for scanner.Scan() {
+		var fields []string
+		fields = strings.Fields(scanner.Text())
 
-			if re.MatchString(text) {
-				var fields []string
-				var rsectors2 int64
-				var wsectors2 int64
-				var ios2 int64
+		if len(fields) < 14 {
+			continue
+		}
 
-				fields = strings.Fields(text)
-				rsectors2, err = strconv.ParseInt(fields[5], 10, 64)
-				Throw(err)
-				wsectors2, err = strconv.ParseInt(fields[9], 10, 64)
-				Throw(err)
-				ios2, err = strconv.ParseInt(fields[11], 10, 64)
-				Throw(err)
+		var values []int64
+		values = make([]int64, 14)
 
-				rsectors += rsectors2
-				wsectors += wsectors2
-				ios += ios2
-			}
+		var i int
+		for i = 3; i < 14; i++ {
+			values[i], err = strconv.ParseInt(fields[i], 10, 64)
+			Throw(err)
 		}
-		err = scanner.Err()
-		Throw(err)
 
-		return rsectors, wsectors, ios
+		disk_stats[fields[2]] = values
 	}
+	err = scanner.Err()
+	Throw(err)
+
+	return disk_stats
+}
 
+// Whole disks only, partitions are not listed in /sys/block.
+//
+// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-block
+func GetBlockDevices() []string {
 	var err error
 
-	var file *os.File
-	file, err = os.Open("/proc/diskstats")
-	defer file.Close()
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(HostSys("/block"))
 	Throw(err)
 
-	var scanner *bufio.Scanner
-	scanner = bufio.NewScanner(file)
-
-	var read_rate float64
-	var write_rate float64
-	var ios int64
-
-	var re *regexp.Regexp
-	var is_matched bool
+	var devices []string
 
-	for scanner.Scan() {
-		var text string
-		text = scanner.Text()
+	var file os.FileInfo
+	for _, file = range files {
+		var name string
+		name = file.Name()
 
-		var patterns []string
-		patterns = []string{
-			" sd[a-z] ",
-			" sd[a-z][0-9] ",
-			" vd[a-z] ",
-			" vd[a-z][0-9] ",
-			" xvd[a-z] ",
-			" xvd[a-z][0-9] ",
-			" hd[a-z] ",
-			" hd[a-z][0-9] ",
+		if strings.HasPrefix(name, "loop") ||
+			strings.HasPrefix(name, "ram") ||
+			strings.HasPrefix(name, "fd") ||
+			strings.HasPrefix(name, "sr") {
+			continue
 		}
 
-		var pattern string
-		for _, pattern = range patterns {
-			re = regexp.MustCompile(pattern)
+		devices = append(devices, name)
+	}
+
+	return devices
+}
 
-			if re.MatchString(text) {
-				is_matched = true
-				break
-			}
-		}
+// dm-0 is shown as its device-mapper name, e.g. centos-root
+func GetBlockDeviceName(device string) string {
+	var err error
 
-		if is_matched {
-			break
-		}
+	var content []byte
+	content, err = ioutil.ReadFile(HostSys(fmt.Sprintf("/block/%s/dm/name", device)))
+	if err == nil && len(strings.TrimSpace(string(content))) > 0 {
+		return strings.TrimSpace(string(content))
 	}
-	err = scanner.Err()
-	Throw(err)
+
+	return device
+}
+
+// A device without slaves is a physical one, device-mapper and md devices are
+// stacked on top of them and are not summed up, otherwise I/O is counted twice.
+func IsBlockDevicePhysical(device string) bool {
+	var err error
+
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(HostSys(fmt.Sprintf("/block/%s/slaves", device)))
+
+	return err != nil || len(files) == 0
+}
+
+// disk_io_rate: disk_read_rate (KiB/s), disk_write_rate (KiB/s), disk_ios (IOPS)
+//
+// disks: name, read_iops, write_iops, read_rate, write_rate, read_await,
+// write_await, util
+func GetDiskIoRate(snapshot Snapshot, snapshot2 Snapshot) (float64, float64, float64, []map[string]interface{}) {
+	var devices []string
+	devices = GetBlockDevices()
+
+	var disk_stats map[string][]int64
+	var disk_stats2 map[string][]int64
+
+	disk_stats = snapshot.DiskStats
+	disk_stats2 = snapshot2.DiskStats
+
+	var elapsed float64
+	elapsed = snapshot2.Time.Sub(snapshot.Time).Seconds()
+
+	var disks []map[string]interface{}
+	disks = make([]map[string]interface{}, 0)
 
 	var rsectors int64
 	var wsectors int64
-	var rsectors2 int64
-	var wsectors2 int64
+	var ios int64
+
+	var device string
+	for _, device = range devices {
+		var values []int64
+		var values2 []int64
+		var ok bool
+		var ok2 bool
+
+		values, ok = disk_stats[device]
+		values2, ok2 = disk_stats2[device]
+		if !ok || !ok2 {
+			continue
+		}
 
-	rsectors, wsectors, _ = CalculateDiskIoRate(re)
-	time.Sleep(1 * time.Second)
-	rsectors2, wsectors2, ios = CalculateDiskIoRate(re)
+		var deltas []int64
+		deltas = make([]int64, 14)
 
-	// KiB/s
-	read_rate = float64(rsectors2-rsectors) * 512 / 1024
-	write_rate = float64(wsectors2-wsectors) * 512 / 1024
+		var i int
+		for i = range deltas {
+			deltas[i] = values2[i] - values[i]
+		}
+
+		if IsBlockDevicePhysical(device) {
+			rsectors += deltas[5]
+			wsectors += deltas[9]
+			ios += deltas[3] + deltas[7]
+		}
+
+		var read_await float64
+		var write_await float64
 
-	// var disk_io_rate string
-	// disk_io_rate = fmt.Sprintf("%.2f,%.2f,%d", read_rate, write_rate, ios)
-	// return disk_io_rate
+		// ms
+		if deltas[3] > 0 {
+			read_await = float64(deltas[6]) / float64(deltas[3])
+		}
+		if deltas[7] > 0 {
+			write_await = float64(deltas[10]) / float64(deltas[7])
+		}
+
+		var util float64
+		util = math.Min(float64(deltas[12])/(elapsed*1000)*100, 100)
+
+		disks = append(
+			disks,
+			map[string]interface{}{
+				"name":       GetBlockDeviceName(device),
+				"read_iops":  CalculateRate(deltas[3], elapsed),
+				"write_iops": CalculateRate(deltas[7], elapsed),
+				// KiB/s
+				"read_rate":   CalculateRate(deltas[5]*512, elapsed*1024),
+				"write_rate":  CalculateRate(deltas[9]*512, elapsed*1024),
+				"read_await":  math.Round(read_await*100) / 100,
+				"write_await": math.Round(write_await*100) / 100,
+				"util":        math.Round(util*100) / 100,
+			},
+		)
+	}
 
 	var disk_read_rate float64
 	var disk_write_rate float64
-	var disk_ios int64
+	var disk_ios float64
 
-	disk_read_rate = math.Round(read_rate*100) / 100
-	disk_write_rate = math.Round(write_rate*100) / 100
-	disk_ios = ios
+	// KiB/s
+	disk_read_rate = CalculateRate(rsectors*512, elapsed*1024)
+	disk_write_rate = CalculateRate(wsectors*512, elapsed*1024)
+	disk_ios = CalculateRate(ios, elapsed)
+
+	return disk_read_rate, disk_write_rate, disk_ios, disks
+}
 
-	return disk_read_rate, disk_write_rate, disk_ios
+type NicStat struct {
+	Name   string
+	Fields []int64
 }
 
 //  0: Interface
@@ -865,98 +1569,287 @@ func GetDiskIoRate() (float64, float64, int64) {
 // 16: Transmit multicast
 //
 // https://www.kernel.org/doc/Documentation/filesystems/proc.txt
-func GetNicIoRate() (float64, int64, float64, int64) {
-	var CalculateNicIoRate func() (int64, int64, int64, int64)
-	CalculateNicIoRate = func() (int64, int64, int64, int64) {
-		var err error
+func ReadNicStat() []NicStat {
+	var err error
 
-		var file *os.File
-		file, err = os.Open("/proc/net/dev")
-		defer file.Close()
-		Throw(err)
+	var file *os.File
+	file, err = os.Open(GetNetPath("dev"))
+	defer file.Close()
+	Throw(err)
 
-		var scanner *bufio.Scanner
-		scanner = bufio.NewScanner(file)
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(file)
 
-		var receive_bytes int64
-		var transmit_bytes int64
-		var receive_packets int64
-		var transmit_packets int64
+	var nic_stats []NicStat
+	for scanner.Scan() {
+		var text string
+		text = scanner.Text()
 
-		for scanner.Scan() {
-			var text string
-			text = scanner.Text()
+		// "eth0:123 ..." has no space after the colon when the counter is large
+		var index int
+		index = strings.Index(text, ":")
+		if index == -1 || strings.Contains(text, "|") {
+			continue
+		}
 
-			if !strings.Contains(text, "Inter") &&
-				!strings.Contains(text, "face") &&
-				!strings.Contains(text, "lo:") {
-				var fields []string
-				var receive_bytes2 int64
-				var receive_packets2 int64
-				var transmit_bytes2 int64
-				var transmit_packets2 int64
+		var fields []string
+		fields = strings.Fields(text[index+1:])
 
-				fields = strings.Fields(text)
-				receive_bytes2, err = strconv.ParseInt(fields[1], 10, 64)
-				Throw(err)
-				receive_packets2, err = strconv.ParseInt(fields[2], 10, 64)
-				Throw(err)
-				transmit_bytes2, err = strconv.ParseInt(fields[9], 10, 64)
-				Throw(err)
-				transmit_packets2, err = strconv.ParseInt(fields[10], 10, 64)
-				Throw(err)
+		var nic_stat NicStat
+		nic_stat = NicStat{
+			Name:   strings.TrimSpace(text[:index]),
+			Fields: make([]int64, 17),
+		}
 
-				receive_bytes += receive_bytes2
-				receive_packets += receive_packets2
-				transmit_bytes += transmit_bytes2
-				transmit_packets += transmit_packets2
-			}
+		var i int
+		for i = 0; i < len(fields) && i < 16; i++ {
+			nic_stat.Fields[i+1], err = strconv.ParseInt(fields[i], 10, 64)
+			Throw(err)
 		}
-		err = scanner.Err()
-		Throw(err)
 
-		return receive_bytes, transmit_bytes, receive_packets, transmit_packets
+		nic_stats = append(nic_stats, nic_stat)
+	}
+	err = scanner.Err()
+	Throw(err)
+
+	return nic_stats
+}
+
+// Mount points are filtered by SETTINGS.MOUNT_INCLUDE and SETTINGS.MOUNT_EXCLUDE.
+func IsMountIncluded(mount_point string) bool {
+	if SETTINGS.mount_include != nil && !SETTINGS.mount_include.MatchString(mount_point) {
+		return false
+	}
+	if SETTINGS.mount_exclude != nil && SETTINGS.mount_exclude.MatchString(mount_point) {
+		return false
+	}
+	return true
+}
+
+// Interfaces are filtered by SETTINGS.NIC_INCLUDE and SETTINGS.NIC_EXCLUDE.
+func IsNicIncluded(name string) bool {
+	if SETTINGS.nic_include != nil && !SETTINGS.nic_include.MatchString(name) {
+		return false
+	}
+	if SETTINGS.nic_exclude != nil && SETTINGS.nic_exclude.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// Only the interfaces backed by a device are summed up, so the traffic of
+// bond, bridge, veth and docker interfaces is not counted twice.
+//
+// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-class-net
+func IsNicPhysical(name string) bool {
+	var err error
+	_, err = os.Stat(HostSys(fmt.Sprintf("/class/net/%s/device", name)))
+	return err == nil
+}
+
+// nic_io_rate: nic_receive_rate (KiB/s), nic_receive_packets (/s),
+// nic_transmit_rate (KiB/s), nic_transmit_packets (/s)
+//
+// nics: name, receive_rate, receive_packets, receive_errs, receive_drop,
+// transmit_rate, transmit_packets, transmit_errs, transmit_drop
+func GetNicIoRate(snapshot Snapshot, snapshot2 Snapshot) (float64, float64, float64, float64, []map[string]interface{}) {
+	var nic_stats []NicStat
+	var nic_stats2 []NicStat
+
+	nic_stats = snapshot.NicStats
+	nic_stats2 = snapshot2.NicStats
+
+	var elapsed float64
+	elapsed = snapshot2.Time.Sub(snapshot.Time).Seconds()
+
+	var nics []map[string]interface{}
+	nics = make([]map[string]interface{}, 0)
+
+	var has_physical bool
+	var nic_stat2 NicStat
+	for _, nic_stat2 = range nic_stats2 {
+		if IsNicIncluded(nic_stat2.Name) && IsNicPhysical(nic_stat2.Name) {
+			has_physical = true
+			break
+		}
 	}
 
 	var receive_bytes int64
-	var transmit_bytes int64
 	var receive_packets int64
+	var transmit_bytes int64
 	var transmit_packets int64
-	var receive_bytes2 int64
-	var transmit_bytes2 int64
-	var receive_packets2 int64
-	var transmit_packets2 int64
 
-	receive_bytes, transmit_bytes, receive_packets, transmit_packets = CalculateNicIoRate()
-	time.Sleep(1 * time.Second)
-	receive_bytes2, transmit_bytes2, receive_packets2, transmit_packets2 = CalculateNicIoRate()
+	var nic_stat NicStat
+	for _, nic_stat2 = range nic_stats2 {
+		if !IsNicIncluded(nic_stat2.Name) {
+			continue
+		}
+
+		var is_found bool
+		for _, nic_stat = range nic_stats {
+			if nic_stat.Name == nic_stat2.Name {
+				is_found = true
+				break
+			}
+		}
+
+		if !is_found {
+			continue
+		}
+
+		var deltas []int64
+		deltas = make([]int64, 17)
 
-	var receive_rate float64
-	var receive_packets3 int64
-	var transmit_rate float64
-	var transmit_packets3 int64
+		var i int
+		for i = range deltas {
+			deltas[i] = nic_stat2.Fields[i] - nic_stat.Fields[i]
+		}
 
-	// KiB/s
-	receive_rate = float64(receive_bytes2-receive_bytes) / 1024
-	receive_packets3 = receive_packets2 - receive_packets
-	transmit_rate = float64(transmit_bytes2-transmit_bytes) / 1024
-	transmit_packets3 = transmit_packets2 - transmit_packets
+		// Without any device, e.g. inside a container, all of the interfaces are summed up
+		if IsNicPhysical(nic_stat2.Name) || !has_physical {
+			receive_bytes += deltas[1]
+			receive_packets += deltas[2]
+			transmit_bytes += deltas[9]
+			transmit_packets += deltas[10]
+		}
 
-	// var nic_io_rate string
-	// nic_io_rate = fmt.Sprintf("%.2f,%d,%.2f,%d", receive_rate, receive_packets3, transmit_rate, transmit_packets3)
-	// return nic_io_rate
+		nics = append(
+			nics,
+			map[string]interface{}{
+				"name": nic_stat2.Name,
+				// KiB/s
+				"receive_rate":     CalculateRate(deltas[1], elapsed*1024),
+				"receive_packets":  CalculateRate(deltas[2], elapsed),
+				"receive_errs":     CalculateRate(deltas[3], elapsed),
+				"receive_drop":     CalculateRate(deltas[4], elapsed),
+				"transmit_rate":    CalculateRate(deltas[9], elapsed*1024),
+				"transmit_packets": CalculateRate(deltas[10], elapsed),
+				"transmit_errs":    CalculateRate(deltas[11], elapsed),
+				"transmit_drop":    CalculateRate(deltas[12], elapsed),
+			},
+		)
+	}
 
 	var nic_receive_rate float64
-	var nic_receive_packets int64
+	var nic_receive_packets float64
 	var nic_transmit_rate float64
-	var nic_transmit_packets int64
+	var nic_transmit_packets float64
+
+	// KiB/s
+	nic_receive_rate = CalculateRate(receive_bytes, elapsed*1024)
+	nic_receive_packets = CalculateRate(receive_packets, elapsed)
+	nic_transmit_rate = CalculateRate(transmit_bytes, elapsed*1024)
+	nic_transmit_packets = CalculateRate(transmit_packets, elapsed)
+
+	return nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets, nics
+}
+
+// The cumulative counters of a snapshot, summed up the same way as the rates,
+// from which the server derives the rates between any two samples. The
+// uptime is the monotonic timestamp, and a new boot time or a smaller uptime
+// tells the server that the counters have been reset. So does a change of the
+// devices summed up, e.g. a NIC plugged in, whose counters would otherwise be
+// taken for a burst of traffic, for which devices is a checksum of their names.
+//
+// counters: boot_time, uptime, devices, cpu_jiffies, cpu_used_jiffies,
+// cpu_idle_jiffies, cpu_iowait_jiffies, cpu_steal_jiffies, disk_reads,
+// disk_read_sectors, disk_writes, disk_write_sectors, nic_receive_bytes,
+// nic_receive_packets, nic_transmit_bytes, nic_transmit_packets
+func GetCounters(snapshot Snapshot) map[string]interface{} {
+	var counters map[string]interface{}
+	counters = map[string]interface{}{
+		"boot_time": GetBootTime(),
+		"uptime":    snapshot.Uptime,
+	}
 
-	nic_receive_rate = math.Round(receive_rate*100) / 100
-	nic_receive_packets = receive_packets3
-	nic_transmit_rate = math.Round(transmit_rate*100) / 100
-	nic_transmit_packets = transmit_packets3
+	var cpu_stat CpuStat
+	for _, cpu_stat = range snapshot.CpuStats {
+		if cpu_stat.Name != "cpu" {
+			continue
+		}
+
+		// Same total as CalculateCpuPercents, guest is already in user
+		var jiffies int64
+		var i int
+		for i = range CPU_FIELDS {
+			if CPU_FIELDS[i] != "guest" && CPU_FIELDS[i] != "guest_nice" {
+				jiffies += cpu_stat.Fields[i]
+			}
+		}
+
+		counters["cpu_jiffies"] = jiffies
+		// user + nice + system
+		counters["cpu_used_jiffies"] = cpu_stat.Fields[0] + cpu_stat.Fields[1] + cpu_stat.Fields[2]
+		counters["cpu_idle_jiffies"] = cpu_stat.Fields[3]
+		counters["cpu_iowait_jiffies"] = cpu_stat.Fields[4]
+		counters["cpu_steal_jiffies"] = cpu_stat.Fields[7]
+	}
+
+	var devices []string
+
+	var reads int64
+	var rsectors int64
+	var writes int64
+	var wsectors int64
+
+	var device string
+	for _, device = range GetBlockDevices() {
+		var values []int64
+		var ok bool
+		values, ok = snapshot.DiskStats[device]
+		if !ok || !IsBlockDevicePhysical(device) {
+			continue
+		}
+
+		devices = append(devices, "disk:"+device)
+		reads += values[3]
+		rsectors += values[5]
+		writes += values[7]
+		wsectors += values[9]
+	}
+
+	counters["disk_reads"] = reads
+	counters["disk_read_sectors"] = rsectors
+	counters["disk_writes"] = writes
+	counters["disk_write_sectors"] = wsectors
+
+	var has_physical bool
+	var nic_stat NicStat
+	for _, nic_stat = range snapshot.NicStats {
+		if IsNicIncluded(nic_stat.Name) && IsNicPhysical(nic_stat.Name) {
+			has_physical = true
+			break
+		}
+	}
+
+	var receive_bytes int64
+	var receive_packets int64
+	var transmit_bytes int64
+	var transmit_packets int64
 
-	return nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets
+	for _, nic_stat = range snapshot.NicStats {
+		if !IsNicIncluded(nic_stat.Name) {
+			continue
+		}
+
+		if IsNicPhysical(nic_stat.Name) || !has_physical {
+			devices = append(devices, "nic:"+nic_stat.Name)
+			receive_bytes += nic_stat.Fields[1]
+			receive_packets += nic_stat.Fields[2]
+			transmit_bytes += nic_stat.Fields[9]
+			transmit_packets += nic_stat.Fields[10]
+		}
+	}
+
+	counters["nic_receive_bytes"] = receive_bytes
+	counters["nic_receive_packets"] = receive_packets
+	counters["nic_transmit_bytes"] = transmit_bytes
+	counters["nic_transmit_packets"] = transmit_packets
+
+	sort.Strings(devices)
+	counters["devices"] = crc32.ChecksumIEEE([]byte(strings.Join(devices, ",")))
+
+	return counters
 }
 
 func GetTcpSockets() (int64, int64) {
@@ -967,7 +1860,7 @@ func GetTcpSockets() (int64, int64) {
 
 	{
 		var file *os.File
-		file, err = os.Open("/proc/net/sockstat")
+		file, err = os.Open(GetNetPath("sockstat"))
 		defer file.Close()
 		Throw(err)
 
@@ -1000,10 +1893,10 @@ func GetTcpSockets() (int64, int64) {
 	}
 
 	{
-		_, err = os.Stat("/proc/net/sockstat6")
+		_, err = os.Stat(GetNetPath("sockstat6"))
 		if err == nil {
 			var file *os.File
-			file, err = os.Open("/proc/net/sockstat6")
+			file, err = os.Open(GetNetPath("sockstat6"))
 			defer file.Close()
 			Throw(err)
 
@@ -1047,188 +1940,4007 @@ func GetTcpSockets() (int64, int64) {
 	return tcp_sockets_inuse, tcp_sockets_tw
 }
 
-func GetUsers() int64 {
-	var err error
+// The states of /proc/net/tcp, 0x01 to 0x0C
+//
+// https://github.com/torvalds/linux/blob/master/include/net/tcp_states.h
+var TCP_STATES = []string{
+	"established",
+	"syn_sent",
+	"syn_recv",
+	"fin_wait1",
+	"fin_wait2",
+	"time_wait",
+	"close",
+	"close_wait",
+	"last_ack",
+	"listen",
+	"closing",
+	"new_syn_recv",
+}
+
+type TcpSocket struct {
+	Protocol string
+	Ip       string
+	Port     int64
+	State    string
+	Inode    int64
+}
 
-	var cmd string
-	var cmd_result string
+// 0100007F -> 127.0.0.1, each 32-bit word is in host byte order (little
+// endian on x86 and arm).
+func ParseProcNetIp(text string) string {
+	var err error
 
-	cmd = "users"
-	cmd_result, err = ExecCmdWithTimeout(cmd)
+	var data []byte
+	data, err = hex.DecodeString(text)
 	if err != nil {
-		log.Println("cmd:", cmd)
-		log.Println("cmd_result:", cmd_result)
+		return text
 	}
-	Throw(err)
-
-	var users int64
-	users = int64(len(strings.Fields(cmd_result)))
 
-	return users
-}
+	var i int
+	for i = 0; i+4 <= len(data); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
 
-func GetCurrentTime() string {
-	var current_time string
-	current_time = time.Now().Format("2006-01-02 15:04:05")
-	return current_time
+	return net.IP(data).String()
 }
 
-// code
-// hostname
-// ip
-// os_type
-// architecture
-// cpu_processors
-// mem_size
-// swap_size
-// disk_size
-// uptime
-// heartbeat_time
-// project
-// version
-func GetHost() []byte {
-	defer Catch()
-
+//  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//   0: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 20281 1 ...
+func ReadTcpSockets() []TcpSocket {
 	var err error
 
+	var tcp_sockets []TcpSocket
+	tcp_sockets = make([]TcpSocket, 0)
+
+	var protocol string
+	for _, protocol = range []string{"tcp", "tcp6"} {
+		var content []byte
+		content, err = ioutil.ReadFile(GetNetPath(protocol))
+		if err != nil {
+			// No tcp6 if IPv6 is disabled
+			continue
+		}
+
+		var lines []string
+		lines = strings.Split(string(content), "\n")
+
+		var line string
+		for _, line = range lines[1:] {
+			var fields []string
+			fields = strings.Fields(line)
+			if len(fields) < 10 {
+				continue
+			}
+
+			var local []string
+			local = strings.Split(fields[1], ":")
+			if len(local) != 2 {
+				continue
+			}
+
+			var tcp_socket TcpSocket
+			tcp_socket.Protocol = protocol
+			tcp_socket.Ip = ParseProcNetIp(local[0])
+
+			tcp_socket.Port, err = strconv.ParseInt(local[1], 16, 64)
+			if err != nil {
+				continue
+			}
+
+			var state int64
+			state, err = strconv.ParseInt(fields[3], 16, 64)
+			if err != nil || state < 1 || state > int64(len(TCP_STATES)) {
+				continue
+			}
+			tcp_socket.State = TCP_STATES[state-1]
+
+			tcp_socket.Inode, err = strconv.ParseInt(fields[9], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			tcp_sockets = append(tcp_sockets, tcp_socket)
+		}
+	}
+
+	return tcp_sockets
+}
+
+// Keys such as tcp_established, tcp_close_wait
+func GetTcpStates(tcp_sockets []TcpSocket) map[string]int64 {
+	var tcp_states map[string]int64
+	tcp_states = make(map[string]int64)
+
+	var state string
+	for _, state = range TCP_STATES {
+		tcp_states["tcp_"+state] = 0
+	}
+
+	var tcp_socket TcpSocket
+	for _, tcp_socket = range tcp_sockets {
+		tcp_states["tcp_"+tcp_socket.State] += 1
+	}
+
+	return tcp_states
+}
+
+// Maps the inodes of the sockets to the pids owning them, by reading the
+// symlinks in /proc/[pid]/fd, e.g. socket:[20281]. The processes of other
+// users are not resolvable unless running as root.
+func GetSocketOwners(process_stats map[int64]ProcessStat) map[int64]int64 {
+	var err error
+
+	var owners map[int64]int64
+	owners = make(map[int64]int64)
+
+	var pid int64
+	for pid = range process_stats {
+		var files []os.FileInfo
+		files, err = ioutil.ReadDir(HostProc(fmt.Sprintf("/%d/fd", pid)))
+		if err != nil {
+			continue
+		}
+
+		var file os.FileInfo
+		for _, file = range files {
+			var link string
+			link, err = os.Readlink(HostProc(fmt.Sprintf("/%d/fd/%s", pid, file.Name())))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+
+			var inode int64
+			inode, err = strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			owners[inode] = pid
+		}
+	}
+
+	return owners
+}
+
+// listening_ports: protocol, ip, port, pid, name
+//
+// pid is 0 and name is "" if the owner is not resolvable.
+func GetListeningPorts(tcp_sockets []TcpSocket, snapshot2 Snapshot) []map[string]interface{} {
+	var listening_ports []map[string]interface{}
+	listening_ports = make([]map[string]interface{}, 0)
+
+	var owners map[int64]int64
+	owners = GetSocketOwners(snapshot2.ProcessStats)
+
+	// With SO_REUSEPORT, there are several sockets listening on a port
+	var keys map[string]bool
+	keys = make(map[string]bool)
+
+	var tcp_socket TcpSocket
+	for _, tcp_socket = range tcp_sockets {
+		if tcp_socket.State != "listen" {
+			continue
+		}
+
+		var key string
+		key = fmt.Sprintf("%s_%s_%d", tcp_socket.Protocol, tcp_socket.Ip, tcp_socket.Port)
+		if keys[key] {
+			continue
+		}
+		keys[key] = true
+
+		var pid int64
+		var name string
+		pid = owners[tcp_socket.Inode]
+		if pid != 0 {
+			name = snapshot2.ProcessStats[pid].Name
+		}
+
+		listening_ports = append(
+			listening_ports,
+			map[string]interface{}{
+				"protocol": tcp_socket.Protocol,
+				"ip":       tcp_socket.Ip,
+				"port":     tcp_socket.Port,
+				"pid":      pid,
+				"name":     name,
+			},
+		)
+	}
+
+	sort.Slice(listening_ports, func(i int, j int) bool {
+		if listening_ports[i]["port"].(int64) != listening_ports[j]["port"].(int64) {
+			return listening_ports[i]["port"].(int64) < listening_ports[j]["port"].(int64)
+		}
+		return listening_ports[i]["protocol"].(string)+listening_ports[i]["ip"].(string) < listening_ports[j]["protocol"].(string)+listening_ports[j]["ip"].(string)
+	})
+
+	return listening_ports
+}
+
+// struct utmp of glibc on Linux, 384 bytes
+//   0: ut_type, USER_PROCESS is 7
+//   4: ut_pid
+//   8: ut_line[32]
+//  40: ut_id[4]
+//  44: ut_user[32]
+//  76: ut_host[256]
+// ...
+//
+// https://man7.org/linux/man-pages/man5/utmp.5.html
+const UTMP_SIZE = 384
+const UTMP_USER_PROCESS = 7
+
+// The number of the logged-in sessions, as `users` prints, i.e. the
+// USER_PROCESS entries of utmp whose processes are still running. It is 0 if
+// there is no utmp, e.g. in a container.
+func GetUsers() int64 {
+	var err error
+
+	var content []byte
+	content, err = ioutil.ReadFile(HostRoot("/var/run/utmp"))
+	if os.IsNotExist(err) {
+		content, err = ioutil.ReadFile(HostRoot("/run/utmp"))
+	}
+	if err != nil {
+		return 0
+	}
+
+	var users int64
+
+	var offset int
+	for offset = 0; offset+UTMP_SIZE <= len(content); offset += UTMP_SIZE {
+		var record []byte
+		record = content[offset : offset+UTMP_SIZE]
+
+		// In host byte order
+		var ut_type int64
+		var ut_pid int64
+		if binary.LittleEndian.Uint16(record[0:2]) == UTMP_USER_PROCESS {
+			ut_type = UTMP_USER_PROCESS
+			ut_pid = int64(binary.LittleEndian.Uint32(record[4:8]))
+		} else if binary.BigEndian.Uint16(record[0:2]) == UTMP_USER_PROCESS {
+			ut_type = UTMP_USER_PROCESS
+			ut_pid = int64(binary.BigEndian.Uint32(record[4:8]))
+		}
+
+		if ut_type != UTMP_USER_PROCESS || record[44] == 0 {
+			continue
+		}
+
+		_, err = os.Stat(HostProc(fmt.Sprintf("/%d", ut_pid)))
+		if err != nil {
+			continue
+		}
+
+		users += 1
+	}
+
+	return users
+}
+
+// USER_HZ, the unit of utime, stime and starttime in /proc/[pid]/stat, which
+// is 100 on all of the supported architectures.
+const CLOCK_TICKS = 100
+
+type ProcessStat struct {
+	Pid       int64
+	Name      string
+	State     string
+	Jiffies   int64
+	StartTime int64
+	Threads   int64
+	Rss       int64
+}
+
+//  1: pid
+//  2: comm
+//  3: state
+// 14: utime
+// 15: stime
+// 20: num_threads
+// 22: starttime
+//
+// VmRSS (KiB) comes from /proc/[pid]/status, kernel threads have none.
+//
+// https://man7.org/linux/man-pages/man5/proc.5.html
+func ReadProcessStat(pid int64) (ProcessStat, error) {
+	var err error
+
+	var process_stat ProcessStat
+
+	var content []byte
+	content, err = ioutil.ReadFile(HostProc(fmt.Sprintf("/%d/stat", pid)))
+	if err != nil {
+		return process_stat, err
+	}
+
+	// comm may contain spaces and parentheses
+	var text string
+	var begin int
+	var end int
+
+	text = string(content)
+	begin = strings.Index(text, "(")
+	end = strings.LastIndex(text, ")")
+	if begin == -1 || end == -1 || end < begin {
+		return process_stat, errors.New(fmt.Sprintf("invalid /proc/%d/stat", pid))
+	}
+
+	var fields []string
+	fields = strings.Fields(text[end+1:])
+
+	// fields[0] is the 3rd field, state
+	if len(fields) < 20 {
+		return process_stat, errors.New(fmt.Sprintf("invalid /proc/%d/stat", pid))
+	}
+
+	var utime int64
+	var stime int64
+
+	utime, err = strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return process_stat, err
+	}
+	stime, err = strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return process_stat, err
+	}
+
+	process_stat.Pid = pid
+	process_stat.Name = text[begin+1 : end]
+	process_stat.State = fields[0]
+	process_stat.Jiffies = utime + stime
+
+	process_stat.Threads, err = strconv.ParseInt(fields[17], 10, 64)
+	if err != nil {
+		return process_stat, err
+	}
+	process_stat.StartTime, err = strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return process_stat, err
+	}
+
+	content, err = ioutil.ReadFile(HostProc(fmt.Sprintf("/%d/status", pid)))
+	if err != nil {
+		return process_stat, err
+	}
+
+	var line string
+	for _, line = range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") {
+			process_stat.Rss, err = strconv.ParseInt(strings.Fields(line)[1], 10, 64)
+			if err != nil {
+				return process_stat, err
+			}
+			break
+		}
+	}
+
+	return process_stat, nil
+}
+
+// Processes may exit while walking /proc, so such errors are skipped.
+func ReadProcessStats() map[int64]ProcessStat {
+	var err error
+
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(HostProc("/"))
+	Throw(err)
+
+	var process_stats map[int64]ProcessStat
+	process_stats = make(map[int64]ProcessStat)
+
+	var file os.FileInfo
+	for _, file = range files {
+		var pid int64
+		pid, err = strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var process_stat ProcessStat
+		process_stat, err = ReadProcessStat(pid)
+		if err != nil {
+			continue
+		}
+
+		process_stats[pid] = process_stat
+	}
+
+	return process_stats
+}
+
+// The arguments are separated by '\0', kernel threads have no cmdline.
+func GetProcessCmdline(pid int64) string {
+	var err error
+
+	var content []byte
+	content, err = ioutil.ReadFile(HostProc(fmt.Sprintf("/%d/cmdline", pid)))
+	if err != nil {
+		return ""
+	}
+
+	var cmdline string
+	cmdline = strings.TrimSpace(strings.ReplaceAll(string(content), "\x00", " "))
+
+	if len(cmdline) > 255 {
+		cmdline = cmdline[:255]
+	}
+
+	return cmdline
+}
+
+// CPU usage (%) of each process between two snapshots, a pid reused in
+// between is treated as a new process.
+func CalculateProcessCpuUsage(snapshot Snapshot, snapshot2 Snapshot) map[int64]float64 {
+	var elapsed float64
+	elapsed = snapshot2.Time.Sub(snapshot.Time).Seconds()
+
+	var cpu_usage map[int64]float64
+	cpu_usage = make(map[int64]float64)
+
+	var pid int64
+	var process_stat2 ProcessStat
+	for pid, process_stat2 = range snapshot2.ProcessStats {
+		var process_stat ProcessStat
+		var ok bool
+		process_stat, ok = snapshot.ProcessStats[pid]
+
+		var jiffies int64
+		if ok && process_stat.StartTime == process_stat2.StartTime {
+			jiffies = process_stat2.Jiffies - process_stat.Jiffies
+		} else {
+			jiffies = process_stat2.Jiffies
+		}
+
+		cpu_usage[pid] = CalculateRate(jiffies*100, elapsed*CLOCK_TICKS)
+	}
+
+	return cpu_usage
+}
+
+// The top SETTINGS.TOP processes by CPU and by RSS, a process in both lists is
+// reported once.
+//
+// processes: pid, name, cmdline, cpu_used (%), mem_rss (MiB), threads
+func GetProcesses(snapshot Snapshot, snapshot2 Snapshot) []map[string]interface{} {
+	var cpu_usage map[int64]float64
+	cpu_usage = CalculateProcessCpuUsage(snapshot, snapshot2)
+
+	var pids []int64
+	var pid int64
+	for pid = range snapshot2.ProcessStats {
+		pids = append(pids, pid)
+	}
+
+	var top map[int64]bool
+	top = make(map[int64]bool)
+
+	sort.Slice(pids, func(i int, j int) bool {
+		return cpu_usage[pids[i]] > cpu_usage[pids[j]]
+	})
+	var i int
+	for i = 0; i < len(pids) && i < SETTINGS.TOP; i++ {
+		top[pids[i]] = true
+	}
+
+	sort.Slice(pids, func(i int, j int) bool {
+		return snapshot2.ProcessStats[pids[i]].Rss > snapshot2.ProcessStats[pids[j]].Rss
+	})
+	for i = 0; i < len(pids) && i < SETTINGS.TOP; i++ {
+		top[pids[i]] = true
+	}
+
+	var processes []map[string]interface{}
+	processes = make([]map[string]interface{}, 0)
+
+	for _, pid = range pids {
+		if !top[pid] {
+			continue
+		}
+
+		var process_stat ProcessStat
+		process_stat = snapshot2.ProcessStats[pid]
+
+		processes = append(
+			processes,
+			map[string]interface{}{
+				"pid":      pid,
+				"name":     process_stat.Name,
+				"cmdline":  GetProcessCmdline(pid),
+				"cpu_used": cpu_usage[pid],
+				// MiB
+				"mem_rss": math.Round(float64(process_stat.Rss)/1024*100) / 100,
+				"threads": process_stat.Threads,
+			},
+		)
+	}
+
+	return processes
+}
+
+// A process to watch, matched by its name, a regexp of its cmdline, or its pidfile.
+type WatchProcess struct {
+	Label   string
+	Type    string
+	Pattern string
+}
+
+// [label=]name:nginx
+// [label=]cmdline:^/usr/bin/java .*app\.jar
+// [label=]pidfile:/run/nginx.pid
+func ParseWatchProcess(value string) (WatchProcess, error) {
+	var watch_process WatchProcess
+
+	var index int
+	index = strings.Index(value, ":")
+	if index == -1 {
+		return watch_process, errors.New(fmt.Sprintf("invalid watch process: %s", value))
+	}
+
+	watch_process.Type = value[:index]
+	watch_process.Pattern = value[index+1:]
+
+	index = strings.Index(watch_process.Type, "=")
+	if index == -1 {
+		watch_process.Label = watch_process.Pattern
+	} else {
+		watch_process.Label = watch_process.Type[:index]
+		watch_process.Type = watch_process.Type[index+1:]
+	}
+
+	if watch_process.Type != "name" && watch_process.Type != "cmdline" && watch_process.Type != "pidfile" {
+		return watch_process, errors.New(fmt.Sprintf("invalid watch process type: %s", value))
+	}
+
+	if watch_process.Pattern == "" {
+		return watch_process, errors.New(fmt.Sprintf("invalid watch process pattern: %s", value))
+	}
+
+	if watch_process.Type == "cmdline" {
+		var err error
+		_, err = regexp.Compile(watch_process.Pattern)
+		if err != nil {
+			return watch_process, err
+		}
+	}
+
+	return watch_process, nil
+}
+
+// A flag which can be repeated, e.g. --watch-process=name:nginx --watch-process=name:postgres
+// A watched process in the config file is written as with --watch-process
+func (watch_process *WatchProcess) UnmarshalJSON(data []byte) error {
+	var err error
+
+	var value string
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	*watch_process, err = ParseWatchProcess(value)
+	return err
+}
+
+type ArrayFlags []string
+
+func (array_flags *ArrayFlags) String() string {
+	return strings.Join(*array_flags, ",")
+}
+
+func (array_flags *ArrayFlags) Set(value string) error {
+	*array_flags = append(*array_flags, value)
+	return nil
+}
+
+// A script whose output is reported as custom metrics, either lines of
+// name value [labels], or the output of a Nagios plugin.
+type CustomScript struct {
+	Name    string
+	Type    string
+	Command string
+}
+
+// [name=]metrics:/usr/local/bin/queue_depth.sh
+// [name=]nagios:/usr/lib/nagios/plugins/check_http -H localhost
+//
+// The name is the base name of the command by default.
+func ParseCustomScript(value string) (CustomScript, error) {
+	var custom_script CustomScript
+
+	var index int
+	index = strings.Index(value, ":")
+	if index == -1 {
+		return custom_script, errors.New(fmt.Sprintf("invalid custom script: %s", value))
+	}
+
+	custom_script.Type = value[:index]
+	custom_script.Command = strings.TrimSpace(value[index+1:])
+
+	index = strings.Index(custom_script.Type, "=")
+	if index == -1 {
+		var fields []string
+		fields = strings.Fields(custom_script.Command)
+		if len(fields) > 0 {
+			custom_script.Name = filepath.Base(fields[0])
+		}
+	} else {
+		custom_script.Name = custom_script.Type[:index]
+		custom_script.Type = custom_script.Type[index+1:]
+	}
+
+	if custom_script.Type != "metrics" && custom_script.Type != "nagios" {
+		return custom_script, errors.New(fmt.Sprintf("invalid custom script type: %s", value))
+	}
+
+	if custom_script.Command == "" {
+		return custom_script, errors.New(fmt.Sprintf("invalid custom script command: %s", value))
+	}
+
+	custom_script.Name = CUSTOM_NAME_REGEXP.ReplaceAllString(custom_script.Name, "_")
+
+	return custom_script, nil
+}
+
+// A custom script in the config file is written as with --custom-script
+func (custom_script *CustomScript) UnmarshalJSON(data []byte) error {
+	var err error
+
+	var value string
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	*custom_script, err = ParseCustomScript(value)
+	return err
+}
+
+// At most so many custom metrics are reported in a sample, the rest are
+// dropped, so that a runaway script does not flood lnxmonsrv.
+const CUSTOM_METRICS_LIMIT = 1000
+
+// Seconds
+const CUSTOM_SCRIPT_TIMEOUT = 10
+
+var CUSTOM_NAME_REGEXP = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+var CUSTOM_LABEL_REGEXP = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"`)
+
+// 'label with spaces'=12.3ms;100;200;0;1000
+var NAGIOS_PERFDATA_REGEXP = regexp.MustCompile(`('[^']+'|[^\s=']+)=([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)`)
+
+// Parses the lines of name value [labels], where the labels are k=v,k=v, or
+// the lines of the text format of Prometheus, name{k="v",k="v"} value
+// [timestamp], as written by the textfile collector of node_exporter. The
+// comments and the blank lines are skipped.
+//
+// custom_metrics: name, labels (k=v,k=v sorted), value
+func ParseCustomMetrics(content string) ([]map[string]interface{}, error) {
+	var err error
+
+	var custom_metrics []map[string]interface{}
+	custom_metrics = make([]map[string]interface{}, 0)
+
+	var line string
+	for _, line = range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var name string
+		var value string
+		var labels []string
+
+		var index int
+		index = strings.Index(line, "{")
+		if index != -1 && index < strings.IndexAny(line+" ", " \t") {
+			var index2 int
+			index2 = strings.LastIndex(line, "}")
+			if index2 < index {
+				return custom_metrics, errors.New(fmt.Sprintf("invalid custom metric: %s", line))
+			}
+
+			name = line[:index]
+
+			var match []string
+			for _, match = range CUSTOM_LABEL_REGEXP.FindAllStringSubmatch(line[index+1:index2], -1) {
+				labels = append(labels, match[1]+"="+strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\n`, " ").Replace(match[2]))
+			}
+
+			var fields []string
+			fields = strings.Fields(line[index2+1:])
+			if len(fields) == 0 {
+				return custom_metrics, errors.New(fmt.Sprintf("invalid custom metric: %s", line))
+			}
+			value = fields[0]
+		} else {
+			var fields []string
+			fields = strings.Fields(line)
+			if len(fields) < 2 {
+				return custom_metrics, errors.New(fmt.Sprintf("invalid custom metric: %s", line))
+			}
+
+			name = fields[0]
+			value = fields[1]
+
+			var field string
+			for _, field = range fields[2:] {
+				var label string
+				for _, label = range strings.Split(field, ",") {
+					if label != "" {
+						labels = append(labels, label)
+					}
+				}
+			}
+		}
+
+		var value2 float64
+		value2, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(value2) || math.IsInf(value2, 0) {
+			return custom_metrics, errors.New(fmt.Sprintf("invalid custom metric value: %s", line))
+		}
+
+		sort.Strings(labels)
+
+		custom_metrics = append(
+			custom_metrics,
+			map[string]interface{}{
+				"name":   CUSTOM_NAME_REGEXP.ReplaceAllString(name, "_"),
+				"labels": strings.Join(labels, ","),
+				"value":  value2,
+			},
+		)
+	}
+
+	return custom_metrics, nil
+}
+
+// The exit status of a Nagios plugin, 0 OK, 1 WARNING, 2 CRITICAL and 3
+// UNKNOWN, as <name>_status, and each value of its performance data, which
+// is after the first | of the output, as <name>_<label>.
+//
+// https://nagios-plugins.org/doc/guidelines.html#AEN200
+func ParseNagiosOutput(name string, output string, status int) []map[string]interface{} {
+	var custom_metrics []map[string]interface{}
+	custom_metrics = []map[string]interface{}{
+		{"name": name + "_status", "labels": "", "value": float64(status)},
+	}
+
+	var index int
+	index = strings.Index(output, "|")
+	if index == -1 {
+		return custom_metrics
+	}
+
+	var match []string
+	for _, match = range NAGIOS_PERFDATA_REGEXP.FindAllStringSubmatch(output[index+1:], -1) {
+		var value float64
+		var err error
+		value, err = strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+
+		custom_metrics = append(
+			custom_metrics,
+			map[string]interface{}{
+				"name":   CUSTOM_NAME_REGEXP.ReplaceAllString(name+"_"+strings.Trim(match[1], "'"), "_"),
+				"labels": "",
+				"value":  value,
+			},
+		)
+	}
+
+	return custom_metrics
+}
+
+func RunCustomScript(custom_script CustomScript) ([]map[string]interface{}, error) {
+	var err error
+
+	var output string
+	output, err = ExecCmdWithTimeout(custom_script.Command, CUSTOM_SCRIPT_TIMEOUT)
+
+	// The exit status of a Nagios plugin is its state, unless it is unknown or
+	// the plugin was killed by a signal, whose exit code is -1
+	if custom_script.Type == "nagios" {
+		var status int
+		if err != nil {
+			var exit_error *exec.ExitError
+			var ok bool
+			exit_error, ok = err.(*exec.ExitError)
+			if !ok || exit_error.ExitCode() < 0 || exit_error.ExitCode() > 3 {
+				return nil, err
+			}
+			status = exit_error.ExitCode()
+		}
+		return ParseNagiosOutput(custom_script.Name, output, status), nil
+	}
+
+	if err != nil && strings.TrimSpace(output) != "" {
+		return nil, errors.New(fmt.Sprintf("%v: %s", err, strings.TrimSpace(output)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCustomMetrics(output)
+}
+
+// The custom metrics of the scripts, which run in parallel so that a sample
+// waits for CUSTOM_SCRIPT_TIMEOUT at most, of the *.prom files of the
+// textfile directory, and of the StatsD listener. A script or a file which failed is reported as
+// custom:<name> or textfile:<name> in collector_errors.
+func GetCustomMetrics(collector_errors CollectorErrors) []map[string]interface{} {
+	var err error
+
+	var custom_metrics []map[string]interface{}
+	custom_metrics = make([]map[string]interface{}, 0)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	var custom_script CustomScript
+	for _, custom_script = range SETTINGS.CUSTOM_SCRIPTS {
+		wg.Add(1)
+		go func(custom_script CustomScript) {
+			defer wg.Done()
+
+			var custom_metrics2 []map[string]interface{}
+			var err error
+			custom_metrics2, err = RunCustomScript(custom_script)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				collector_errors["custom:"+custom_script.Name] = err.Error()
+				return
+			}
+			custom_metrics = append(custom_metrics, custom_metrics2...)
+		}(custom_script)
+	}
+	wg.Wait()
+
+	if SETTINGS.TEXTFILE_DIR != "" {
+		var paths []string
+		paths, err = filepath.Glob(filepath.Join(SETTINGS.TEXTFILE_DIR, "*.prom"))
+		Throw(err)
+
+		var path string
+		for _, path = range paths {
+			var content []byte
+			var custom_metrics2 []map[string]interface{}
+
+			content, err = ioutil.ReadFile(path)
+			if err == nil {
+				custom_metrics2, err = ParseCustomMetrics(string(content))
+			}
+			if err != nil {
+				collector_errors["textfile:"+filepath.Base(path)] = err.Error()
+				continue
+			}
+
+			custom_metrics = append(custom_metrics, custom_metrics2...)
+		}
+	}
+
+	if SETTINGS.STATSD_ADDRESS != "" || SETTINGS.STATSD_SOCKET != "" {
+		custom_metrics = append(custom_metrics, STATSD.Flush(collector_errors)...)
+	}
+
+	if len(custom_metrics) > CUSTOM_METRICS_LIMIT {
+		collector_errors["custom"] = fmt.Sprintf("%d custom metrics dropped, %d at most", len(custom_metrics)-CUSTOM_METRICS_LIMIT, CUSTOM_METRICS_LIMIT)
+		custom_metrics = custom_metrics[:CUSTOM_METRICS_LIMIT]
+	}
+
+	return custom_metrics
+}
+
+// The metrics received by the StatsD listener within an interval, which are
+// reported as custom metrics: the sum of a counter, the last value of a gauge,
+// the number of unique values of a set, and the count, mean, max and
+// percentiles of a timer as <name>_count, <name>_mean, ...
+//
+// name:value|c[|@rate][|#tag:value,tag:value]
+// name:value|g, name:+value|g or name:-value|g
+// name:value|ms, name:value|h or name:value|d
+// name:value|s
+//
+// https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+type Statsd struct {
+	mutex    sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string]*StatsdTimer
+	sets     map[string]map[string]bool
+	invalid  int
+	example  string
+
+	// The flushes since each gauge was last set, see STATSD_GAUGE_EXPIRY
+	gauge_flushes map[string]int
+}
+
+// The count, sum and max of a timer are exact, the percentiles are those of
+// a random sample of STATSD_TIMER_LIMIT values at most.
+type StatsdTimer struct {
+	count  int
+	sum    float64
+	max    float64
+	values []float64
+}
+
+var STATSD = Statsd{
+	counters:      make(map[string]float64),
+	gauges:        make(map[string]float64),
+	timers:        make(map[string]*StatsdTimer),
+	sets:          make(map[string]map[string]bool),
+	gauge_flushes: make(map[string]int),
+}
+
+var STATSD_PERCENTILES = []float64{50, 90, 99}
+
+const STATSD_TIMER_LIMIT = 10000
+
+// A gauge which has not been set for so many intervals is dropped, so that
+// the series of gone clients do not count towards CUSTOM_METRICS_LIMIT forever
+const STATSD_GAUGE_EXPIRY = 5
+
+// Parses the lines of a packet, a line which is invalid is counted and the
+// last one is kept to be reported by Flush().
+func (statsd *Statsd) Parse(packet string) {
+	statsd.mutex.Lock()
+	defer statsd.mutex.Unlock()
+
+	var line string
+	for _, line = range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !statsd.parseLine(line) {
+			statsd.invalid += 1
+			statsd.example = line
+		}
+	}
+}
+
+func (statsd *Statsd) parseLine(line string) bool {
+	var err error
+
+	// The tags may contain colons too
+	var index int
+	index = strings.Index(line, ":")
+	if index <= 0 {
+		return false
+	}
+
+	var name string
+	var fields []string
+	name = CUSTOM_NAME_REGEXP.ReplaceAllString(line[:index], "_")
+	fields = strings.Split(line[index+1:], "|")
+	if len(fields) < 2 {
+		return false
+	}
+
+	var rate float64
+	rate = 1
+
+	var labels []string
+	var field string
+	for _, field = range fields[2:] {
+		if strings.HasPrefix(field, "@") {
+			rate, err = strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return false
+			}
+		} else if strings.HasPrefix(field, "#") {
+			var tag string
+			for _, tag = range strings.Split(field[1:], ",") {
+				if tag != "" {
+					labels = append(labels, strings.Replace(tag, ":", "=", 1))
+				}
+			}
+		}
+	}
+	sort.Strings(labels)
+
+	// The series of the metric, as name and labels of a custom metric
+	var key string
+	key = name + " " + strings.Join(labels, ",")
+
+	var is_known bool
+	_, is_known = statsd.counters[key]
+	if !is_known {
+		_, is_known = statsd.gauges[key]
+	}
+	if !is_known {
+		_, is_known = statsd.timers[key]
+	}
+	if !is_known {
+		_, is_known = statsd.sets[key]
+	}
+
+	// The series are limited as the custom metrics are
+	if !is_known && len(statsd.counters)+len(statsd.gauges)+len(statsd.timers)+len(statsd.sets) >= CUSTOM_METRICS_LIMIT {
+		return false
+	}
+
+	if fields[1] == "s" {
+		if statsd.sets[key] == nil {
+			statsd.sets[key] = make(map[string]bool)
+		}
+		statsd.sets[key][fields[0]] = true
+		return true
+	}
+
+	var value float64
+	value, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return false
+	}
+
+	switch fields[1] {
+	case "c":
+		statsd.counters[key] += value / rate
+	case "g":
+		// A signed value changes the gauge rather than sets it
+		if strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-") {
+			statsd.gauges[key] += value
+		} else {
+			statsd.gauges[key] = value
+		}
+		statsd.gauge_flushes[key] = 0
+	case "ms", "h", "d":
+		var timer *StatsdTimer
+		timer = statsd.timers[key]
+		if timer == nil {
+			timer = &StatsdTimer{max: value}
+			statsd.timers[key] = timer
+		}
+
+		timer.count += 1
+		timer.sum += value
+		timer.max = math.Max(timer.max, value)
+
+		// Reservoir sampling
+		if len(timer.values) < STATSD_TIMER_LIMIT {
+			timer.values = append(timer.values, value)
+		} else {
+			var index int
+			index = rand.Intn(timer.count)
+			if index < STATSD_TIMER_LIMIT {
+				timer.values[index] = value
+			}
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Returns the custom metrics of the interval and starts a new one, in which
+// the gauges keep their last value as StatsD does, until they expire. The
+// invalid lines are reported as statsd in collector_errors.
+func (statsd *Statsd) Flush(collector_errors CollectorErrors) []map[string]interface{} {
+	statsd.mutex.Lock()
+	defer statsd.mutex.Unlock()
+
+	var custom_metrics []map[string]interface{}
+	custom_metrics = make([]map[string]interface{}, 0)
+
+	var add func(key string, suffix string, value float64)
+	add = func(key string, suffix string, value float64) {
+		var fields []string
+		fields = strings.SplitN(key, " ", 2)
+
+		custom_metrics = append(
+			custom_metrics,
+			map[string]interface{}{
+				"name":   fields[0] + suffix,
+				"labels": fields[1],
+				"value":  math.Round(value*100) / 100,
+			},
+		)
+	}
+
+	var key string
+	var value float64
+	for key, value = range statsd.counters {
+		add(key, "", value)
+	}
+	for key, value = range statsd.gauges {
+		add(key, "", value)
+	}
+
+	var timer *StatsdTimer
+	for key, timer = range statsd.timers {
+		var values []float64
+		values = timer.values
+		sort.Float64s(values)
+
+		add(key, "_count", float64(timer.count))
+		add(key, "_mean", timer.sum/float64(timer.count))
+		add(key, "_max", timer.max)
+
+		// Nearest rank
+		var percentile float64
+		for _, percentile = range STATSD_PERCENTILES {
+			var rank int
+			rank = int(math.Ceil(percentile / 100 * float64(len(values))))
+			add(key, fmt.Sprintf("_p%.0f", percentile), values[rank-1])
+		}
+	}
+
+	var set map[string]bool
+	for key, set = range statsd.sets {
+		add(key, "", float64(len(set)))
+	}
+
+	if statsd.invalid > 0 {
+		collector_errors["statsd"] = fmt.Sprintf("%d invalid or dropped lines, e.g. %s", statsd.invalid, statsd.example)
+	}
+
+	for key = range statsd.gauges {
+		statsd.gauge_flushes[key] += 1
+		if statsd.gauge_flushes[key] >= STATSD_GAUGE_EXPIRY {
+			delete(statsd.gauges, key)
+			delete(statsd.gauge_flushes, key)
+		}
+	}
+
+	statsd.counters = make(map[string]float64)
+	statsd.timers = make(map[string]*StatsdTimer)
+	statsd.sets = make(map[string]map[string]bool)
+	statsd.invalid = 0
+	statsd.example = ""
+
+	return custom_metrics
+}
+
+// Receives the StatsD packets on --statsd-address (udp) or --statsd-socket
+// (unixgram), a stale socket of a previous run is removed first.
+func ServeStatsd(network string, address string) {
+	var err error
+
+	if network == "unixgram" {
+		err = os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			Throw(err)
+		}
+	}
+
+	var conn net.PacketConn
+	conn, err = net.ListenPacket(network, address)
+	Throw(err)
+	defer conn.Close()
+
+	log.Printf("statsd listening on: %s %s\n", network, address)
+
+	var buffer []byte
+	buffer = make([]byte, 65535)
+
+	for {
+		var n int
+		n, _, err = conn.ReadFrom(buffer)
+		if err != nil {
+			Skip(err)
+			continue
+		}
+
+		STATSD.Parse(string(buffer[:n]))
+	}
+}
+
+// A log file to tail, the lines of which matching the regexp are counted, see
+// GetLogMatches()
+type LogWatch struct {
+	Name    string
+	Path    string
+	Pattern string
+	regexp  *regexp.Regexp
+}
+
+// name=/var/log/app.log:ERROR|FATAL
+//
+// The regexp may contain colons, the path may not, nor = or , since it is
+// reported as a label.
+func ParseLogWatch(value string) (LogWatch, error) {
+	var err error
+
+	var log_watch LogWatch
+
+	var index int
+	index = strings.Index(value, ":")
+	if index == -1 {
+		return log_watch, errors.New(fmt.Sprintf("invalid log watch: %s", value))
+	}
+
+	log_watch.Path = value[:index]
+	log_watch.Pattern = value[index+1:]
+
+	index = strings.Index(log_watch.Path, "=")
+	if index == -1 {
+		return log_watch, errors.New(fmt.Sprintf("invalid log watch name: %s", value))
+	}
+
+	log_watch.Name = CUSTOM_NAME_REGEXP.ReplaceAllString(log_watch.Path[:index], "_")
+	log_watch.Path = log_watch.Path[index+1:]
+
+	if log_watch.Name == "" {
+		return log_watch, errors.New(fmt.Sprintf("invalid log watch name: %s", value))
+	}
+
+	if log_watch.Path == "" || strings.ContainsAny(log_watch.Path, "=,") {
+		return log_watch, errors.New(fmt.Sprintf("invalid log watch path: %s", value))
+	}
+
+	if log_watch.Pattern == "" {
+		return log_watch, errors.New(fmt.Sprintf("invalid log watch pattern: %s", value))
+	}
+
+	log_watch.regexp, err = regexp.Compile(log_watch.Pattern)
+	if err != nil {
+		return log_watch, err
+	}
+
+	return log_watch, nil
+}
+
+// A log watch in the config file is written as with --log-watch
+func (log_watch *LogWatch) UnmarshalJSON(data []byte) error {
+	var err error
+
+	var value string
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	*log_watch, err = ParseLogWatch(value)
+	return err
+}
+
+// At most so many bytes of a log file are read in an interval, the rest is
+// read in the next ones.
+const LOG_READ_LIMIT = 16 * 1024 * 1024
+
+// A sample line is cut to so many bytes, and so is a line without a newline
+// which is waiting for the rest of it.
+const LOG_LINE_LIMIT = 1024
+
+// A log file being tailed, which is followed by its path rather than by the
+// open file, so that it survives the rotation.
+type LogTail struct {
+	file   *os.File
+	offset int64
+	rest   string
+	// The rest is the beginning of a line over LOG_LINE_LIMIT, the remainder
+	// of which is dropped
+	is_cut bool
+}
+
+// The log files being tailed by path, which are shared by the log watches of
+// the same path. Only used by the collector of GetHostMetric().
+var LOG_TAILS = map[string]*LogTail{}
+
+// Returns the lines appended to the log file since the last call. The file is
+// read from its end when first seen at the start of lnxmoncli, and from its
+// start when created later on. When it is rotated, the rest of the old file is
+// read before the new one, and when it is truncated, it is read from its start
+// again. The path is the one on the host, see HostRoot().
+func ReadLogLines(path string) ([]string, error) {
+	var err error
+
+	var tail *LogTail
+	tail = LOG_TAILS[path]
+
+	if tail == nil {
+		tail = &LogTail{}
+		LOG_TAILS[path] = tail
+
+		tail.file, err = os.Open(HostRoot(path))
+		if err != nil {
+			tail.file = nil
+			return nil, err
+		}
+
+		tail.offset, err = tail.file.Seek(0, io.SeekEnd)
+		return nil, err
+	}
+
+	var lines []string
+
+	// Of the old file, which is lost once the new one is opened
+	var lost_err error
+
+	var file_info os.FileInfo
+	var stat_err error
+	file_info, stat_err = os.Stat(HostRoot(path))
+	if stat_err != nil && !os.IsNotExist(stat_err) {
+		return nil, stat_err
+	}
+
+	// Rotated, or created since
+	if tail.file != nil && file_info != nil {
+		var file_info2 os.FileInfo
+		file_info2, err = tail.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		if !os.SameFile(file_info, file_info2) {
+			lines, err = tail.read()
+			if err == nil {
+				file_info2, err = tail.file.Stat()
+			}
+			if err == nil && file_info2.Size() > tail.offset {
+				lost_err = errors.New(fmt.Sprintf("rotated with %d bytes unread", file_info2.Size()-tail.offset))
+			}
+			if err != nil {
+				lost_err = err
+			}
+
+			tail.file.Close()
+			tail.file = nil
+			tail.rest = ""
+			tail.is_cut = false
+		}
+	}
+	if tail.file == nil {
+		if file_info == nil {
+			return lines, stat_err
+		}
+
+		tail.file, err = os.Open(HostRoot(path))
+		if err != nil {
+			tail.file = nil
+			return lines, err
+		}
+		tail.offset = 0
+	}
+
+	var lines2 []string
+	lines2, err = tail.read()
+	lines = append(lines, lines2...)
+
+	if err == nil {
+		err = lost_err
+	}
+
+	return lines, err
+}
+
+func (tail *LogTail) read() ([]string, error) {
+	var err error
+
+	var file_info os.FileInfo
+	file_info, err = tail.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Truncated, e.g. by copytruncate of logrotate, unless written past the
+	// offset again since, as with tail -F
+	if file_info.Size() < tail.offset {
+		tail.offset = 0
+		tail.rest = ""
+		tail.is_cut = false
+	}
+
+	_, err = tail.file.Seek(tail.offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	content, err = ioutil.ReadAll(io.LimitReader(tail.file, LOG_READ_LIMIT))
+	tail.offset += int64(len(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var content2 string
+	content2 = string(content)
+
+	// The remainder of a line which was cut, up to its newline
+	if tail.is_cut {
+		var index int
+		index = strings.Index(content2, "\n")
+		if index == -1 {
+			return nil, nil
+		}
+		content2 = content2[index:]
+		tail.is_cut = false
+	}
+
+	var lines []string
+	lines = strings.Split(tail.rest+content2, "\n")
+
+	// Not a whole line yet
+	tail.rest = lines[len(lines)-1]
+	if len(tail.rest) > LOG_LINE_LIMIT {
+		tail.rest = tail.rest[:LOG_LINE_LIMIT]
+		tail.is_cut = true
+	}
+
+	return lines[:len(lines)-1], nil
+}
+
+// Counts the lines of the log files matching the regexps of --log-watch since
+// the last call, which are reported as the custom metrics log_<name> with the
+// label path. The last SETTINGS.LOG_SAMPLES matching lines of each are
+// returned as log_events. A log file which could not be read is reported as
+// log:<path> in collector_errors.
+//
+// log_events: name, path, line
+func GetLogMatches(collector_errors CollectorErrors) ([]map[string]interface{}, []map[string]interface{}) {
+	var custom_metrics []map[string]interface{}
+	custom_metrics = make([]map[string]interface{}, 0)
+
+	var log_events []map[string]interface{}
+	log_events = make([]map[string]interface{}, 0)
+
+	var paths []string
+	var log_watches map[string][]LogWatch
+	log_watches = make(map[string][]LogWatch)
+
+	var log_watch LogWatch
+	for _, log_watch = range SETTINGS.LOG_WATCHES {
+		if log_watches[log_watch.Path] == nil {
+			paths = append(paths, log_watch.Path)
+		}
+		log_watches[log_watch.Path] = append(log_watches[log_watch.Path], log_watch)
+	}
+
+	// Not watched any longer since a reload
+	var path string
+	var tail *LogTail
+	for path, tail = range LOG_TAILS {
+		if log_watches[path] == nil {
+			if tail.file != nil {
+				tail.file.Close()
+			}
+			delete(LOG_TAILS, path)
+		}
+	}
+
+	for _, path = range paths {
+		var err error
+
+		var lines []string
+		lines, err = ReadLogLines(path)
+		if err != nil {
+			collector_errors["log:"+path] = err.Error()
+		}
+
+		for _, log_watch = range log_watches[path] {
+			var count int
+			var samples []string
+
+			var line string
+			for _, line = range lines {
+				if !log_watch.regexp.MatchString(line) {
+					continue
+				}
+
+				count += 1
+
+				if SETTINGS.LOG_SAMPLES > 0 {
+					if len(line) > LOG_LINE_LIMIT {
+						line = line[:LOG_LINE_LIMIT]
+					}
+					samples = append(samples, strings.ToValidUTF8(line, "�"))
+					if len(samples) > SETTINGS.LOG_SAMPLES {
+						samples = samples[1:]
+					}
+				}
+			}
+
+			custom_metrics = append(
+				custom_metrics,
+				map[string]interface{}{
+					"name":   "log_" + log_watch.Name,
+					"labels": "path=" + path,
+					"value":  float64(count),
+				},
+			)
+
+			for _, line = range samples {
+				log_events = append(
+					log_events,
+					map[string]interface{}{
+						"name": log_watch.Name,
+						"path": path,
+						"line": line,
+					},
+				)
+			}
+		}
+	}
+
+	return custom_metrics, log_events
+}
+
+func GetBootTime() int64 {
+	var err error
+
+	var file *os.File
+	file, err = os.Open(HostProc("/stat"))
+	defer file.Close()
+	Throw(err)
+
+	var scanner *bufio.Scanner
+	scanner = bufio.NewScanner(file)
+
+	var boot_time int64
+	for scanner.Scan() {
+		var text string
+		text = scanner.Text()
+
+		if strings.HasPrefix(text, "btime ") {
+			boot_time, err = strconv.ParseInt(strings.Fields(text)[1], 10, 64)
+			Throw(err)
+			break
+		}
+	}
+	err = scanner.Err()
+	Throw(err)
+
+	return boot_time
+}
+
+// Permission denied for the processes of other users unless running as root,
+// such processes are counted as 0.
+func GetProcessFds(pid int64) int64 {
+	var err error
+
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(HostProc(fmt.Sprintf("/%d/fd", pid)))
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(files))
+}
+
+func MatchWatchProcess(watch_process WatchProcess, process_stats map[int64]ProcessStat, cmdlines map[int64]string) []int64 {
+	var pids []int64
+
+	if watch_process.Type == "pidfile" {
+		var err error
+
+		var content []byte
+		content, err = ioutil.ReadFile(HostRoot(watch_process.Pattern))
+		if err != nil {
+			return pids
+		}
+
+		var pid int64
+		pid, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return pids
+		}
+
+		var ok bool
+		_, ok = process_stats[pid]
+		if ok {
+			pids = append(pids, pid)
+		}
+
+		return pids
+	}
+
+	var re *regexp.Regexp
+	if watch_process.Type == "cmdline" {
+		re = regexp.MustCompile(watch_process.Pattern)
+	}
+
+	var self int64
+	self = GetSelfPid()
+
+	var pid int64
+	var process_stat ProcessStat
+	for pid, process_stat = range process_stats {
+		// The cmdline of lnxmoncli contains the patterns
+		if pid == self {
+			continue
+		}
+
+		if watch_process.Type == "name" {
+			// comm is truncated to 15 characters
+			if process_stat.Name == watch_process.Pattern ||
+				(len(process_stat.Name) == 15 && strings.HasPrefix(watch_process.Pattern, process_stat.Name)) {
+				pids = append(pids, pid)
+			}
+		} else {
+			var cmdline string
+			var ok bool
+			cmdline, ok = cmdlines[pid]
+			if !ok {
+				cmdline = GetProcessCmdline(pid)
+				cmdlines[pid] = cmdline
+			}
+
+			if cmdline != "" && re.MatchString(cmdline) {
+				pids = append(pids, pid)
+			}
+		}
+	}
+
+	return pids
+}
+
+// watched_processes: name, type, pattern, count, cpu_used (%), mem_rss (MiB),
+// threads, fds, start_time
+//
+// count is 0 when none of the processes is running.
+func GetWatchedProcesses(snapshot Snapshot, snapshot2 Snapshot) []map[string]interface{} {
+	var watched_processes []map[string]interface{}
+	watched_processes = make([]map[string]interface{}, 0)
+
+	if len(SETTINGS.WATCH_PROCESSES) == 0 {
+		return watched_processes
+	}
+
+	var cpu_usage map[int64]float64
+	cpu_usage = CalculateProcessCpuUsage(snapshot, snapshot2)
+
+	var boot_time int64
+	boot_time = GetBootTime()
+
+	var cmdlines map[int64]string
+	cmdlines = make(map[int64]string)
+
+	var watch_process WatchProcess
+	for _, watch_process = range SETTINGS.WATCH_PROCESSES {
+		var pids []int64
+		pids = MatchWatchProcess(watch_process, snapshot2.ProcessStats, cmdlines)
+
+		var cpu_used float64
+		var mem_rss int64
+		var threads int64
+		var fds int64
+		var start_time int64
+
+		var pid int64
+		for _, pid = range pids {
+			var process_stat ProcessStat
+			process_stat = snapshot2.ProcessStats[pid]
+
+			cpu_used += cpu_usage[pid]
+			mem_rss += process_stat.Rss
+			threads += process_stat.Threads
+			fds += GetProcessFds(pid)
+
+			if start_time == 0 || process_stat.StartTime < start_time {
+				start_time = process_stat.StartTime
+			}
+		}
+
+		var start_time2 string
+		if len(pids) > 0 {
+			start_time2 = time.Unix(boot_time+start_time/CLOCK_TICKS, 0).Format("2006-01-02 15:04:05")
+		}
+
+		watched_processes = append(
+			watched_processes,
+			map[string]interface{}{
+				"name":     watch_process.Label,
+				"type":     watch_process.Type,
+				"pattern":  watch_process.Pattern,
+				"count":    len(pids),
+				"cpu_used": math.Round(cpu_used*100) / 100,
+				// MiB
+				"mem_rss":    math.Round(float64(mem_rss)/1024*100) / 100,
+				"threads":    threads,
+				"fds":        fds,
+				"start_time": start_time2,
+			},
+		)
+	}
+
+	return watched_processes
+}
+
+func GetCgroupRoot() string {
+	return HostSys("/fs/cgroup")
+}
+
+// Containers are reported wherever they are in the tree, e.g.
+// /system.slice/docker-<id>.scope, /docker/<id>,
+// /kubepods.slice/.../cri-containerd-<id>.scope
+var CGROUP_CONTAINER_REGEXP = regexp.MustCompile(`^(?:(docker|cri-containerd|crio|libpod)-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// The counters of a cgroup, cpu in usec, memory and io in bytes.
+type CgroupStat struct {
+	Name          string
+	CpuUsage      int64
+	Periods       int64
+	Throttled     int64
+	ThrottledTime int64
+	MemCurrent    int64
+	MemMax        int64
+	IoReadBytes   int64
+	IoWriteBytes  int64
+	IoReads       int64
+	IoWrites      int64
+}
+
+func IsCgroupV2() bool {
+	var err error
+	_, err = os.Stat(GetCgroupRoot() + "/cgroup.controllers")
+	return err == nil
+}
+
+// Returns a name such as system.slice or docker/0123456789ab for the path
+// relative to the root of a hierarchy, or "" if it is not reported.
+//
+// Cgroups up to SETTINGS.CGROUP_DEPTH levels deep are reported, containers
+// are reported at any depth.
+func GetCgroupName(path string) string {
+	var names []string
+	names = strings.Split(strings.Trim(path, "/"), "/")
+
+	var matches []string
+	matches = CGROUP_CONTAINER_REGEXP.FindStringSubmatch(names[len(names)-1])
+	if matches != nil {
+		var runtime string
+		runtime = matches[1]
+		if runtime == "" && len(names) > 1 {
+			runtime = names[len(names)-2]
+		}
+		if runtime == "" {
+			runtime = "container"
+		}
+		return runtime + "/" + matches[2][:12]
+	}
+
+	if len(names) > SETTINGS.CGROUP_DEPTH {
+		return ""
+	}
+
+	return strings.Join(names, "/")
+}
+
+// Relative paths of the cgroups to report, walking the given hierarchies.
+func GetCgroupPaths(roots []string) map[string]string {
+	var paths map[string]string
+	paths = make(map[string]string)
+
+	var root string
+	for _, root = range roots {
+		// filepath.Walk() does not follow the root if it is a symlink, e.g.
+		// cpuacct to cpu,cpuacct on cgroup v1
+		var err error
+		root, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() || path == root {
+				return nil
+			}
+
+			var path2 string
+			path2 = strings.TrimPrefix(path, root)
+
+			var name string
+			name = GetCgroupName(path2)
+			if name != "" {
+				paths[path2] = name
+			}
+
+			return nil
+		})
+	}
+
+	return paths
+}
+
+// A single number, e.g. memory.current, "max" is returned as 0.
+func ReadCgroupValue(path string) int64 {
+	var err error
+
+	var content []byte
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	var value int64
+	value, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// Flat keyed files, e.g. cpu.stat, "key value" per line.
+func ReadCgroupKeyedValues(path string) map[string]int64 {
+	var err error
+
+	var values map[string]int64
+	values = make(map[string]int64)
+
+	var content []byte
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		return values
+	}
+
+	var line string
+	for _, line = range strings.Split(string(content), "\n") {
+		var fields []string
+		fields = strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		var value int64
+		value, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		values[fields[0]] = value
+	}
+
+	return values
+}
+
+// cpu.stat:       usage_usec, nr_periods, nr_throttled, throttled_usec
+// memory.current
+// memory.max:     "max" if unlimited
+// io.stat:        8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0
+//
+// https://www.kernel.org/doc/Documentation/admin-guide/cgroup-v2.rst
+func ReadCgroupStatV2(path string) CgroupStat {
+	var cgroup_stat CgroupStat
+
+	var cpu_stat map[string]int64
+	cpu_stat = ReadCgroupKeyedValues(path + "/cpu.stat")
+
+	cgroup_stat.CpuUsage = cpu_stat["usage_usec"]
+	cgroup_stat.Periods = cpu_stat["nr_periods"]
+	cgroup_stat.Throttled = cpu_stat["nr_throttled"]
+	cgroup_stat.ThrottledTime = cpu_stat["throttled_usec"]
+
+	cgroup_stat.MemCurrent = ReadCgroupValue(path + "/memory.current")
+	cgroup_stat.MemMax = ReadCgroupValue(path + "/memory.max")
+
+	var err error
+
+	var content []byte
+	content, err = ioutil.ReadFile(path + "/io.stat")
+	if err != nil {
+		return cgroup_stat
+	}
+
+	var field string
+	for _, field = range strings.Fields(string(content)) {
+		var index int
+		index = strings.Index(field, "=")
+		if index == -1 {
+			continue
+		}
+
+		var value int64
+		value, err = strconv.ParseInt(field[index+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch field[:index] {
+		case "rbytes":
+			cgroup_stat.IoReadBytes += value
+		case "wbytes":
+			cgroup_stat.IoWriteBytes += value
+		case "rios":
+			cgroup_stat.IoReads += value
+		case "wios":
+			cgroup_stat.IoWrites += value
+		}
+	}
+
+	return cgroup_stat
+}
+
+// blkio.throttle.io_service_bytes and blkio.throttle.io_serviced:
+// 8:0 Read 1
+// 8:0 Write 2
+// ...
+// Total 3
+func ReadCgroupBlkio(path string) (int64, int64) {
+	var err error
+
+	var content []byte
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+
+	var read int64
+	var write int64
+
+	var line string
+	for _, line = range strings.Split(string(content), "\n") {
+		var fields []string
+		fields = strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		var value int64
+		value, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if fields[1] == "Read" {
+			read += value
+		} else if fields[1] == "Write" {
+			write += value
+		}
+	}
+
+	return read, write
+}
+
+// cpuacct.usage (ns)
+// cpu.stat:                 nr_periods, nr_throttled, throttled_time (ns)
+// memory.usage_in_bytes
+// memory.limit_in_bytes:    a huge number if unlimited
+// blkio.throttle.io_service_bytes, blkio.throttle.io_serviced
+//
+// https://www.kernel.org/doc/Documentation/cgroup-v1/
+func ReadCgroupStatV1(path string) CgroupStat {
+	var cgroup_stat CgroupStat
+
+	cgroup_stat.CpuUsage = ReadCgroupValue(GetCgroupRoot()+"/cpuacct"+path+"/cpuacct.usage") / 1000
+
+	var cpu_stat map[string]int64
+	cpu_stat = ReadCgroupKeyedValues(GetCgroupRoot() + "/cpu" + path + "/cpu.stat")
+
+	cgroup_stat.Periods = cpu_stat["nr_periods"]
+	cgroup_stat.Throttled = cpu_stat["nr_throttled"]
+	cgroup_stat.ThrottledTime = cpu_stat["throttled_time"] / 1000
+
+	cgroup_stat.MemCurrent = ReadCgroupValue(GetCgroupRoot() + "/memory" + path + "/memory.usage_in_bytes")
+	cgroup_stat.MemMax = ReadCgroupValue(GetCgroupRoot() + "/memory" + path + "/memory.limit_in_bytes")
+	// 9223372036854771712, PAGE_COUNTER_MAX rounded down to the page size
+	if cgroup_stat.MemMax >= 1<<62 {
+		cgroup_stat.MemMax = 0
+	}
+
+	cgroup_stat.IoReadBytes, cgroup_stat.IoWriteBytes = ReadCgroupBlkio(GetCgroupRoot() + "/blkio" + path + "/blkio.throttle.io_service_bytes")
+	cgroup_stat.IoReads, cgroup_stat.IoWrites = ReadCgroupBlkio(GetCgroupRoot() + "/blkio" + path + "/blkio.throttle.io_serviced")
+
+	return cgroup_stat
+}
+
+// Keyed by the relative path, the controllers missing from a cgroup are
+// reported as 0.
+func ReadCgroupStats() map[string]CgroupStat {
+	var cgroup_stats map[string]CgroupStat
+	cgroup_stats = make(map[string]CgroupStat)
+
+	var v2 bool
+	v2 = IsCgroupV2()
+
+	var paths map[string]string
+	if v2 {
+		paths = GetCgroupPaths([]string{GetCgroupRoot()})
+	} else {
+		paths = GetCgroupPaths([]string{GetCgroupRoot() + "/cpuacct", GetCgroupRoot() + "/memory", GetCgroupRoot() + "/blkio"})
+	}
+
+	var path string
+	var name string
+	for path, name = range paths {
+		var cgroup_stat CgroupStat
+		if v2 {
+			cgroup_stat = ReadCgroupStatV2(GetCgroupRoot() + path)
+		} else {
+			cgroup_stat = ReadCgroupStatV1(path)
+		}
+		cgroup_stat.Name = name
+
+		cgroup_stats[path] = cgroup_stat
+	}
+
+	return cgroup_stats
+}
+
+// cgroups: name, cpu_used (% of a CPU), cpu_throttled (% of the periods),
+// cpu_throttled_time (ms/s), mem_current (MiB), mem_max (MiB, 0 if
+// unlimited), io_read_rate (KiB/s), io_write_rate (KiB/s), io_read_iops,
+// io_write_iops
+func GetCgroups(snapshot Snapshot, snapshot2 Snapshot) []map[string]interface{} {
+	var elapsed float64
+	elapsed = snapshot2.Time.Sub(snapshot.Time).Seconds()
+
+	var cgroups []map[string]interface{}
+	cgroups = make([]map[string]interface{}, 0)
+
+	var paths []string
+	var path string
+	for path = range snapshot2.CgroupStats {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path = range paths {
+		var cgroup_stat CgroupStat
+		var cgroup_stat2 CgroupStat
+		var ok bool
+
+		cgroup_stat2 = snapshot2.CgroupStats[path]
+		cgroup_stat, ok = snapshot.CgroupStats[path]
+		if !ok {
+			continue
+		}
+
+		var cpu_throttled float64
+		if cgroup_stat2.Periods > cgroup_stat.Periods {
+			cpu_throttled = float64(cgroup_stat2.Throttled-cgroup_stat.Throttled) / float64(cgroup_stat2.Periods-cgroup_stat.Periods) * 100
+		}
+
+		cgroups = append(
+			cgroups,
+			map[string]interface{}{
+				"name": cgroup_stat2.Name,
+				// usec/s to %
+				"cpu_used":      CalculateRate(cgroup_stat2.CpuUsage-cgroup_stat.CpuUsage, elapsed*10000),
+				"cpu_throttled": math.Round(cpu_throttled*100) / 100,
+				// usec/s to ms/s
+				"cpu_throttled_time": CalculateRate(cgroup_stat2.ThrottledTime-cgroup_stat.ThrottledTime, elapsed*1000),
+				// MiB
+				"mem_current": math.Round(float64(cgroup_stat2.MemCurrent)/1024/1024*100) / 100,
+				"mem_max":     math.Round(float64(cgroup_stat2.MemMax)/1024/1024*100) / 100,
+				// KiB/s
+				"io_read_rate":  CalculateRate(cgroup_stat2.IoReadBytes-cgroup_stat.IoReadBytes, elapsed*1024),
+				"io_write_rate": CalculateRate(cgroup_stat2.IoWriteBytes-cgroup_stat.IoWriteBytes, elapsed*1024),
+				"io_read_iops":  CalculateRate(cgroup_stat2.IoReads-cgroup_stat.IoReads, elapsed),
+				"io_write_iops": CalculateRate(cgroup_stat2.IoWrites-cgroup_stat.IoWrites, elapsed),
+			},
+		)
+	}
+
+	return cgroups
+}
+
+// The counters of /proc/stat and /proc/vmstat to report, procs_running and
+// procs_blocked are gauges.
+var KERNEL_STAT_FIELDS = []string{"ctxt", "intr", "processes", "procs_running", "procs_blocked"}
+var VMSTAT_FIELDS = []string{"pgpgin", "pgpgout", "pswpin", "pswpout", "pgmajfault", "oom_kill"}
+
+// ctxt 769182
+// intr 333669 0 0 ..., the first number is the total
+// processes 24888
+// procs_running 2
+// procs_blocked 0
+//
+// pgpgin 728990
+// ...
+// oom_kill 0, since Linux 4.13
+func ReadKernelStat() map[string]int64 {
+	var err error
+
+	var kernel_stat map[string]int64
+	kernel_stat = make(map[string]int64)
+
+	var path string
+	var fields []string
+	for path, fields = range map[string][]string{
+		HostProc("/stat"):   KERNEL_STAT_FIELDS,
+		HostProc("/vmstat"): VMSTAT_FIELDS,
+	} {
+		var wanted map[string]bool
+		wanted = make(map[string]bool)
+
+		var field string
+		for _, field = range fields {
+			wanted[field] = true
+		}
+
+		var content []byte
+		content, err = ioutil.ReadFile(path)
+		Throw(err)
+
+		var line string
+		for _, line = range strings.Split(string(content), "\n") {
+			var fields2 []string
+			fields2 = strings.Fields(line)
+			if len(fields2) < 2 || !wanted[fields2[0]] {
+				continue
+			}
+
+			var value int64
+			value, err = strconv.ParseInt(fields2[1], 10, 64)
+			Skip(err)
+
+			kernel_stat[fields2[0]] = value
+		}
+	}
+
+	return kernel_stat
+}
+
+// kernel: kernel_ctxt, kernel_intr, kernel_forks (per second),
+// kernel_procs_running, kernel_procs_blocked
+// vm: vm_pgpgin, vm_pgpgout (KiB/s), vm_pswpin, vm_pswpout (pages/s),
+// vm_pgmajfault (per second), vm_oom_kill (the number of the OOM kills during
+// the interval, rather than a rate)
+func GetKernelActivity(snapshot Snapshot, snapshot2 Snapshot) map[string]float64 {
+	var elapsed float64
+	elapsed = snapshot2.Time.Sub(snapshot.Time).Seconds()
+
+	var kernel_stat map[string]int64
+	var kernel_stat2 map[string]int64
+
+	kernel_stat = snapshot.KernelStat
+	kernel_stat2 = snapshot2.KernelStat
+
+	var kernel_activity map[string]float64
+	kernel_activity = map[string]float64{
+		"kernel_ctxt":          CalculateRate(kernel_stat2["ctxt"]-kernel_stat["ctxt"], elapsed),
+		"kernel_intr":          CalculateRate(kernel_stat2["intr"]-kernel_stat["intr"], elapsed),
+		"kernel_forks":         CalculateRate(kernel_stat2["processes"]-kernel_stat["processes"], elapsed),
+		"kernel_procs_running": float64(kernel_stat2["procs_running"]),
+		"kernel_procs_blocked": float64(kernel_stat2["procs_blocked"]),
+		"vm_pgpgin":            CalculateRate(kernel_stat2["pgpgin"]-kernel_stat["pgpgin"], elapsed),
+		"vm_pgpgout":           CalculateRate(kernel_stat2["pgpgout"]-kernel_stat["pgpgout"], elapsed),
+		"vm_pswpin":            CalculateRate(kernel_stat2["pswpin"]-kernel_stat["pswpin"], elapsed),
+		"vm_pswpout":           CalculateRate(kernel_stat2["pswpout"]-kernel_stat["pswpout"], elapsed),
+		"vm_pgmajfault":        CalculateRate(kernel_stat2["pgmajfault"]-kernel_stat["pgmajfault"], elapsed),
+		"vm_oom_kill":          math.Max(float64(kernel_stat2["oom_kill"]-kernel_stat["oom_kill"]), 0),
+	}
+
+	return kernel_activity
+}
+
+// A snapshot of the counters, the rates are calculated between two of them.
+type Snapshot struct {
+	Errors       CollectorErrors
+	Time         time.Time
+	Uptime       float64
+	CpuStats     []CpuStat
+	DiskStats    map[string][]int64
+	NicStats     []NicStat
+	ProcessStats map[int64]ProcessStat
+	CgroupStats  map[string]CgroupStat
+	KernelStat   map[string]int64
+}
+
+// The errors of the collectors of a sample, keyed by the name of the
+// collector, e.g. users: open /var/run/utmp: no such file or directory
+type CollectorErrors map[string]string
+
+// Runs a collector, a panic of which is recorded instead of failing the whole
+// sample. Returns whether it succeeded.
+func (collector_errors CollectorErrors) Collect(name string, collector func()) (ok bool) {
+	defer func() {
+		var err interface{}
+		err = recover()
+		if err != nil {
+			log.Println(err)
+			log.Println(string(debug.Stack()))
+			collector_errors[name] = fmt.Sprint(err)
+			ok = false
+		}
+	}()
+
+	collector()
+
+	return true
+}
+
+func TakeSnapshot() Snapshot {
+	var snapshot Snapshot
+	snapshot = Snapshot{
+		Errors: make(CollectorErrors),
+		Time:   time.Now(),
+	}
+
+	// A stat which could not be read is left empty, see GetHostMetric()
+	snapshot.Errors.Collect("uptime", func() { snapshot.Uptime = ReadUptime() })
+	snapshot.Errors.Collect("cpu_stat", func() { snapshot.CpuStats = ReadCpuStat() })
+	snapshot.Errors.Collect("disk_stat", func() { snapshot.DiskStats = ReadDiskStat() })
+	snapshot.Errors.Collect("nic_stat", func() { snapshot.NicStats = ReadNicStat() })
+	snapshot.Errors.Collect("kernel_stat", func() { snapshot.KernelStat = ReadKernelStat() })
+
+	// The collectors which need them may all be disabled
+	if IsCollectorEnabled("processes") || IsCollectorEnabled("watched_processes") || IsCollectorEnabled("listening_ports") {
+		snapshot.Errors.Collect("process_stats", func() { snapshot.ProcessStats = ReadProcessStats() })
+	}
+	if IsCollectorEnabled("cgroups") {
+		snapshot.Errors.Collect("cgroup_stats", func() { snapshot.CgroupStats = ReadCgroupStats() })
+	}
+
+	return snapshot
+}
+
+// Sampler keeps the previous snapshot, so that every rate is calculated over
+// the whole reporting interval, instead of sleeping for a second in each
+// collector.
+type Sampler struct {
+	mutex    sync.Mutex
+	snapshot *Snapshot
+}
+
+var SAMPLER Sampler
+
+// Returns the previous snapshot and the current one, which is kept for the
+// next call. On the first call, there is no previous snapshot yet, so it is
+// taken a second earlier.
+func (sampler *Sampler) Sample() (Snapshot, Snapshot) {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	if sampler.snapshot == nil {
+		var snapshot Snapshot
+		snapshot = TakeSnapshot()
+		sampler.snapshot = &snapshot
+		time.Sleep(1 * time.Second)
+	}
+
+	var snapshot Snapshot
+	var snapshot2 Snapshot
+
+	snapshot = *sampler.snapshot
+	snapshot2 = TakeSnapshot()
+
+	sampler.snapshot = &snapshot2
+
+	return snapshot, snapshot2
+}
+
+// The metrics sampled every SETTINGS.SAMPLE_INTERVAL seconds, see Aggregator
+var AGGREGATE_METRICS = []string{
+	"cpu_used",
+	"cpu_iowait",
+	"mem_used",
+	"swap_used",
+	"disk_read_rate",
+	"disk_write_rate",
+	"disk_ios",
+	"nic_receive_rate",
+	"nic_transmit_rate",
+}
+
+// Aggregator samples a few metrics more often than they are reported, so that
+// the spikes shorter than the metric interval are not averaged out. Their min,
+// max, avg and last values are reported along with the other metrics.
+type Aggregator struct {
+	mutex    sync.Mutex
+	snapshot *Snapshot
+	values   map[string][]float64
+}
+
+var AGGREGATOR Aggregator
+
+func (aggregator *Aggregator) Run() {
+	for {
+		SETTINGS_MUTEX.RLock()
+		var sample_interval int
+		sample_interval = SETTINGS.SAMPLE_INTERVAL
+		if sample_interval > 0 {
+			aggregator.Sample()
+		} else {
+			aggregator.Reset()
+		}
+		SETTINGS_MUTEX.RUnlock()
+
+		// Until it is enabled by a reload of the config file
+		if sample_interval == 0 {
+			sample_interval = 1
+		}
+		time.Sleep(time.Duration(sample_interval) * time.Second)
+	}
+}
+
+func (aggregator *Aggregator) Sample() {
+	defer Catch()
+
+	var snapshot2 Snapshot
+	snapshot2 = Snapshot{
+		Time:      time.Now(),
+		CpuStats:  ReadCpuStat(),
+		DiskStats: ReadDiskStat(),
+		NicStats:  ReadNicStat(),
+	}
+
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+
+	if aggregator.snapshot != nil {
+		var snapshot Snapshot
+		snapshot = *aggregator.snapshot
+
+		var values map[string]float64
+		values, _ = GetCpuUsage(snapshot, snapshot2)
+
+		values["mem_used"], values["swap_used"] = GetMemUsage()
+		values["disk_read_rate"], values["disk_write_rate"], values["disk_ios"], _ = GetDiskIoRate(snapshot, snapshot2)
+		values["nic_receive_rate"], _, values["nic_transmit_rate"], _, _ = GetNicIoRate(snapshot, snapshot2)
+
+		if aggregator.values == nil {
+			aggregator.values = make(map[string][]float64)
+		}
+
+		var name string
+		for _, name = range AGGREGATE_METRICS {
+			aggregator.values[name] = append(aggregator.values[name], values[name])
+		}
+	}
+
+	aggregator.snapshot = &snapshot2
+}
+
+func (aggregator *Aggregator) Reset() {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+
+	aggregator.snapshot = nil
+	aggregator.values = nil
+}
+
+// The min, max, avg and last values of each metric since the previous call,
+// empty if sub-interval sampling is disabled.
+func (aggregator *Aggregator) Flush() []map[string]interface{} {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+
+	var aggregates []map[string]interface{}
+	aggregates = make([]map[string]interface{}, 0)
+
+	var name string
+	for _, name = range AGGREGATE_METRICS {
+		var values []float64
+		values = aggregator.values[name]
+
+		if len(values) == 0 {
+			continue
+		}
+
+		var min_value float64
+		var max_value float64
+		var sum_value float64
+
+		min_value = values[0]
+		max_value = values[0]
+
+		var value float64
+		for _, value = range values {
+			min_value = math.Min(min_value, value)
+			max_value = math.Max(max_value, value)
+			sum_value += value
+		}
+
+		aggregates = append(aggregates, map[string]interface{}{
+			"name":       name,
+			"min_value":  min_value,
+			"max_value":  max_value,
+			"avg_value":  math.Round(sum_value/float64(len(values))*100) / 100,
+			"last_value": values[len(values)-1],
+		})
+	}
+
+	aggregator.values = nil
+
+	return aggregates
+}
+
+// Per second, rounded to 2 decimal places
+func CalculateRate(delta int64, elapsed float64) float64 {
+	if elapsed <= 0 || delta < 0 {
+		return 0
+	}
+	return math.Round(float64(delta)/elapsed*100) / 100
+}
+
+func GetCurrentTime() string {
+	var current_time string
+	current_time = time.Now().Format("2006-01-02 15:04:05")
+	return current_time
+}
+
+// code
+// hostname
+// ip
+// interfaces
+// labels
+// os_type
+// architecture
+// cpu_processors
+// mem_size
+// swap_size
+// disk_size
+// uptime
+// heartbeat_time
+// project
+// version
+func GetHost() []byte {
+	defer Catch()
+
+	var err error
+
+	var host map[string]interface{}
+	host = map[string]interface{}{
+		"code":           GetCode(),
+		"legacy_code":    GetLegacyCode(),
+		"hostname":       GetHostname(),
+		"ip":             GetIp(),
+		"interfaces":     GetInterfaces(),
+		"labels":         GetLabels(),
+		"os_type":        GetOsType(),
+		"architecture":   GetArchitecture(),
+		"cpu_processors": GetCpuProcessors(),
+		"mem_size":       GetMemSize(),
+		"swap_size":      GetSwapSize(),
+		"disk_size":      GetDiskSize(),
+		"uptime":         GetUptime(),
+		"heartbeat_time": GetCurrentTime(),
+		"project":        SETTINGS.PROJECT,
+		"version":        SETTINGS.VERSION,
+	}
+
+	if SETTINGS.DEBUG {
+		var tmp []byte
+		tmp, err = json.MarshalIndent(host, "", "    ")
+		Skip(err)
+		log.Println("host: \n" + string(tmp))
+	}
+
+	var host2 []byte
+	host2, err = json.Marshal(host)
+	Throw(err)
+
+	return host2
+}
+
+// code
+// hostname
+// loadavg: loadavg_1m, loadavg_5m, loadavg_15m
+// pressure: psi_supported, psi_{cpu,memory,io}_{some,full}_{avg10,avg60,total}
+// cpu_usage: cpu_used, cpu_user, cpu_nice, cpu_system, cpu_idle, cpu_iowait, cpu_irq, cpu_softirq, cpu_steal, cpu_guest, cpu_guest_nice
+// cpu_cores
+// kernel_activity: kernel_ctxt, kernel_intr, kernel_forks, kernel_procs_running, kernel_procs_blocked,
+// vm_pgpgin, vm_pgpgout, vm_pswpin, vm_pswpout, vm_pgmajfault, vm_oom_kill
+// mem_usage: mem_used, swap_used
+// mem_breakdown: mem_apps, mem_hugepages_total, mem_buffers, mem_cached, mem_shmem, mem_slab, mem_free,
+// mem_available, mem_slab_reclaimable, mem_dirty, mem_writeback, mem_hugepages_used, mem_committed_as
+// disk_usage: disk_used, inode_used
+// disk_io_rate: disk_read_rate, disk_write_rate, disk_ios
+// disks
+// nic_io_rate: nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets
+// nics
+// tcp_sockets: tcp_sockets_inuse, tcp_sockets_tw
+// tcp_states: tcp_established, tcp_syn_sent, ..., tcp_new_syn_recv
+// listening_ports
+// processes
+// watched_processes
+// cgroups
+// custom_metrics
+// log_events
+// users
+// errors
+// heartbeat_time
+// project
+func GetHostMetric() []byte {
+	defer Catch()
+
+	var err error
+
+	var code string
+	var hostname string
+	var ip string
+	var loadavg_1m float64
+	var loadavg_5m float64
+	var loadavg_15m float64
+	var psi_supported bool
+	var pressure map[string]float64
+	var cpu_usage map[string]float64
+	var cpu_cores string
+	var kernel_activity map[string]float64
+	var mem_used float64
+	var swap_used float64
+	var mem_breakdown map[string]float64
+	var disk_usage string
+	var disk_used float64
+	var inode_used float64
+	var disk_read_rate float64
+	var disk_write_rate float64
+	var disk_ios float64
+	var disks []map[string]interface{}
+	var nic_receive_rate float64
+	var nic_receive_packets float64
+	var nic_transmit_rate float64
+	var nic_transmit_packets float64
+	var nics []map[string]interface{}
+	var tcp_sockets_inuse int64
+	var tcp_sockets_tw int64
+	var tcp_states map[string]int64
+	var listening_ports []map[string]interface{}
+	var processes []map[string]interface{}
+	var watched_processes []map[string]interface{}
+	var cgroups []map[string]interface{}
+	var custom_metrics []map[string]interface{}
+	var log_events []map[string]interface{}
+	var counters map[string]interface{}
+	var users int64
+	var heartbeat_time string
+	var project string
+
+	var snapshot Snapshot
+	var snapshot2 Snapshot
+	snapshot, snapshot2 = SAMPLER.Sample()
+
+	// The stats of the snapshot which could not be read, on which the
+	// collectors below report zeros
+	var collector_errors CollectorErrors
+	collector_errors = make(CollectorErrors)
+
+	var name string
+	var message string
+	for name, message = range snapshot2.Errors {
+		collector_errors[name] = message
+	}
+
+	code = GetCode()
+	hostname = GetHostname()
+	ip = GetIp()
+	collector_errors.Collect("loadavg", func() {
+		loadavg_1m, loadavg_5m, loadavg_15m = GetLoadavg()
+	})
+	if IsCollectorDue("pressure") {
+		collector_errors.Collect("pressure", func() {
+			psi_supported, pressure = GetPressure()
+		})
+	}
+	collector_errors.Collect("cpu_usage", func() {
+		cpu_usage, cpu_cores = GetCpuUsage(snapshot, snapshot2)
+	})
+	if IsCollectorDue("kernel") {
+		collector_errors.Collect("kernel", func() {
+			kernel_activity = GetKernelActivity(snapshot, snapshot2)
+		})
+	}
+	collector_errors.Collect("mem_usage", func() {
+		mem_used, swap_used = GetMemUsage()
+	})
+	if IsCollectorDue("mem_breakdown") {
+		collector_errors.Collect("mem_breakdown", func() {
+			mem_breakdown = GetMemBreakdown()
+		})
+	}
+	collector_errors.Collect("disk_usage", func() {
+		disk_usage, disk_used, inode_used = GetDiskUsage()
+	})
+	collector_errors.Collect("disk_io_rate", func() {
+		disk_read_rate, disk_write_rate, disk_ios, disks = GetDiskIoRate(snapshot, snapshot2)
+	})
+	collector_errors.Collect("nic_io_rate", func() {
+		nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets, nics = GetNicIoRate(snapshot, snapshot2)
+	})
+	collector_errors.Collect("tcp_sockets", func() {
+		tcp_sockets_inuse, tcp_sockets_tw = GetTcpSockets()
+	})
+
+	var is_tcp_states_due bool
+	var is_listening_ports_due bool
+	is_tcp_states_due = IsCollectorDue("tcp_states")
+	is_listening_ports_due = IsCollectorDue("listening_ports")
+
+	if is_tcp_states_due || is_listening_ports_due {
+		// Shared by both, so the error is reported under the first one due.
+		// Without the sockets, listening_ports is not sent at all, otherwise
+		// lnxmonsrv would take all of the ports for gone.
+		name = "tcp_states"
+		if !is_tcp_states_due {
+			name = "listening_ports"
+		}
+
+		var tcp_sockets []TcpSocket
+		if collector_errors.Collect(name, func() { tcp_sockets = ReadTcpSockets() }) {
+			if is_tcp_states_due {
+				collector_errors.Collect("tcp_states", func() {
+					tcp_states = GetTcpStates(tcp_sockets)
+				})
+			}
+			if is_listening_ports_due {
+				collector_errors.Collect("listening_ports", func() {
+					listening_ports = GetListeningPorts(tcp_sockets, snapshot2)
+				})
+			}
+		}
+	}
+
+	// Without the stats, every watched process would be taken for down
+	var is_process_stats_failed bool
+	var is_cgroup_stats_failed bool
+	_, is_process_stats_failed = snapshot2.Errors["process_stats"]
+	_, is_cgroup_stats_failed = snapshot2.Errors["cgroup_stats"]
+
+	if IsCollectorDue("processes") && !is_process_stats_failed {
+		collector_errors.Collect("processes", func() {
+			processes = GetProcesses(snapshot, snapshot2)
+		})
+	}
+	if IsCollectorDue("watched_processes") && !is_process_stats_failed {
+		collector_errors.Collect("watched_processes", func() {
+			watched_processes = GetWatchedProcesses(snapshot, snapshot2)
+		})
+	}
+	if IsCollectorDue("cgroups") && !is_cgroup_stats_failed {
+		collector_errors.Collect("cgroups", func() {
+			cgroups = GetCgroups(snapshot, snapshot2)
+		})
+	}
+	if IsCollectorDue("custom") && (len(SETTINGS.CUSTOM_SCRIPTS) > 0 || SETTINGS.TEXTFILE_DIR != "" || SETTINGS.STATSD_ADDRESS != "" || SETTINGS.STATSD_SOCKET != "") {
+		collector_errors.Collect("custom", func() {
+			custom_metrics = GetCustomMetrics(collector_errors)
+		})
+	}
+	// The StatsD listener runs whether the collector is enabled or not, what
+	// it received is dropped rather than kept forever if disabled
+	if !IsCollectorEnabled("custom") && (SETTINGS.STATSD_ADDRESS != "" || SETTINGS.STATSD_SOCKET != "") {
+		STATSD.Flush(CollectorErrors{})
+	}
+	if IsCollectorDue("log_watch") && len(SETTINGS.LOG_WATCHES) > 0 {
+		collector_errors.Collect("log_watch", func() {
+			var custom_metrics2 []map[string]interface{}
+			custom_metrics2, log_events = GetLogMatches(collector_errors)
+			custom_metrics = append(custom_metrics, custom_metrics2...)
+		})
+	}
+	// A partial snapshot would be taken for a reset of the counters
+	if SETTINGS.RAW_COUNTERS && len(snapshot2.Errors) == 0 {
+		collector_errors.Collect("counters", func() {
+			counters = GetCounters(snapshot2)
+		})
+	}
+	collector_errors.Collect("users", func() {
+		users = GetUsers()
+	})
+	heartbeat_time = snapshot2.Time.Format("2006-01-02 15:04:05")
+	project = SETTINGS.PROJECT
+
+	var host_metric map[string]interface{}
+	host_metric = map[string]interface{}{
+		"code":                 code,
+		"hostname":             hostname,
+		"ip":                   ip,
+		"loadavg_1m":           loadavg_1m,
+		"loadavg_5m":           loadavg_5m,
+		"loadavg_15m":          loadavg_15m,
+		"psi_supported":        psi_supported,
+		"cpu_cores":            cpu_cores,
+		"mem_used":             mem_used,
+		"swap_used":            swap_used,
+		"disk_usage":           disk_usage,
+		"disk_used":            disk_used,
+		"inode_used":           inode_used,
+		"disk_read_rate":       disk_read_rate,
+		"disk_write_rate":      disk_write_rate,
+		"disk_ios":             disk_ios,
+		"disks":                disks,
+		"nic_receive_rate":     nic_receive_rate,
+		"nic_receive_packets":  nic_receive_packets,
+		"nic_transmit_rate":    nic_transmit_rate,
+		"nic_transmit_packets": nic_transmit_packets,
+		"nics":                 nics,
+		"tcp_sockets_inuse":    tcp_sockets_inuse,
+		"tcp_sockets_tw":       tcp_sockets_tw,
+		"listening_ports":      listening_ports,
+		"processes":            processes,
+		"watched_processes":    watched_processes,
+		"cgroups":              cgroups,
+		"custom_metrics":       custom_metrics,
+		"log_events":           log_events,
+		"aggregates":           AGGREGATOR.Flush(),
+		"counters":             counters,
+		"users":                users,
+		"errors":               collector_errors,
+		"heartbeat_time":       heartbeat_time,
+		"project":              project,
+	}
+
+	var key string
+	var value float64
+	for key, value = range cpu_usage {
+		host_metric[key] = value
+	}
+
+	// The values of the collectors of the columns of t_host_metric_%s, nil
+	// unless they ran
+	var collector_values map[string]map[string]interface{}
+	collector_values = make(map[string]map[string]interface{})
+
+	if pressure != nil {
+		collector_values["pressure"] = map[string]interface{}{"psi_supported": psi_supported}
+		for key, value = range pressure {
+			collector_values["pressure"][key] = value
+		}
+	}
+	if kernel_activity != nil {
+		collector_values["kernel"] = make(map[string]interface{})
+		for key, value = range kernel_activity {
+			collector_values["kernel"][key] = value
+		}
+	}
+	if mem_breakdown != nil {
+		collector_values["mem_breakdown"] = make(map[string]interface{})
+		for key, value = range mem_breakdown {
+			collector_values["mem_breakdown"][key] = value
+		}
+	}
+	if tcp_states != nil {
+		collector_values["tcp_states"] = make(map[string]interface{})
+
+		var value2 int64
+		for key, value2 = range tcp_states {
+			collector_values["tcp_states"][key] = value2
+		}
+	}
+
+	// A collector with an interval is not due in every sample, in which its
+	// last values are sent again, as lnxmonsrv would store 0 for the missing
+	// columns. Not if it failed, or was disabled since.
+	for _, name = range []string{"pressure", "kernel", "mem_breakdown", "tcp_states"} {
+		var values map[string]interface{}
+		values = collector_values[name]
+
+		var is_failed bool
+		_, is_failed = collector_errors[name]
+
+		if values != nil {
+			COLLECTOR_LAST_VALUES[name] = values
+		} else if !IsCollectorEnabled(name) {
+			delete(COLLECTOR_LAST_VALUES, name)
+		} else if !is_failed {
+			values = COLLECTOR_LAST_VALUES[name]
+		}
+
+		var value3 interface{}
+		for key, value3 = range values {
+			host_metric[key] = value3
+		}
+	}
+
+	if SETTINGS.DEBUG {
+		var tmp []byte
+		tmp, err = json.MarshalIndent(host_metric, "", "    ")
+		Skip(err)
+		log.Println("host_metric: \n" + string(tmp))
+	}
+
+	var host_metric2 []byte
+	host_metric2, err = json.Marshal(host_metric)
+	Throw(err)
+
+	return host_metric2
+}
+
+// The optional collectors, each of them can be disabled or run less often than
+// every report in the config file, e.g.
+// "collectors": {"processes": {"interval": 300}, "cgroups": {"enabled": false}}
+type Collector struct {
+	Enabled  bool
+	Interval int
+}
+
+var COLLECTOR_NAMES = []string{
+	"pressure",
+	"kernel",
+	"mem_breakdown",
+	"tcp_states",
+	"listening_ports",
+	"processes",
+	"watched_processes",
+	"cgroups",
+	"custom",
+	"log_watch",
+}
+
+// Enabled unless set otherwise
+func (collector *Collector) UnmarshalJSON(data []byte) error {
+	var err error
+
+	type collector2 Collector
+
+	var value collector2
+	value = collector2{Enabled: true}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	*collector = Collector(value)
+	return nil
+}
+
+func IsCollectorEnabled(name string) bool {
+	var collector Collector
+	var ok bool
+	collector, ok = SETTINGS.COLLECTORS[name]
+	return !ok || collector.Enabled
+}
+
+// The last time each collector ran, see IsCollectorDue()
+var COLLECTOR_RUN_TIMES = map[string]time.Time{}
+
+// The last values of the collectors of the columns of t_host_metric_%s, see
+// GetHostMetric()
+var COLLECTOR_LAST_VALUES = map[string]map[string]interface{}{}
+
+// Whether the collector is enabled and its interval has elapsed since it last
+// ran, in which case it is expected to run now.
+func IsCollectorDue(name string) bool {
+	if !IsCollectorEnabled(name) {
+		return false
+	}
+
+	var now time.Time
+	now = time.Now()
+
+	var interval time.Duration
+	interval = time.Duration(SETTINGS.COLLECTORS[name].Interval) * time.Second
+
+	if interval > 0 && now.Sub(COLLECTOR_RUN_TIMES[name]) < interval {
+		return false
+	}
+
+	COLLECTOR_RUN_TIMES[name] = now
+	return true
+}
+
+// Reads the config file over the settings of the command line, a key of the
+// config file takes precedence over the corresponding flag, e.g.
+//
+//	{
+//	    "api": "http://10.0.0.1:1234/api",
+//	    "token": "123456",
+//	    "project": "web",
+//	    "labels": {"env": "prod"},
+//	    "host_interval": 300,
+//	    "metric_interval": 60,
+//	    "mount_exclude": "^/boot",
+//	    "watch_processes": ["name:nginx"],
+//	    "collectors": {"cgroups": {"enabled": false}}
+//	}
+func LoadConfig(path string, base Settings) (Settings, error) {
+	var err error
+
+	var settings Settings
+	settings = base
+
+	// Replaced rather than merged, without touching the ones of base
+	settings.WATCH_PROCESSES = nil
+	settings.CUSTOM_SCRIPTS = nil
+	settings.LOG_WATCHES = nil
+	settings.LABELS = nil
+	settings.COLLECTORS = nil
+
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil {
+		return base, err
+	}
+	defer file.Close()
+
+	var decoder *json.Decoder
+	decoder = json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&settings)
+	if err != nil {
+		return base, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+
+	if settings.WATCH_PROCESSES == nil {
+		settings.WATCH_PROCESSES = base.WATCH_PROCESSES
+	}
+	if settings.CUSTOM_SCRIPTS == nil {
+		settings.CUSTOM_SCRIPTS = base.CUSTOM_SCRIPTS
+	}
+	if settings.LOG_WATCHES == nil {
+		settings.LOG_WATCHES = base.LOG_WATCHES
+	}
+	if settings.LABELS == nil {
+		settings.LABELS = base.LABELS
+	}
+	if settings.COLLECTORS == nil {
+		settings.COLLECTORS = base.COLLECTORS
+	}
+
+	settings, err = CompileFilters(settings)
+	if err != nil {
+		return base, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+
+	err = CheckSettings(settings)
+	if err != nil {
+		return base, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+
+	return settings, nil
+}
+
+// The filters of the interfaces and the mount points are compiled once, when
+// the settings are loaded, rather than on each sample.
+func CompileFilters(settings Settings) (Settings, error) {
+	var err error
+
+	settings.nic_include, err = CompileFilter("nic_include", settings.NIC_INCLUDE)
+	if err != nil {
+		return settings, err
+	}
+	settings.nic_exclude, err = CompileFilter("nic_exclude", settings.NIC_EXCLUDE)
+	if err != nil {
+		return settings, err
+	}
+	settings.mount_include, err = CompileFilter("mount_include", settings.MOUNT_INCLUDE)
+	if err != nil {
+		return settings, err
+	}
+	settings.mount_exclude, err = CompileFilter("mount_exclude", settings.MOUNT_EXCLUDE)
+	if err != nil {
+		return settings, err
+	}
+
+	return settings, nil
+}
+
+// An empty filter is nil, i.e. not applied
+func CompileFilter(name string, value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var err error
+
+	var re *regexp.Regexp
+	re, err = regexp.Compile(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid %s: %v", name, err))
+	}
+
+	return re, nil
+}
+
+func CheckSettings(settings Settings) error {
+	var err error
+
+	var api *url.URL
+	api, err = url.Parse(settings.API)
+	if err != nil || (api.Scheme != "http" && api.Scheme != "https") || api.Host == "" {
+		return errors.New(fmt.Sprintf("invalid api: %q", settings.API))
+	}
+
+	if settings.PROJECT == "" {
+		return errors.New("empty project")
+	}
+
+	if settings.TOP < 0 {
+		return errors.New(fmt.Sprintf("invalid top: %d", settings.TOP))
+	}
+	if settings.CGROUP_DEPTH < 1 {
+		return errors.New(fmt.Sprintf("invalid cgroup_depth: %d", settings.CGROUP_DEPTH))
+	}
+	if settings.HOST_INTERVAL < 1 {
+		return errors.New(fmt.Sprintf("invalid host_interval: %d", settings.HOST_INTERVAL))
+	}
+	if settings.METRIC_INTERVAL < 1 {
+		return errors.New(fmt.Sprintf("invalid metric_interval: %d", settings.METRIC_INTERVAL))
+	}
+	if settings.SPOOL_SIZE < 0 {
+		return errors.New(fmt.Sprintf("invalid spool_size: %d", settings.SPOOL_SIZE))
+	}
+	if settings.SAMPLE_INTERVAL < 0 || (settings.SAMPLE_INTERVAL > 0 && settings.SAMPLE_INTERVAL >= settings.METRIC_INTERVAL) {
+		return errors.New(fmt.Sprintf("invalid sample_interval: %d, shorter than metric_interval or 0", settings.SAMPLE_INTERVAL))
+	}
+	if settings.LISTEN != "" {
+		_, _, err = net.SplitHostPort(settings.LISTEN)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid listen: %q", settings.LISTEN))
+		}
+	}
+	if settings.STATSD_ADDRESS != "" {
+		_, _, err = net.SplitHostPort(settings.STATSD_ADDRESS)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid statsd_address: %q", settings.STATSD_ADDRESS))
+		}
+	}
+	if settings.LOG_SAMPLES < 0 {
+		return errors.New(fmt.Sprintf("invalid log_samples: %d", settings.LOG_SAMPLES))
+	}
+	if settings.REPORT_INTERVAL < 0 {
+		return errors.New(fmt.Sprintf("invalid report_interval: %d", settings.REPORT_INTERVAL))
+	}
+	// The samples are kept in the spool until the next report
+	if settings.REPORT_INTERVAL > settings.METRIC_INTERVAL && (settings.SPOOL_DIR == "" || settings.SPOOL_SIZE == 0) {
+		return errors.New("report_interval needs the spool")
+	}
+
+	var key string
+	var value string
+	for key, value = range settings.LABELS {
+		if key == "" || strings.ContainsAny(key+value, "=,") {
+			return errors.New(fmt.Sprintf("invalid label: %q=%q", key, value))
+		}
+	}
+
+	var name string
+	var collector Collector
+	for name, collector = range settings.COLLECTORS {
+		var name2 string
+		var ok bool
+		for _, name2 = range COLLECTOR_NAMES {
+			if name == name2 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return errors.New(fmt.Sprintf("unknown collector: %q, one of %s", name, strings.Join(COLLECTOR_NAMES, ", ")))
+		}
+		if collector.Interval < 0 {
+			return errors.New(fmt.Sprintf("invalid interval of collector %s: %d", name, collector.Interval))
+		}
+	}
+
+	return nil
+}
+
+// Reloads the config file on SIGHUP, an invalid one is logged and ignored so
+// that lnxmoncli keeps running with the previous settings.
+func WatchConfig(path string, base Settings) {
+	var signals chan os.Signal
+	signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Println("reloading config:", path)
+
+		var settings Settings
+		var err error
+		settings, err = LoadConfig(path, base)
+		if err != nil {
+			log.Println(err)
+			log.Println("config not reloaded")
+			continue
+		}
+
+		REPORT_MUTEX.Lock()
+		SETTINGS_MUTEX.Lock()
+		SETTINGS = settings
+		SETTINGS_MUTEX.Unlock()
+		REPORT_MUTEX.Unlock()
+
+		log.Printf("SETTINGS: %+v\n", settings)
+	}
+}
+
+// The interval of ReportHost() or ReportHostMetric(), which is shortened to a
+// few seconds with --debug.
+func GetInterval(interval int, debug_interval int) time.Duration {
+	if SETTINGS.DEBUG {
+		return time.Duration(debug_interval) * time.Second
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// Whether a payload which failed with this status is worth sending again, i.e.
+// the server could not be reached or failed rather than rejected it. A wrong
+// token is retried as well, since the payload is fine.
+func IsRetryable(http_status_code int64) bool {
+	return http_status_code == 0 || http_status_code == 401 || http_status_code >= 500
+}
+
+// The payloads which could not be sent are kept in SETTINGS.SPOOL_DIR, one
+// file per payload named after the time it was spooled, so that they are sorted
+// in the order they are to be replayed.
+func SpoolPayload(data []byte) {
+	defer Catch()
+
+	if SETTINGS.SPOOL_DIR == "" || SETTINGS.SPOOL_SIZE == 0 {
+		log.Println("spool disabled, payload dropped")
+		return
+	}
+
+	var err error
+
+	err = os.MkdirAll(SETTINGS.SPOOL_DIR, 0700)
+	Throw(err)
+
+	var path string
+	path = filepath.Join(SETTINGS.SPOOL_DIR, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+
+	// Never replay a partially written payload
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	Throw(err)
+	err = os.Rename(path+".tmp", path)
+	Throw(err)
+
+	log.Println("payload spooled:", path)
+
+	TrimSpool()
+}
+
+// The spooled payloads, oldest first
+func ListSpool() []os.FileInfo {
+	var err error
+
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(SETTINGS.SPOOL_DIR)
+	if err != nil {
+		return nil
+	}
+
+	var files2 []os.FileInfo
+
+	var file os.FileInfo
+	for _, file = range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			files2 = append(files2, file)
+		}
+	}
+
+	return files2
+}
+
+// Drops the oldest payloads once the spool exceeds SETTINGS.SPOOL_SIZE MiB
+func TrimSpool() {
+	var files []os.FileInfo
+	files = ListSpool()
+
+	var spool_size int64
+
+	var file os.FileInfo
+	for _, file = range files {
+		spool_size += file.Size()
+	}
+
+	var dropped int
+	for _, file = range files {
+		if spool_size <= int64(SETTINGS.SPOOL_SIZE)*1024*1024 {
+			break
+		}
+
+		RemoveSpooled(filepath.Join(SETTINGS.SPOOL_DIR, file.Name()))
+		spool_size -= file.Size()
+		dropped++
+	}
+
+	if dropped > 0 {
+		log.Printf("spool full, %d oldest payload(s) dropped\n", dropped)
+	}
+}
+
+// Number of the spooled payloads sent at once, an hour of samples by default
+const SPOOL_BATCH = 60
+
+// A spooled payload on which lnxmonsrv keeps failing with 500, e.g. because it
+// panics on it, is dropped after so many attempts, otherwise it would hold up
+// all of the newer ones until the spool is full.
+const SPOOL_MAX_ATTEMPTS = 10
+
+// The attempts of the spooled payloads which failed with 500, by path
+var SPOOL_ATTEMPTS = map[string]int{}
+
+func RemoveSpooled(path string) {
+	Skip(os.Remove(path))
+	delete(SPOOL_ATTEMPTS, path)
+}
+
+// Sends the spooled payloads in order, in gzipped batches to
+// /api/report_host_metrics, stopping at the first batch which fails. A batch
+// which failed with 500 SPOOL_MAX_ATTEMPTS times is sent one payload at a time
+// to find the one lnxmonsrv fails on. Returns whether the spool is now empty.
+func ReplaySpool() bool {
+	var files []os.FileInfo
+	files = ListSpool()
+
+	if len(files) > 0 {
+		log.Printf("replaying %d spooled payload(s)\n", len(files))
+	}
+
+	var api string
+	api = fmt.Sprintf("%s/report_host_metrics", SETTINGS.API)
+
+	for len(files) > 0 {
+		var count int
+		count = len(files)
+		if count > SPOOL_BATCH {
+			count = SPOOL_BATCH
+		}
+
+		var paths []string
+		var payloads [][]byte
+
+		var file os.FileInfo
+		for _, file = range files[:count] {
+			var path string
+			path = filepath.Join(SETTINGS.SPOOL_DIR, file.Name())
+
+			var data []byte
+			var err error
+			data, err = ioutil.ReadFile(path)
+			if err != nil {
+				Skip(err)
+				RemoveSpooled(path)
+				continue
+			}
+
+			paths = append(paths, path)
+			payloads = append(payloads, data)
+		}
+		files = files[count:]
+
+		if len(payloads) == 0 {
+			continue
+		}
+
+		var batch []byte
+		batch = append([]byte("["), bytes.Join(payloads, []byte(","))...)
+		batch = append(batch, ']')
+
+		var http_status_code int64
+		http_status_code = HttpPostGzip(api, batch)
+
+		// An older lnxmonsrv, one payload at a time
+		if http_status_code == 404 {
+			for _, file = range files {
+				paths = append(paths, filepath.Join(SETTINGS.SPOOL_DIR, file.Name()))
+			}
+			return ReplaySpoolOneByOne(paths)
+		}
+
+		if http_status_code == 500 {
+			SPOOL_ATTEMPTS[paths[0]]++
+			if SPOOL_ATTEMPTS[paths[0]] < SPOOL_MAX_ATTEMPTS {
+				return false
+			}
+
+			if !ReplaySpoolOneByOne(paths) {
+				return false
+			}
+			continue
+		}
+
+		if http_status_code != 200 && IsRetryable(http_status_code) {
+			return false
+		}
+		if http_status_code != 200 {
+			log.Printf("spooled batch rejected, %d payload(s) dropped\n", len(paths))
+		}
+
+		var path string
+		for _, path = range paths {
+			RemoveSpooled(path)
+		}
+	}
+
+	return true
+}
+
+func ReplaySpoolOneByOne(paths []string) bool {
+	var api string
+	api = fmt.Sprintf("%s/report_host_metric", SETTINGS.API)
+
+	var path string
+	for _, path = range paths {
+		var data []byte
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err == nil {
+			var http_status_code int64
+			http_status_code = HttpPost(api, data)
+
+			if http_status_code == 500 {
+				SPOOL_ATTEMPTS[path]++
+				if SPOOL_ATTEMPTS[path] < SPOOL_MAX_ATTEMPTS {
+					return false
+				}
+				log.Printf("spooled payload failed %d times, dropped: %s\n", SPOOL_ATTEMPTS[path], path)
+			} else if http_status_code != 200 && IsRetryable(http_status_code) {
+				return false
+			} else if http_status_code != 200 {
+				log.Println("spooled payload rejected, dropped:", path)
+			}
+		} else {
+			Skip(err)
+		}
+
+		RemoveSpooled(path)
+	}
+
+	return true
+}
+
+// Backoff delays the next attempt exponentially after consecutive failures,
+// with a random jitter so that the agents of a fleet do not all come back at
+// the same time to a recovering server.
+type Backoff struct {
+	failures int
+	next     time.Time
+}
+
+var BACKOFF Backoff
+
+func (backoff *Backoff) IsReady() bool {
+	return !time.Now().Before(backoff.next)
+}
+
+// From one interval up to 32 intervals, at most 10 minutes, of which a random
+// half is waited on top of the other half.
+func (backoff *Backoff) Fail(interval time.Duration) {
+	var shift int
+	shift = backoff.failures
+	if shift > 5 {
+		shift = 5
+	}
+	backoff.failures++
+
+	var delay time.Duration
+	delay = interval << uint(shift)
+	if delay > 10*time.Minute {
+		delay = 10 * time.Minute
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	backoff.next = time.Now().Add(delay)
+	log.Printf("backing off for %v after %d failure(s)\n", delay, backoff.failures)
+}
+
+func (backoff *Backoff) Reset() {
+	backoff.failures = 0
+	backoff.next = time.Time{}
+}
+
+// The last time the spool was sent with --report-interval, see SendHostMetric()
+var REPORT_TIME time.Time
+
+// The spooled payloads are sent first, so that the server receives them in
+// order, then the current one, which is spooled as well if it cannot be sent.
+// With a report interval longer than the metric one, the samples are spooled
+// and sent in a single batch once the report interval has elapsed.
+func SendHostMetric(api string, host_metric []byte, interval time.Duration) {
+	var report_interval time.Duration
+	report_interval = time.Duration(SETTINGS.REPORT_INTERVAL) * time.Second
+
+	if report_interval > interval {
+		SpoolPayload(host_metric)
+
+		if !BACKOFF.IsReady() || time.Since(REPORT_TIME) < report_interval {
+			return
+		}
+		REPORT_TIME = time.Now()
+
+		if ReplaySpool() {
+			BACKOFF.Reset()
+		} else {
+			BACKOFF.Fail(report_interval)
+		}
+		return
+	}
+
+	if !BACKOFF.IsReady() {
+		SpoolPayload(host_metric)
+		return
+	}
+
+	if !ReplaySpool() {
+		BACKOFF.Fail(interval)
+		SpoolPayload(host_metric)
+		return
+	}
+
+	var http_status_code int64
+	http_status_code = HttpPost(api, host_metric)
+
+	if http_status_code != 200 && IsRetryable(http_status_code) {
+		BACKOFF.Fail(interval)
+		SpoolPayload(host_metric)
+		return
+	}
+
+	BACKOFF.Reset()
+}
+
+// The latest payloads of ReportHost() and ReportHostMetric(), which are
+// served on /metrics, so that a scrape does not take a sample of its own and
+// shorten the interval of the next report.
+type Latest struct {
+	mutex       sync.RWMutex
+	host        []byte
+	host_metric []byte
+}
+
+var LATEST Latest
+
+func (latest *Latest) SetHost(host []byte) {
+	latest.mutex.Lock()
+	defer latest.mutex.Unlock()
+
+	latest.host = host
+}
+
+func (latest *Latest) SetHostMetric(host_metric []byte) {
+	latest.mutex.Lock()
+	defer latest.mutex.Unlock()
+
+	latest.host_metric = host_metric
+}
+
+// Returns the payloads decoded, or empty maps before the first report
+func (latest *Latest) Get() (map[string]interface{}, map[string]interface{}) {
+	latest.mutex.RLock()
+	defer latest.mutex.RUnlock()
+
+	var host map[string]interface{}
+	var host_metric map[string]interface{}
+	host = make(map[string]interface{})
+	host_metric = make(map[string]interface{})
+
+	if len(latest.host) > 0 {
+		Skip(json.Unmarshal(latest.host, &host))
+	}
+	if len(latest.host_metric) > 0 {
+		Skip(json.Unmarshal(latest.host_metric, &host_metric))
+	}
+
+	return host, host_metric
+}
+
+var PROMETHEUS_NAME_REGEXP = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// The samples of each metric, which are written grouped by metric as the
+// text exposition format requires.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type PrometheusMetrics struct {
+	types   map[string]string
+	samples map[string][]string
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		types:   make(map[string]string),
+		samples: make(map[string][]string),
+	}
+}
+
+// labels are pairs of names and values, e.g. "mount", "/boot"
+func (metrics *PrometheusMetrics) Add(name string, metric_type string, value float64, labels ...string) {
+	name = "lnxmon_" + PROMETHEUS_NAME_REGEXP.ReplaceAllString(name, "_")
+
+	var pairs []string
+	var i int
+	for i = 0; i+1 < len(labels); i += 2 {
+		var label_value string
+		label_value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", PROMETHEUS_NAME_REGEXP.ReplaceAllString(labels[i], "_"), label_value))
+	}
+
+	var sample string
+	if len(pairs) > 0 {
+		sample = fmt.Sprintf("%s{%s} %s", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+	} else {
+		sample = fmt.Sprintf("%s %s", name, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	metrics.types[name] = metric_type
+	metrics.samples[name] = append(metrics.samples[name], sample)
+}
+
+// The numeric values of a list of devices, e.g. data["nics"], labelled with
+// their names, e.g. lnxmon_nics_receive_rate{interface="eth0"}, which are
+// prefixed with the key so as not to be mixed up with the totals such as
+// lnxmon_nic_receive_rate.
+func (metrics *PrometheusMetrics) AddDevices(prefix string, label string, devices interface{}) {
+	var devices2 []interface{}
+	devices2, _ = devices.([]interface{})
+
+	var value interface{}
+	for _, value = range devices2 {
+		var device map[string]interface{}
+		device, _ = value.(map[string]interface{})
+
+		var name string
+		name, _ = device["name"].(string)
+
+		var key string
+		var value2 interface{}
+		for key, value2 = range device {
+			var number float64
+			var ok bool
+			number, ok = value2.(float64)
+			if ok {
+				metrics.Add(prefix+"_"+key, "gauge", number, label, name)
+			}
+		}
+	}
+}
+
+func (metrics *PrometheusMetrics) String() string {
+	var names []string
+	var name string
+	for name = range metrics.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name = range names {
+		sort.Strings(metrics.samples[name])
+
+		builder.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, metrics.types[name]))
+		builder.WriteString(strings.Join(metrics.samples[name], "\n"))
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// The values of the latest reports in the Prometheus text format, named after
+// the keys of the payloads, in the same units as they are sent to lnxmonsrv,
+// e.g. KiB/s for the rates and % for the usages.
+//
+// lnxmon_host_info: code, hostname, ip, os_type, architecture, version,
+// project and the labels
+// lnxmon_<key>: cpu_used, loadavg_1m, mem_used, tcp_established, ...
+// lnxmon_filesystem_{size,used,inode_used}: by mount
+// lnxmon_disks_<key>: by device
+// lnxmon_nics_<key>: by interface
+// lnxmon_cgroups_<key>: by cgroup
+// lnxmon_watched_processes_<key>: by name
+// lnxmon_custom_<name>: by the labels of the custom metric
+// lnxmon_collector_error: by collector, only the ones which failed
+// lnxmon_<counter>_total: with --raw-counters
+func GetPrometheusMetrics() string {
 	var host map[string]interface{}
-	host = map[string]interface{}{
-		"code":           GetCode(),
-		"hostname":       GetHostname(),
-		"ip":             GetIp(),
-		"os_type":        GetOsType(),
-		"architecture":   GetArchitecture(),
-		"cpu_processors": GetCpuProcessors(),
-		"mem_size":       GetMemSize(),
-		"swap_size":      GetSwapSize(),
-		"disk_size":      GetDiskSize(),
-		"uptime":         GetUptime(),
-		"heartbeat_time": GetCurrentTime(),
-		"project":        SETTINGS.PROJECT,
-		"version":        SETTINGS.VERSION,
+	var host_metric map[string]interface{}
+	host, host_metric = LATEST.Get()
+
+	var metrics *PrometheusMetrics
+	metrics = NewPrometheusMetrics()
+
+	if len(host) > 0 {
+		var labels []string
+		var key string
+		for _, key = range []string{"code", "hostname", "ip", "os_type", "architecture", "version", "project"} {
+			var value string
+			value, _ = host[key].(string)
+			labels = append(labels, key, value)
+		}
+
+		SETTINGS_MUTEX.RLock()
+		var keys []string
+		for key = range SETTINGS.LABELS {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key = range keys {
+			labels = append(labels, "label_"+key, SETTINGS.LABELS[key])
+		}
+		SETTINGS_MUTEX.RUnlock()
+
+		metrics.Add("host_info", "gauge", 1, labels...)
+
+		// GiB, GiB, GiB, days
+		for _, key = range []string{"cpu_processors", "mem_size", "swap_size", "disk_size", "uptime"} {
+			var value float64
+			var ok bool
+			value, ok = host[key].(float64)
+			if ok {
+				metrics.Add(key, "gauge", value)
+			}
+		}
 	}
 
-	if SETTINGS.DEBUG {
-		var tmp []byte
-		tmp, err = json.MarshalIndent(host, "", "    ")
-		Skip(err)
-		log.Println("host: \n" + string(tmp))
+	var key string
+	var value interface{}
+	for key, value = range host_metric {
+		var number float64
+		var is_true bool
+		var ok bool
+
+		number, ok = value.(float64)
+		if ok {
+			metrics.Add(key, "gauge", number)
+			continue
+		}
+
+		// psi_supported
+		is_true, ok = value.(bool)
+		if ok && is_true {
+			metrics.Add(key, "gauge", 1)
+		} else if ok {
+			metrics.Add(key, "gauge", 0)
+		}
 	}
 
-	var host2 []byte
-	host2, err = json.Marshal(host)
-	Throw(err)
+	// /boot_1_12.34_0.56,/data_100_45.67_1.23
+	var disk_usage string
+	disk_usage, _ = host_metric["disk_usage"].(string)
+	if disk_usage != "" {
+		var disk string
+		for _, disk = range strings.Split(disk_usage, ",") {
+			var fields []string
+			fields = strings.Split(disk, "_")
+			if len(fields) < 4 {
+				continue
+			}
 
-	return host2
+			// The mount point may contain underscores
+			var mount_point string
+			mount_point = strings.Join(fields[:len(fields)-3], "_")
+
+			var i int
+			var name string
+			for i, name = range []string{"filesystem_size", "filesystem_used", "filesystem_inode_used"} {
+				var number float64
+				var err error
+				number, err = strconv.ParseFloat(fields[len(fields)-3+i], 64)
+				if err == nil {
+					metrics.Add(name, "gauge", number, "mount", mount_point)
+				}
+			}
+		}
+	}
+
+	metrics.AddDevices("disks", "device", host_metric["disks"])
+	metrics.AddDevices("nics", "interface", host_metric["nics"])
+	metrics.AddDevices("cgroups", "cgroup", host_metric["cgroups"])
+	metrics.AddDevices("watched_processes", "name", host_metric["watched_processes"])
+
+	var custom_metrics []interface{}
+	custom_metrics, _ = host_metric["custom_metrics"].([]interface{})
+	for _, value = range custom_metrics {
+		var custom_metric map[string]interface{}
+		custom_metric, _ = value.(map[string]interface{})
+
+		var labels []string
+		var label string
+		for _, label = range strings.Split(StringValueOf(custom_metric, "labels"), ",") {
+			var index int
+			index = strings.Index(label, "=")
+			if index > 0 {
+				labels = append(labels, label[:index], label[index+1:])
+			}
+		}
+
+		metrics.Add("custom_"+StringValueOf(custom_metric, "name"), "gauge", FloatValueOf(custom_metric, "value"), labels...)
+	}
+
+	var collector_errors map[string]interface{}
+	collector_errors, _ = host_metric["errors"].(map[string]interface{})
+	for key = range collector_errors {
+		metrics.Add("collector_error", "gauge", 1, "collector", key)
+	}
+
+	var counters map[string]interface{}
+	counters, _ = host_metric["counters"].(map[string]interface{})
+	for key, value = range counters {
+		var number float64
+		var ok bool
+		number, ok = value.(float64)
+		// A checksum rather than a counter
+		if !ok || key == "devices" {
+			continue
+		}
+
+		if key == "boot_time" || key == "uptime" {
+			metrics.Add(key+"_seconds", "gauge", number)
+		} else {
+			metrics.Add(key+"_total", "counter", number)
+		}
+	}
+
+	return metrics.String()
 }
 
-// code
-// hostname
-// loadavg: loadavg_1m, loadavg_5m, loadavg_15m
-// cpu_usage: cpu_used, cpu_iowait
-// mem_usage: mem_used, swap_used
-// disk_usage: disk_used, inode_used
-// disk_io_rate: disk_read_rate, disk_write_rate, disk_ios
-// nic_io_rate: nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets
-// tcp_sockets: tcp_sockets_inuse, tcp_sockets_tw
-// users
-// heartbeat_time
-// project
-func GetHostMetric() []byte {
+func HandleMetrics(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(response, GetPrometheusMetrics())
+}
+
+// Serves /metrics for Prometheus on --listen, along with the reports to
+// lnxmonsrv. The listener is bound by main(), which exits if it cannot be, so
+// a failure here is only logged.
+func ServeMetrics(listener net.Listener) {
 	defer Catch()
 
+	var mux *http.ServeMux
+	mux = http.NewServeMux()
+	mux.HandleFunc("/metrics", HandleMetrics)
+
+	log.Println("listening on:", listener.Addr())
+
 	var err error
+	err = http.Serve(listener, mux)
+	Throw(err)
+}
 
-	var code string
-	var hostname string
-	var ip string
-	var loadavg_1m float64
-	var loadavg_5m float64
-	var loadavg_15m float64
-	var cpu_used float64
-	var cpu_iowait float64
-	var mem_used float64
-	var swap_used float64
+// If key is not present, e.g. a disabled collector, FloatValueOf returns 0.
+func FloatValueOf(data map[string]interface{}, key string) float64 {
+	var value float64
+	var ok bool
+
+	value, ok = data[key].(float64)
+	if !ok {
+		value = 0
+	}
+
+	return value
+}
+
+// If key is not present, StringValueOf returns the empty string.
+func StringValueOf(data map[string]interface{}, key string) string {
+	var value string
+	var ok bool
+
+	value, ok = data[key].(string)
+	if !ok {
+		value = ""
+	}
+
+	return value
+}
+
+// Prints the host and the host metric the way the dashboard shows them, the
+// summary first and then the mounts, disks, interfaces, custom metrics and
+// top processes.
+func PrintTable(host map[string]interface{}, host_metric map[string]interface{}) {
+	var writer *tabwriter.Writer
+	writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(writer, "Host\t%s (%s)\t%s\n", StringValueOf(host, "hostname"), StringValueOf(host, "ip"), StringValueOf(host_metric, "heartbeat_time"))
+	fmt.Fprintf(writer, "OS\t%s\t%s\n", StringValueOf(host, "os_type"), StringValueOf(host, "architecture"))
+	fmt.Fprintf(writer, "Uptime\t%.2f days\n", FloatValueOf(host, "uptime"))
+	fmt.Fprintf(writer, "Load\t%.2f %.2f %.2f\n", FloatValueOf(host_metric, "loadavg_1m"), FloatValueOf(host_metric, "loadavg_5m"), FloatValueOf(host_metric, "loadavg_15m"))
+	fmt.Fprintf(
+		writer,
+		"CPU\t%.2f%% used\t%.2f%% iowait\t%.2f%% steal\t%.0f processors\n",
+		FloatValueOf(host_metric, "cpu_used"),
+		FloatValueOf(host_metric, "cpu_iowait"),
+		FloatValueOf(host_metric, "cpu_steal"),
+		FloatValueOf(host, "cpu_processors"),
+	)
+	fmt.Fprintf(
+		writer,
+		"Memory\t%.2f%% used\t%.2f%% swap\t%.0f GiB\t%.0f GiB swap\n",
+		FloatValueOf(host_metric, "mem_used"),
+		FloatValueOf(host_metric, "swap_used"),
+		FloatValueOf(host, "mem_size"),
+		FloatValueOf(host, "swap_size"),
+	)
+	fmt.Fprintf(
+		writer,
+		"Disk\t%.2f%% used\t%.2f%% inode\t%.2f KiB/s read\t%.2f KiB/s write\t%.2f IOPS\n",
+		FloatValueOf(host_metric, "disk_used"),
+		FloatValueOf(host_metric, "inode_used"),
+		FloatValueOf(host_metric, "disk_read_rate"),
+		FloatValueOf(host_metric, "disk_write_rate"),
+		FloatValueOf(host_metric, "disk_ios"),
+	)
+	fmt.Fprintf(
+		writer,
+		"Network\t%.2f KiB/s receive\t%.2f KiB/s transmit\t%.2f packets/s receive\t%.2f packets/s transmit\n",
+		FloatValueOf(host_metric, "nic_receive_rate"),
+		FloatValueOf(host_metric, "nic_transmit_rate"),
+		FloatValueOf(host_metric, "nic_receive_packets"),
+		FloatValueOf(host_metric, "nic_transmit_packets"),
+	)
+	fmt.Fprintf(writer, "TCP\t%.0f inuse\t%.0f time_wait\n", FloatValueOf(host_metric, "tcp_sockets_inuse"), FloatValueOf(host_metric, "tcp_sockets_tw"))
+	fmt.Fprintf(writer, "Users\t%.0f\n", FloatValueOf(host_metric, "users"))
+
+	var collector_errors map[string]interface{}
+	collector_errors, _ = host_metric["errors"].(map[string]interface{})
+
+	var names []string
+	var name string
+	for name = range collector_errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		fmt.Fprintf(writer, "Error\t%s\t%s\n", name, StringValueOf(collector_errors, name))
+	}
+	writer.Flush()
+
+	// /boot_1_12.34_0.56,/data_100_45.67_1.23
 	var disk_usage string
-	var disk_used float64
-	var inode_used float64
-	var disk_read_rate float64
-	var disk_write_rate float64
-	var disk_ios int64
-	var nic_receive_rate float64
-	var nic_receive_packets int64
-	var nic_transmit_rate float64
-	var nic_transmit_packets int64
-	var tcp_sockets_inuse int64
-	var tcp_sockets_tw int64
-	var users int64
-	var heartbeat_time string
-	var project string
+	disk_usage = StringValueOf(host_metric, "disk_usage")
+	if disk_usage != "" {
+		fmt.Println()
+		fmt.Fprintln(writer, "MOUNT\tSIZE (GiB)\tUSED (%)\tINODE (%)")
+
+		var disk string
+		for _, disk = range strings.Split(disk_usage, ",") {
+			var fields []string
+			fields = strings.Split(disk, "_")
+			if len(fields) < 4 {
+				continue
+			}
 
-	code = GetCode()
-	hostname = GetHostname()
-	ip = GetIp()
-	loadavg_1m, loadavg_5m, loadavg_15m = GetLoadavg()
-	cpu_used, cpu_iowait = GetCpuUsage()
-	mem_used, swap_used = GetMemUsage()
-	disk_usage, disk_used, inode_used = GetDiskUsage()
-	disk_read_rate, disk_write_rate, disk_ios = GetDiskIoRate()
-	nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets = GetNicIoRate()
-	tcp_sockets_inuse, tcp_sockets_tw = GetTcpSockets()
-	users = GetUsers()
-	heartbeat_time = GetCurrentTime()
-	project = SETTINGS.PROJECT
+			// The mount point may contain underscores
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", strings.Join(fields[:len(fields)-3], "_"), fields[len(fields)-3], fields[len(fields)-2], fields[len(fields)-1])
+		}
+		writer.Flush()
+	}
 
-	var host_metric map[string]interface{}
-	host_metric = map[string]interface{}{
-		"code":                 code,
-		"hostname":             hostname,
-		"ip":                   ip,
-		"loadavg_1m":           loadavg_1m,
-		"loadavg_5m":           loadavg_5m,
-		"loadavg_15m":          loadavg_15m,
-		"cpu_used":             cpu_used,
-		"cpu_iowait":           cpu_iowait,
-		"mem_used":             mem_used,
-		"swap_used":            swap_used,
-		"disk_usage":           disk_usage,
-		"disk_used":            disk_used,
-		"inode_used":           inode_used,
-		"disk_read_rate":       disk_read_rate,
-		"disk_write_rate":      disk_write_rate,
-		"disk_ios":             disk_ios,
-		"nic_receive_rate":     nic_receive_rate,
-		"nic_receive_packets":  nic_receive_packets,
-		"nic_transmit_rate":    nic_transmit_rate,
-		"nic_transmit_packets": nic_transmit_packets,
-		"tcp_sockets_inuse":    tcp_sockets_inuse,
-		"tcp_sockets_tw":       tcp_sockets_tw,
-		"users":                users,
-		"heartbeat_time":       heartbeat_time,
-		"project":              project,
+	var devices []interface{}
+	var value interface{}
+
+	devices, _ = host_metric["disks"].([]interface{})
+	if len(devices) > 0 {
+		fmt.Println()
+		fmt.Fprintln(writer, "DEVICE\tREAD (KiB/s)\tWRITE (KiB/s)\tREAD (IOPS)\tWRITE (IOPS)\tREAD AWAIT (ms)\tWRITE AWAIT (ms)\tUTIL (%)")
+		for _, value = range devices {
+			var disk map[string]interface{}
+			disk, _ = value.(map[string]interface{})
+			fmt.Fprintf(
+				writer,
+				"%s\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\n",
+				StringValueOf(disk, "name"),
+				FloatValueOf(disk, "read_rate"),
+				FloatValueOf(disk, "write_rate"),
+				FloatValueOf(disk, "read_iops"),
+				FloatValueOf(disk, "write_iops"),
+				FloatValueOf(disk, "read_await"),
+				FloatValueOf(disk, "write_await"),
+				FloatValueOf(disk, "util"),
+			)
+		}
+		writer.Flush()
 	}
 
-	if SETTINGS.DEBUG {
-		var tmp []byte
-		tmp, err = json.MarshalIndent(host_metric, "", "    ")
-		Skip(err)
-		log.Println("host_metric: \n" + string(tmp))
+	devices, _ = host_metric["nics"].([]interface{})
+	if len(devices) > 0 {
+		fmt.Println()
+		fmt.Fprintln(writer, "INTERFACE\tRECEIVE (KiB/s)\tTRANSMIT (KiB/s)\tRECEIVE (packets/s)\tTRANSMIT (packets/s)\tERRS (/s)\tDROP (/s)")
+		for _, value = range devices {
+			var nic map[string]interface{}
+			nic, _ = value.(map[string]interface{})
+			fmt.Fprintf(
+				writer,
+				"%s\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\n",
+				StringValueOf(nic, "name"),
+				FloatValueOf(nic, "receive_rate"),
+				FloatValueOf(nic, "transmit_rate"),
+				FloatValueOf(nic, "receive_packets"),
+				FloatValueOf(nic, "transmit_packets"),
+				FloatValueOf(nic, "receive_errs")+FloatValueOf(nic, "transmit_errs"),
+				FloatValueOf(nic, "receive_drop")+FloatValueOf(nic, "transmit_drop"),
+			)
+		}
+		writer.Flush()
 	}
 
-	var host_metric2 []byte
-	host_metric2, err = json.Marshal(host_metric)
-	Throw(err)
+	devices, _ = host_metric["custom_metrics"].([]interface{})
+	if len(devices) > 0 {
+		fmt.Println()
+		fmt.Fprintln(writer, "CUSTOM\tVALUE\tLABELS")
+		for _, value = range devices {
+			var custom_metric map[string]interface{}
+			custom_metric, _ = value.(map[string]interface{})
+			fmt.Fprintf(
+				writer,
+				"%s\t%s\t%s\n",
+				StringValueOf(custom_metric, "name"),
+				strconv.FormatFloat(FloatValueOf(custom_metric, "value"), 'f', -1, 64),
+				StringValueOf(custom_metric, "labels"),
+			)
+		}
+		writer.Flush()
+	}
 
-	return host_metric2
+	devices, _ = host_metric["log_events"].([]interface{})
+	if len(devices) > 0 {
+		fmt.Println()
+		fmt.Fprintln(writer, "LOG\tPATH\tLINE")
+		for _, value = range devices {
+			var log_event map[string]interface{}
+			log_event, _ = value.(map[string]interface{})
+			fmt.Fprintf(
+				writer,
+				"%s\t%s\t%s\n",
+				StringValueOf(log_event, "name"),
+				StringValueOf(log_event, "path"),
+				StringValueOf(log_event, "line"),
+			)
+		}
+		writer.Flush()
+	}
+
+	devices, _ = host_metric["processes"].([]interface{})
+	if len(devices) > 0 {
+		fmt.Println()
+		fmt.Fprintln(writer, "PID\tCPU (%)\tRSS (MiB)\tTHREADS\tNAME\tCMDLINE")
+		for _, value = range devices {
+			var process map[string]interface{}
+			process, _ = value.(map[string]interface{})
+
+			var cmdline string
+			cmdline = StringValueOf(process, "cmdline")
+			if len(cmdline) > 60 {
+				cmdline = cmdline[:60] + "..."
+			}
+
+			fmt.Fprintf(
+				writer,
+				"%.0f\t%.2f\t%.2f\t%.0f\t%s\t%s\n",
+				FloatValueOf(process, "pid"),
+				FloatValueOf(process, "cpu_used"),
+				FloatValueOf(process, "mem_rss"),
+				FloatValueOf(process, "threads"),
+				StringValueOf(process, "name"),
+				cmdline,
+			)
+		}
+		writer.Flush()
+	}
+}
+
+// Runs the collectors and prints the result instead of reporting it to
+// lnxmonsrv, once with --once, or every interval seconds like top with
+// --watch. The rates of the first run are over a second, see Sampler.Sample().
+func RunLocal(once bool, interval int, output string) {
+	for {
+		var host []byte
+		var host_metric []byte
+		host = GetHost()
+		host_metric = GetHostMetric()
+
+		var host2 map[string]interface{}
+		var host_metric2 map[string]interface{}
+		Skip(json.Unmarshal(host, &host2))
+		Skip(json.Unmarshal(host_metric, &host_metric2))
+
+		if output == "json" {
+			var content []byte
+			var err error
+			content, err = json.MarshalIndent(map[string]interface{}{"host": host2, "host_metric": host_metric2}, "", "    ")
+			Throw(err)
+			fmt.Println(string(content))
+		} else {
+			if !once {
+				// Clears the screen
+				fmt.Print("\033[H\033[2J")
+			}
+			PrintTable(host2, host_metric2)
+		}
+
+		if once {
+			return
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
 }
 
 func ReportHost(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	var api string
-	api = fmt.Sprintf("%s/report_host", SETTINGS.API)
-
 	for {
+		REPORT_MUTEX.RLock()
+
+		var api string
+		api = fmt.Sprintf("%s/report_host", SETTINGS.API)
+
 		var host []byte
 		host = GetHost()
 
@@ -1236,26 +5948,33 @@ func ReportHost(wg *sync.WaitGroup) {
 		log.Println("host:", string(host))
 
 		if len(host) > 0 {
+			LATEST.SetHost(host)
 			HttpPost(api, host)
 		} else {
 			log.Println("get host failed")
 		}
 
-		if SETTINGS.DEBUG {
-			time.Sleep(5 * time.Second)
-		} else {
-			time.Sleep(5 * time.Minute)
-		}
+		var interval time.Duration
+		interval = GetInterval(SETTINGS.HOST_INTERVAL, 5)
+
+		REPORT_MUTEX.RUnlock()
+
+		time.Sleep(interval)
 	}
 }
 
 func ReportHostMetric(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	var api string
-	api = fmt.Sprintf("%s/report_host_metric", SETTINGS.API)
-
 	for {
+		REPORT_MUTEX.RLock()
+
+		var api string
+		api = fmt.Sprintf("%s/report_host_metric", SETTINGS.API)
+
+		var interval time.Duration
+		interval = GetInterval(SETTINGS.METRIC_INTERVAL, 1)
+
 		var host_metric []byte
 		host_metric = GetHostMetric()
 
@@ -1263,16 +5982,15 @@ func ReportHostMetric(wg *sync.WaitGroup) {
 		log.Println("host_metric:", string(host_metric))
 
 		if len(host_metric) > 0 {
-			HttpPost(api, host_metric)
+			LATEST.SetHostMetric(host_metric)
+			SendHostMetric(api, host_metric, interval)
 		} else {
 			log.Println("get host metric failed")
 		}
 
-		if SETTINGS.DEBUG {
-			time.Sleep(1 * time.Second)
-		} else {
-			time.Sleep(1 * time.Minute)
-		}
+		REPORT_MUTEX.RUnlock()
+
+		time.Sleep(interval)
 	}
 }
 
@@ -1283,25 +6001,227 @@ func main() {
 	var port int
 	var project string
 	var debug bool
+	var nic_include string
+	var nic_exclude string
+	var mount_include string
+	var mount_exclude string
+	var top int
+	var watch_processes ArrayFlags
+	var custom_scripts ArrayFlags
+	var textfile_dir string
+	var statsd_address string
+	var statsd_socket string
+	var log_watches ArrayFlags
+	var log_samples int
+	var cgroup_depth int
+	var rootfs string
+	var procfs string
+	var sysfs string
+	var host_id string
+	var config string
+	var check_config bool
+	var spool_dir string
+	var spool_size int
+	var report_interval int
+	var sample_interval int
+	var raw_counters bool
+	var listen string
+	var once bool
+	var watch int
+	var output string
 
 	flag.StringVar(&host, "host", "127.0.0.1", "Host")
 	flag.IntVar(&port, "port", 1234, "Port")
 	flag.StringVar(&project, "project", "DEFAULT", "Project")
 	flag.BoolVar(&debug, "debug", false, "Debug")
+	flag.StringVar(&nic_include, "nic-include", SETTINGS.NIC_INCLUDE, "Regexp of the interfaces to include")
+	flag.StringVar(&nic_exclude, "nic-exclude", SETTINGS.NIC_EXCLUDE, "Regexp of the interfaces to exclude")
+	flag.StringVar(&mount_include, "mount-include", SETTINGS.MOUNT_INCLUDE, "Regexp of the mount points to include")
+	flag.StringVar(&mount_exclude, "mount-exclude", SETTINGS.MOUNT_EXCLUDE, "Regexp of the mount points to exclude")
+	flag.IntVar(&top, "top", SETTINGS.TOP, "Number of the top processes by CPU and by memory")
+	flag.Var(&watch_processes, "watch-process", "Process to watch, [label=]name:nginx, [label=]cmdline:regexp or [label=]pidfile:/run/nginx.pid, can be repeated")
+	flag.Var(&custom_scripts, "custom-script", "Script to report the output of as custom metrics, [name=]metrics:command printing lines of name value [k=v,k=v], or [name=]nagios:command of a Nagios plugin, can be repeated")
+	flag.StringVar(&textfile_dir, "textfile-dir", SETTINGS.TEXTFILE_DIR, "Directory of *.prom files in the text format of Prometheus to report as custom metrics")
+	flag.StringVar(&statsd_address, "statsd-address", SETTINGS.STATSD_ADDRESS, "UDP address to receive StatsD metrics on, e.g. 127.0.0.1:8125, which are reported as custom metrics")
+	flag.StringVar(&statsd_socket, "statsd-socket", SETTINGS.STATSD_SOCKET, "Unix datagram socket to receive StatsD metrics on, e.g. /run/lnxmon/statsd.sock")
+	flag.Var(&log_watches, "log-watch", "Log file to tail, name=/var/log/app.log:regexp, whose matching lines are counted and reported as the custom metric log_<name>, can be repeated")
+	flag.IntVar(&log_samples, "log-samples", SETTINGS.LOG_SAMPLES, "Number of the last matching lines of each log watch to report as events, 0 to disable it")
+	flag.StringVar(&rootfs, "rootfs", SETTINGS.ROOTFS, "Root of the host, e.g. /host when running in a container")
+	flag.StringVar(&procfs, "procfs", "", "procfs of the host, <rootfs>/proc by default")
+	flag.StringVar(&sysfs, "sysfs", "", "sysfs of the host, <rootfs>/sys by default")
+	flag.StringVar(&spool_dir, "spool-dir", SETTINGS.SPOOL_DIR, "Directory of the metrics to send again once the server is back")
+	flag.IntVar(&spool_size, "spool-size", SETTINGS.SPOOL_SIZE, "Size of the spool in MiB, 0 to disable it")
+	flag.IntVar(&report_interval, "report-interval", SETTINGS.REPORT_INTERVAL, "Seconds between the reports of the metrics, which are sent in batches if longer than the interval of the metrics")
+	flag.IntVar(&sample_interval, "sample-interval", SETTINGS.SAMPLE_INTERVAL, "Seconds between the samples of CPU, memory, disk and network I/O, whose min, max, avg and last are reported, 0 to disable it")
+	flag.BoolVar(&raw_counters, "raw-counters", SETTINGS.RAW_COUNTERS, "Send the cumulative counters of CPU, disk and network too, from which the server derives the rates")
+	flag.StringVar(&listen, "listen", SETTINGS.LISTEN, "Address to serve /metrics for Prometheus on, e.g. :9101, disabled by default")
+	flag.BoolVar(&once, "once", false, "Print the host and the host metric once instead of reporting them, then exit")
+	flag.IntVar(&watch, "watch", 0, "Print the host and the host metric every N seconds instead of reporting them, like top")
+	flag.StringVar(&output, "output", "table", "Output of --once and --watch, table or json")
+	flag.StringVar(&config, "config", "", "Config file in JSON, which takes precedence over the flags and is reloaded on SIGHUP")
+	flag.BoolVar(&check_config, "check-config", false, "Check the config file and the flags, then exit")
+	flag.StringVar(&host_id, "host-id", SETTINGS.HOST_ID, "Code of the host, derived from /etc/machine-id by default")
+	flag.IntVar(&cgroup_depth, "cgroup-depth", SETTINGS.CGROUP_DEPTH, "Depth of the cgroups to report, e.g. 1 for the slices and 2 for the services, containers are always reported")
 
 	flag.Parse()
 
+	// Also without --once, rather than ignored
+	if watch < 0 || (output != "table" && output != "json") {
+		fmt.Printf("invalid watch: %d or output: %q, table or json\n", watch, output)
+		os.Exit(1)
+	}
+
+	// Only the result is printed with --once and --watch
+	if (once || watch > 0) && !debug {
+		log.SetOutput(ioutil.Discard)
+	}
+
 	log.Println("host:", host)
 	log.Println("port:", port)
 	log.Println("project:", project)
 	log.Println("debug:", debug)
+	log.Println("nic_include:", nic_include)
+	log.Println("nic_exclude:", nic_exclude)
+	log.Println("mount_include:", mount_include)
+	log.Println("mount_exclude:", mount_exclude)
+	log.Println("top:", top)
+	log.Println("watch_processes:", watch_processes.String())
+	log.Println("custom_scripts:", custom_scripts.String())
+	log.Println("textfile_dir:", textfile_dir)
+	log.Println("statsd_address:", statsd_address)
+	log.Println("statsd_socket:", statsd_socket)
+	log.Println("log_watches:", log_watches.String())
+	log.Println("log_samples:", log_samples)
+	log.Println("cgroup_depth:", cgroup_depth)
+	log.Println("rootfs:", rootfs)
+	log.Println("procfs:", procfs)
+	log.Println("sysfs:", sysfs)
+	log.Println("host_id:", host_id)
+	log.Println("spool_dir:", spool_dir)
+	log.Println("spool_size:", spool_size)
+	log.Println("report_interval:", report_interval)
+	log.Println("sample_interval:", sample_interval)
+	log.Println("raw_counters:", raw_counters)
+	log.Println("listen:", listen)
+	log.Println("config:", config)
+	log.Println("check_config:", check_config)
+	log.Println("once:", once)
+	log.Println("watch:", watch)
+	log.Println("output:", output)
 
 	SETTINGS.API = fmt.Sprintf("http://%s:%d/api", host, port)
 	SETTINGS.PROJECT = project
 	SETTINGS.DEBUG = debug
+	SETTINGS.NIC_INCLUDE = nic_include
+	SETTINGS.NIC_EXCLUDE = nic_exclude
+	SETTINGS.MOUNT_INCLUDE = mount_include
+	SETTINGS.MOUNT_EXCLUDE = mount_exclude
+	SETTINGS.TOP = top
+	SETTINGS.CGROUP_DEPTH = cgroup_depth
+	SETTINGS.HOST_ID = host_id
+	SETTINGS.SPOOL_DIR = spool_dir
+	SETTINGS.SPOOL_SIZE = spool_size
+	SETTINGS.REPORT_INTERVAL = report_interval
+	SETTINGS.SAMPLE_INTERVAL = sample_interval
+	SETTINGS.RAW_COUNTERS = raw_counters
+	SETTINGS.LISTEN = listen
+	SETTINGS.TEXTFILE_DIR = textfile_dir
+	SETTINGS.STATSD_ADDRESS = statsd_address
+	SETTINGS.STATSD_SOCKET = statsd_socket
+	SETTINGS.LOG_SAMPLES = log_samples
+
+	SETTINGS.ROOTFS = rootfs
+	if procfs == "" {
+		SETTINGS.PROCFS = filepath.Join(rootfs, "/proc")
+	} else {
+		SETTINGS.PROCFS = procfs
+	}
+	if sysfs == "" {
+		SETTINGS.SYSFS = filepath.Join(rootfs, "/sys")
+	} else {
+		SETTINGS.SYSFS = sysfs
+	}
+
+	var value string
+	for _, value = range watch_processes {
+		var watch_process WatchProcess
+		var err error
+		watch_process, err = ParseWatchProcess(value)
+		Throw(err)
+		SETTINGS.WATCH_PROCESSES = append(SETTINGS.WATCH_PROCESSES, watch_process)
+	}
+
+	for _, value = range custom_scripts {
+		var custom_script CustomScript
+		var err error
+		custom_script, err = ParseCustomScript(value)
+		Throw(err)
+		SETTINGS.CUSTOM_SCRIPTS = append(SETTINGS.CUSTOM_SCRIPTS, custom_script)
+	}
+
+	for _, value = range log_watches {
+		var log_watch LogWatch
+		var err error
+		log_watch, err = ParseLogWatch(value)
+		Throw(err)
+		SETTINGS.LOG_WATCHES = append(SETTINGS.LOG_WATCHES, log_watch)
+	}
+
+	// The settings of the command line, which the config file is read over on
+	// each reload
+	var base Settings
+	base = SETTINGS
+
+	var err error
+	if config != "" {
+		SETTINGS, err = LoadConfig(config, base)
+	} else {
+		SETTINGS, err = CompileFilters(SETTINGS)
+		if err == nil {
+			err = CheckSettings(SETTINGS)
+		}
+	}
+
+	if check_config {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("%+v\n", SETTINGS)
+		os.Exit(0)
+	}
+	Throw(err)
+
+	if once || watch > 0 {
+		RunLocal(once, watch, output)
+		os.Exit(0)
+	}
 
 	log.Printf("SETTINGS: %+v\n", SETTINGS)
 
+	if config != "" {
+		go WatchConfig(config, base)
+	}
+
+	go AGGREGATOR.Run()
+
+	// Not reloaded on SIGHUP
+	if SETTINGS.LISTEN != "" {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", SETTINGS.LISTEN)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go ServeMetrics(listener)
+	}
+	if SETTINGS.STATSD_ADDRESS != "" {
+		go ServeStatsd("udp", SETTINGS.STATSD_ADDRESS)
+	}
+	if SETTINGS.STATSD_SOCKET != "" {
+		go ServeStatsd("unixgram", SETTINGS.STATSD_SOCKET)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go ReportHost(&wg)
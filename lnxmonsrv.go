@@ -6,6 +6,7 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -15,6 +16,7 @@ import (
 	"math"
 	"net/http"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -77,7 +79,7 @@ func MakeHandler(next func(http.ResponseWriter, *http.Request)) http.HandlerFunc
 
 		log.Println("request.URL.Path:", request.URL.Path)
 
-		if strings.HasPrefix(request.URL.Path, "/api/report_") {
+		if strings.HasPrefix(request.URL.Path, "/api/report_") || request.URL.Path == "/api/link_host" {
 			var token string
 			token = request.Header.Get("token")
 
@@ -177,6 +179,48 @@ func Api(response http.ResponseWriter, code int, args ...interface{}) {
 	response.Write(body)
 }
 
+// 32 MiB, the limit of a request body both as sent and once decompressed, so
+// that a small gzipped body cannot expand into any size
+const BODY_LIMIT = 32 << 20
+
+var ERR_BODY_TOO_LARGE = errors.New("request body too large")
+
+// The body of the request, decompressed if sent with Content-Encoding: gzip,
+// ERR_BODY_TOO_LARGE beyond BODY_LIMIT, which is answered with 413.
+func ReadBody(response http.ResponseWriter, request *http.Request) ([]byte, error) {
+	var err error
+
+	var reader io.Reader
+	reader = http.MaxBytesReader(response, request.Body, BODY_LIMIT)
+
+	if request.Header.Get("Content-Encoding") == "gzip" {
+		var gzip_reader *gzip.Reader
+		gzip_reader, err = gzip.NewReader(reader)
+		if err != nil {
+			if IsMaxBytesError(err) {
+				return nil, ERR_BODY_TOO_LARGE
+			}
+			return nil, err
+		}
+		defer gzip_reader.Close()
+
+		reader = gzip_reader
+	}
+
+	var body []byte
+	body, err = ioutil.ReadAll(io.LimitReader(reader, BODY_LIMIT+1))
+	if IsMaxBytesError(err) || len(body) > BODY_LIMIT {
+		return nil, ERR_BODY_TOO_LARGE
+	}
+
+	return body, err
+}
+
+func IsMaxBytesError(err error) bool {
+	var max_bytes_error *http.MaxBytesError
+	return errors.As(err, &max_bytes_error)
+}
+
 func HttpStatusOk(response http.ResponseWriter, request *http.Request) {
 	response.WriteHeader(http.StatusOK)
 }
@@ -263,6 +307,32 @@ func ParseNil(value string) interface{} {
 	return value
 }
 
+// If key is not present, e.g. reported by an older lnxmoncli, FloatValueOf returns 0.
+func FloatValueOf(data map[string]interface{}, key string) float64 {
+	var value float64
+	var ok bool
+
+	value, ok = data[key].(float64)
+	if !ok {
+		value = 0
+	}
+
+	return value
+}
+
+// If key is not present, e.g. reported by an older lnxmoncli, StringValueOf returns the empty string.
+func StringValueOf(data map[string]interface{}, key string) string {
+	var value string
+	var ok bool
+
+	value, ok = data[key].(string)
+	if !ok {
+		value = ""
+	}
+
+	return value
+}
+
 func SelectProjects(db *sql.DB) []map[string]interface{} {
 	var err error
 
@@ -307,6 +377,9 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 			host.hostname,
 			host.alias,
 			host.ip,
+			host.interfaces,
+			host.labels,
+			host.errors,
 			host.os_type,
 			host.architecture,
 			host.cpu_processors,
@@ -323,14 +396,18 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 			host_metric.swap_used,
 			host_metric.disk_used,
 			host_metric.inode_used,
-			host_metric.users
+			host_metric.users,
+			(
+				SELECT COUNT(*) FROM t_host_watch_%s watch
+				WHERE watch.code=host.code AND watch.heartbeat_time=host_metric.heartbeat_time AND watch.count=0
+			) AS watch_down
 		FROM t_host host
 		JOIN t_host_metric_%s host_metric
 		ON host.host_metric_id=host_metric.id
 		WHERE host.project=?
 		ORDER BY host.hostname
 	`
-	query = fmt.Sprintf(query, project)
+	query = fmt.Sprintf(query, project, project)
 
 	var rows *sql.Rows
 	rows, err = db.Query(query, project)
@@ -346,6 +423,9 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 		var hostname string
 		var alias sql.NullString
 		var ip string
+		var interfaces string
+		var labels string
+		var collector_errors string
 		var os_type string
 		var architecture string
 		var cpu_processors int64
@@ -363,6 +443,7 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 		var disk_used float64
 		var inode_used float64
 		var users int64
+		var watch_down int64
 
 		var alias2 string
 		var ips []string
@@ -389,6 +470,9 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 			&hostname,
 			&alias,
 			&ip,
+			&interfaces,
+			&labels,
+			&collector_errors,
 			&os_type,
 			&architecture,
 			&cpu_processors,
@@ -406,6 +490,7 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 			&disk_used,
 			&inode_used,
 			&users,
+			&watch_down,
 		)
 		Throw(err)
 
@@ -415,6 +500,11 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 		ips = strings.Split(ip, ",")
 		heartbeat_time2 = heartbeat_time.Format("2006-01-02 15:04:05")
 
+		var error_count int
+		if collector_errors != "" {
+			error_count = len(strings.Split(collector_errors, "\n"))
+		}
+
 		{
 			loadavg = fmt.Sprintf("%.2f, %.2f, %.2f", loadavg_1m, loadavg_5m, loadavg_15m)
 			max_loadavg = math.Max(max_loadavg, loadavg_1m)
@@ -459,6 +549,9 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 				"alias":          alias2,
 				"ip":             ip,
 				"ips":            ips,
+				"interfaces":     strings.Replace(interfaces, ";", "\n", -1),
+				"labels":         labels,
+				"errors":         collector_errors,
 				"os_type":        os_type,
 				"architecture":   architecture,
 				"cpu_processors": cpu_processors,
@@ -480,6 +573,8 @@ func SelectHosts(db *sql.DB, project string) []map[string]interface{} {
 				"is_overcpu":     is_overcpu,
 				"is_overmem":     is_overmem,
 				"is_overdisk":    is_overdisk,
+				"watch_down":     watch_down,
+				"error_count":    error_count,
 			},
 		)
 	}
@@ -516,6 +611,95 @@ func SelectHost(db *sql.DB, id int64) map[string]interface{} {
 	return host
 }
 
+// Selects the per-device metrics, e.g. t_host_nic_%s, and aligns them with
+// heartbeat_time_array of t_host_metric_%s, the missing points are null.
+//
+// Returns the device names, and the data of each column of each device.
+func SelectHostDeviceMetric(db *sql.DB, table string, code string, begin_time string, end_time string, columns []string, heartbeat_time_array []string) ([]string, map[string]map[string][]interface{}) {
+	var err error
+
+	var indexes map[string]int
+	indexes = make(map[string]int)
+
+	{
+		var index int
+		var heartbeat_time string
+		for index, heartbeat_time = range heartbeat_time_array {
+			indexes[heartbeat_time] = index
+		}
+	}
+
+	var query string
+	query = `
+		SELECT
+			name,
+			heartbeat_time,
+			%s
+		FROM %s
+		WHERE code=? AND heartbeat_time>=? AND heartbeat_time<=?
+		ORDER BY name
+	`
+	query = fmt.Sprintf(query, strings.Join(columns, ", "), table)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, begin_time, end_time)
+	defer rows.Close()
+	Throw(err)
+
+	var names []string
+	names = make([]string, 0)
+
+	var data map[string]map[string][]interface{}
+	data = make(map[string]map[string][]interface{})
+
+	var column string
+	for _, column = range columns {
+		data[column] = make(map[string][]interface{})
+	}
+
+	for rows.Next() {
+		var name string
+		var heartbeat_time time.Time
+		var values []sql.NullFloat64
+
+		values = make([]sql.NullFloat64, len(columns))
+
+		var dest []interface{}
+		dest = []interface{}{&name, &heartbeat_time}
+
+		var i int
+		for i = range values {
+			dest = append(dest, &values[i])
+		}
+
+		err = rows.Scan(dest...)
+		Throw(err)
+
+		var index int
+		var ok bool
+		index, ok = indexes[heartbeat_time.Format("2006-01-02 15:04:05")]
+		if !ok {
+			continue
+		}
+
+		if data[columns[0]][name] == nil {
+			names = append(names, name)
+
+			for _, column = range columns {
+				data[column][name] = make([]interface{}, len(heartbeat_time_array))
+			}
+		}
+
+		for i, column = range columns {
+			if values[i].Valid {
+				data[column][name][index] = values[i].Float64
+			}
+		}
+	}
+
+	return names, data
+}
+
 func SelectHostMetric(db *sql.DB, project string, code string, offset int64, limit int64) map[string]interface{} {
 	var err error
 
@@ -547,8 +731,46 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			loadavg_15m,
 			cpu_used,
 			cpu_iowait,
+			cpu_user,
+			cpu_nice,
+			cpu_system,
+			cpu_irq,
+			cpu_softirq,
+			cpu_steal,
+			cpu_cores,
+			psi_supported,
+			psi_cpu_some_avg60,
+			psi_cpu_full_avg60,
+			psi_memory_some_avg60,
+			psi_memory_full_avg60,
+			psi_io_some_avg60,
+			psi_io_full_avg60,
+			kernel_ctxt,
+			kernel_intr,
+			kernel_forks,
+			kernel_procs_running,
+			kernel_procs_blocked,
+			vm_pgpgin,
+			vm_pgpgout,
+			vm_pswpin,
+			vm_pswpout,
+			vm_pgmajfault,
+			vm_oom_kill,
 			mem_used,
 			swap_used,
+			mem_apps,
+			mem_hugepages_total,
+			mem_buffers,
+			mem_cached,
+			mem_shmem,
+			mem_slab,
+			mem_free,
+			mem_available,
+			mem_committed_as,
+			mem_slab_reclaimable,
+			mem_dirty,
+			mem_writeback,
+			mem_hugepages_used,
 			disk_usage,
 			disk_read_rate,
 			disk_write_rate,
@@ -556,6 +778,18 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			nic_transmit_rate,
 			tcp_sockets_inuse,
 			tcp_sockets_tw,
+			tcp_established,
+			tcp_syn_sent,
+			tcp_syn_recv,
+			tcp_fin_wait1,
+			tcp_fin_wait2,
+			tcp_time_wait,
+			tcp_close,
+			tcp_close_wait,
+			tcp_last_ack,
+			tcp_listen,
+			tcp_closing,
+			tcp_new_syn_recv,
 			users,
 			heartbeat_time
 		FROM t_host_metric_%s
@@ -586,6 +820,79 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 	cpu_used_array = make([]float64, 0)
 	cpu_iowait_array = make([]float64, 0)
 
+	var cpu_breakdown_array []map[string]interface{}
+	var cpu_user_array []float64
+	var cpu_nice_array []float64
+	var cpu_system_array []float64
+	var cpu_irq_array []float64
+	var cpu_softirq_array []float64
+	var cpu_steal_array []float64
+
+	cpu_breakdown_array = make([]map[string]interface{}, 0)
+	cpu_user_array = make([]float64, 0)
+	cpu_nice_array = make([]float64, 0)
+	cpu_system_array = make([]float64, 0)
+	cpu_irq_array = make([]float64, 0)
+	cpu_softirq_array = make([]float64, 0)
+	cpu_steal_array = make([]float64, 0)
+
+	// The cores of old rows are null, so that every series is aligned with heartbeat_time_array.
+	var cpu_cores_array []map[string]interface{}
+	var cpu_cores_map map[string][]interface{}
+
+	cpu_cores_array = make([]map[string]interface{}, 0)
+	cpu_cores_map = make(map[string][]interface{})
+
+	// Not supported unless reported by any of the rows
+	var psi_supported bool
+	var pressure_array []map[string]interface{}
+	var psi_cpu_some_array []float64
+	var psi_cpu_full_array []float64
+	var psi_memory_some_array []float64
+	var psi_memory_full_array []float64
+	var psi_io_some_array []float64
+	var psi_io_full_array []float64
+
+	pressure_array = make([]map[string]interface{}, 0)
+	psi_cpu_some_array = make([]float64, 0)
+	psi_cpu_full_array = make([]float64, 0)
+	psi_memory_some_array = make([]float64, 0)
+	psi_memory_full_array = make([]float64, 0)
+	psi_io_some_array = make([]float64, 0)
+	psi_io_full_array = make([]float64, 0)
+
+	var kernel_cs_array []map[string]interface{}
+	var kernel_procs_array []map[string]interface{}
+	var kernel_paging_array []map[string]interface{}
+	var kernel_ctxt_array []float64
+	var kernel_intr_array []float64
+	var kernel_forks_array []float64
+	var kernel_procs_running_array []float64
+	var kernel_procs_blocked_array []float64
+	var vm_pgpgin_array []float64
+	var vm_pgpgout_array []float64
+	var vm_pswpin_array []float64
+	var vm_pswpout_array []float64
+	var vm_pgmajfault_array []float64
+
+	kernel_cs_array = make([]map[string]interface{}, 0)
+	kernel_procs_array = make([]map[string]interface{}, 0)
+	kernel_paging_array = make([]map[string]interface{}, 0)
+	kernel_ctxt_array = make([]float64, 0)
+	kernel_intr_array = make([]float64, 0)
+	kernel_forks_array = make([]float64, 0)
+	kernel_procs_running_array = make([]float64, 0)
+	kernel_procs_blocked_array = make([]float64, 0)
+	vm_pgpgin_array = make([]float64, 0)
+	vm_pgpgout_array = make([]float64, 0)
+	vm_pswpin_array = make([]float64, 0)
+	vm_pswpout_array = make([]float64, 0)
+	vm_pgmajfault_array = make([]float64, 0)
+
+	// Marked on the mem usage chart
+	var oom_kill_points []map[string]interface{}
+	oom_kill_points = make([]map[string]interface{}, 0)
+
 	var mem_usage_array []map[string]interface{}
 	var mem_used_array []float64
 	var swap_used_array []float64
@@ -594,6 +901,38 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 	mem_used_array = make([]float64, 0)
 	swap_used_array = make([]float64, 0)
 
+	var mem_composition_array []map[string]interface{}
+	var mem_others_array []map[string]interface{}
+	var mem_apps_array []float64
+	var mem_hugepages_total_array []float64
+	var mem_buffers_array []float64
+	var mem_cached_array []float64
+	var mem_shmem_array []float64
+	var mem_slab_array []float64
+	var mem_free_array []float64
+	var mem_available_array []float64
+	var mem_committed_as_array []float64
+	var mem_slab_reclaimable_array []float64
+	var mem_dirty_array []float64
+	var mem_writeback_array []float64
+	var mem_hugepages_used_array []float64
+
+	mem_composition_array = make([]map[string]interface{}, 0)
+	mem_others_array = make([]map[string]interface{}, 0)
+	mem_apps_array = make([]float64, 0)
+	mem_hugepages_total_array = make([]float64, 0)
+	mem_buffers_array = make([]float64, 0)
+	mem_cached_array = make([]float64, 0)
+	mem_shmem_array = make([]float64, 0)
+	mem_slab_array = make([]float64, 0)
+	mem_free_array = make([]float64, 0)
+	mem_available_array = make([]float64, 0)
+	mem_committed_as_array = make([]float64, 0)
+	mem_slab_reclaimable_array = make([]float64, 0)
+	mem_dirty_array = make([]float64, 0)
+	mem_writeback_array = make([]float64, 0)
+	mem_hugepages_used_array = make([]float64, 0)
+
 	var disk_usage_array []map[string]interface{}
 	var disk_usage_map map[string][]float64
 
@@ -624,6 +963,13 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 	tcp_sockets_inuse_array = make([]int64, 0)
 	tcp_sockets_tw_array = make([]int64, 0)
 
+	// One series per state
+	var tcp_states_array []map[string]interface{}
+	var tcp_states_map map[string][]int64
+
+	tcp_states_array = make([]map[string]interface{}, 0)
+	tcp_states_map = make(map[string][]int64)
+
 	var misc_array []map[string]interface{}
 	var users_array []float64
 
@@ -639,8 +985,46 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 		var loadavg_15m float64
 		var cpu_used float64
 		var cpu_iowait float64
+		var cpu_user float64
+		var cpu_nice float64
+		var cpu_system float64
+		var cpu_irq float64
+		var cpu_softirq float64
+		var cpu_steal float64
+		var cpu_cores string
+		var psi_supported2 bool
+		var psi_cpu_some float64
+		var psi_cpu_full float64
+		var psi_memory_some float64
+		var psi_memory_full float64
+		var psi_io_some float64
+		var psi_io_full float64
+		var kernel_ctxt float64
+		var kernel_intr float64
+		var kernel_forks float64
+		var kernel_procs_running float64
+		var kernel_procs_blocked float64
+		var vm_pgpgin float64
+		var vm_pgpgout float64
+		var vm_pswpin float64
+		var vm_pswpout float64
+		var vm_pgmajfault float64
+		var vm_oom_kill float64
 		var mem_used float64
 		var swap_used float64
+		var mem_apps float64
+		var mem_hugepages_total float64
+		var mem_buffers float64
+		var mem_cached float64
+		var mem_shmem float64
+		var mem_slab float64
+		var mem_free float64
+		var mem_available float64
+		var mem_committed_as float64
+		var mem_slab_reclaimable float64
+		var mem_dirty float64
+		var mem_writeback float64
+		var mem_hugepages_used float64
 		var disk_usage string
 		var disk_read_rate float64
 		var disk_write_rate float64
@@ -648,6 +1032,18 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 		var nic_transmit_rate float64
 		var tcp_sockets_inuse int64
 		var tcp_sockets_tw int64
+		var tcp_established int64
+		var tcp_syn_sent int64
+		var tcp_syn_recv int64
+		var tcp_fin_wait1 int64
+		var tcp_fin_wait2 int64
+		var tcp_time_wait int64
+		var tcp_close int64
+		var tcp_close_wait int64
+		var tcp_last_ack int64
+		var tcp_listen int64
+		var tcp_closing int64
+		var tcp_new_syn_recv int64
 		var users string
 		var heartbeat_time time.Time
 
@@ -657,8 +1053,46 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			&loadavg_15m,
 			&cpu_used,
 			&cpu_iowait,
+			&cpu_user,
+			&cpu_nice,
+			&cpu_system,
+			&cpu_irq,
+			&cpu_softirq,
+			&cpu_steal,
+			&cpu_cores,
+			&psi_supported2,
+			&psi_cpu_some,
+			&psi_cpu_full,
+			&psi_memory_some,
+			&psi_memory_full,
+			&psi_io_some,
+			&psi_io_full,
+			&kernel_ctxt,
+			&kernel_intr,
+			&kernel_forks,
+			&kernel_procs_running,
+			&kernel_procs_blocked,
+			&vm_pgpgin,
+			&vm_pgpgout,
+			&vm_pswpin,
+			&vm_pswpout,
+			&vm_pgmajfault,
+			&vm_oom_kill,
 			&mem_used,
 			&swap_used,
+			&mem_apps,
+			&mem_hugepages_total,
+			&mem_buffers,
+			&mem_cached,
+			&mem_shmem,
+			&mem_slab,
+			&mem_free,
+			&mem_available,
+			&mem_committed_as,
+			&mem_slab_reclaimable,
+			&mem_dirty,
+			&mem_writeback,
+			&mem_hugepages_used,
 			&disk_usage,
 			&disk_read_rate,
 			&disk_write_rate,
@@ -666,6 +1100,18 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			&nic_transmit_rate,
 			&tcp_sockets_inuse,
 			&tcp_sockets_tw,
+			&tcp_established,
+			&tcp_syn_sent,
+			&tcp_syn_recv,
+			&tcp_fin_wait1,
+			&tcp_fin_wait2,
+			&tcp_time_wait,
+			&tcp_close,
+			&tcp_close_wait,
+			&tcp_last_ack,
+			&tcp_listen,
+			&tcp_closing,
+			&tcp_new_syn_recv,
 			&users,
 			&heartbeat_time,
 		)
@@ -682,11 +1128,110 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			cpu_iowait_array = append(cpu_iowait_array, cpu_iowait)
 		}
 
+		{
+			cpu_user_array = append(cpu_user_array, cpu_user)
+			cpu_nice_array = append(cpu_nice_array, cpu_nice)
+			cpu_system_array = append(cpu_system_array, cpu_system)
+			cpu_irq_array = append(cpu_irq_array, cpu_irq)
+			cpu_softirq_array = append(cpu_softirq_array, cpu_softirq)
+			cpu_steal_array = append(cpu_steal_array, cpu_steal)
+		}
+
+		{
+			var fields []string
+			if cpu_cores != "" {
+				fields = strings.Split(cpu_cores, ",")
+			}
+
+			// cpu0_user_nice_system_idle_iowait_irq_softirq_steal_guest_guest_nice
+			var field string
+			for _, field = range fields {
+				var fields2 []string
+				fields2 = strings.Split(field, "_")
+
+				if len(fields2) < 6 {
+					continue
+				}
+
+				var core string
+				var idle float64
+				var iowait float64
+
+				core = fields2[0]
+				idle, err = strconv.ParseFloat(fields2[4], 64)
+				Skip(err)
+				iowait, err = strconv.ParseFloat(fields2[5], 64)
+				Skip(err)
+
+				for len(cpu_cores_map[core]) < len(heartbeat_time_array) {
+					cpu_cores_map[core] = append(cpu_cores_map[core], nil)
+				}
+				cpu_cores_map[core] = append(cpu_cores_map[core], math.Round((100-idle-iowait)*100)/100)
+			}
+
+			var core string
+			for core = range cpu_cores_map {
+				for len(cpu_cores_map[core]) < len(heartbeat_time_array)+1 {
+					cpu_cores_map[core] = append(cpu_cores_map[core], nil)
+				}
+			}
+		}
+
+		{
+			psi_supported = psi_supported || psi_supported2
+			psi_cpu_some_array = append(psi_cpu_some_array, psi_cpu_some)
+			psi_cpu_full_array = append(psi_cpu_full_array, psi_cpu_full)
+			psi_memory_some_array = append(psi_memory_some_array, psi_memory_some)
+			psi_memory_full_array = append(psi_memory_full_array, psi_memory_full)
+			psi_io_some_array = append(psi_io_some_array, psi_io_some)
+			psi_io_full_array = append(psi_io_full_array, psi_io_full)
+		}
+
+		{
+			kernel_ctxt_array = append(kernel_ctxt_array, kernel_ctxt)
+			kernel_intr_array = append(kernel_intr_array, kernel_intr)
+			kernel_forks_array = append(kernel_forks_array, kernel_forks)
+			kernel_procs_running_array = append(kernel_procs_running_array, kernel_procs_running)
+			kernel_procs_blocked_array = append(kernel_procs_blocked_array, kernel_procs_blocked)
+			vm_pgpgin_array = append(vm_pgpgin_array, vm_pgpgin)
+			vm_pgpgout_array = append(vm_pgpgout_array, vm_pgpgout)
+			vm_pswpin_array = append(vm_pswpin_array, vm_pswpin)
+			vm_pswpout_array = append(vm_pswpout_array, vm_pswpout)
+			vm_pgmajfault_array = append(vm_pgmajfault_array, vm_pgmajfault)
+
+			if vm_oom_kill > 0 {
+				oom_kill_points = append(
+					oom_kill_points,
+					map[string]interface{}{
+						"name":  "OOM Kill",
+						"value": vm_oom_kill,
+						"coord": []interface{}{heartbeat_time.Format("2006-01-02 15:04:05"), mem_used},
+					},
+				)
+			}
+		}
+
 		{
 			mem_used_array = append(mem_used_array, mem_used)
 			swap_used_array = append(swap_used_array, swap_used)
 		}
 
+		{
+			mem_apps_array = append(mem_apps_array, mem_apps)
+			mem_hugepages_total_array = append(mem_hugepages_total_array, mem_hugepages_total)
+			mem_buffers_array = append(mem_buffers_array, mem_buffers)
+			mem_cached_array = append(mem_cached_array, mem_cached)
+			mem_shmem_array = append(mem_shmem_array, mem_shmem)
+			mem_slab_array = append(mem_slab_array, mem_slab)
+			mem_free_array = append(mem_free_array, mem_free)
+			mem_available_array = append(mem_available_array, mem_available)
+			mem_committed_as_array = append(mem_committed_as_array, mem_committed_as)
+			mem_slab_reclaimable_array = append(mem_slab_reclaimable_array, mem_slab_reclaimable)
+			mem_dirty_array = append(mem_dirty_array, mem_dirty)
+			mem_writeback_array = append(mem_writeback_array, mem_writeback)
+			mem_hugepages_used_array = append(mem_hugepages_used_array, mem_hugepages_used)
+		}
+
 		{
 			var fields []string
 			fields = strings.Split(disk_usage, ",")
@@ -738,6 +1283,21 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 			tcp_sockets_tw_array = append(tcp_sockets_tw_array, tcp_sockets_tw)
 		}
 
+		{
+			tcp_states_map["established"] = append(tcp_states_map["established"], tcp_established)
+			tcp_states_map["syn_sent"] = append(tcp_states_map["syn_sent"], tcp_syn_sent)
+			tcp_states_map["syn_recv"] = append(tcp_states_map["syn_recv"], tcp_syn_recv)
+			tcp_states_map["fin_wait1"] = append(tcp_states_map["fin_wait1"], tcp_fin_wait1)
+			tcp_states_map["fin_wait2"] = append(tcp_states_map["fin_wait2"], tcp_fin_wait2)
+			tcp_states_map["time_wait"] = append(tcp_states_map["time_wait"], tcp_time_wait)
+			tcp_states_map["close"] = append(tcp_states_map["close"], tcp_close)
+			tcp_states_map["close_wait"] = append(tcp_states_map["close_wait"], tcp_close_wait)
+			tcp_states_map["last_ack"] = append(tcp_states_map["last_ack"], tcp_last_ack)
+			tcp_states_map["listen"] = append(tcp_states_map["listen"], tcp_listen)
+			tcp_states_map["closing"] = append(tcp_states_map["closing"], tcp_closing)
+			tcp_states_map["new_syn_recv"] = append(tcp_states_map["new_syn_recv"], tcp_new_syn_recv)
+		}
+
 		{
 			var users2 float64
 			users2, err = strconv.ParseFloat(users, 64)
@@ -755,15 +1315,123 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 		return map[string]interface{}{"name": name, "data": data}
 	}
 
+	// The min and max of the samples taken within each interval, drawn as a
+	// band around the line, see t_host_metric_agg_%s
+	var agg map[string]map[string][]interface{}
+	_, agg = SelectHostDeviceMetric(
+		db,
+		fmt.Sprintf("t_host_metric_agg_%s", project),
+		code,
+		begin_time,
+		end_time,
+		[]string{"min_value", "max_value"},
+		heartbeat_time_array,
+	)
+
+	var generate_band_series func(name string, data interface{}, metric string) map[string]interface{}
+	generate_band_series = func(name string, data interface{}, metric string) map[string]interface{} {
+		var series map[string]interface{}
+		series = generate_series(name, data)
+
+		var min_array []interface{}
+		var max_array []interface{}
+		min_array = agg["min_value"][metric]
+		max_array = agg["max_value"][metric]
+
+		if min_array == nil {
+			return series
+		}
+
+		// Stacked on top of the min
+		var range_array []interface{}
+		range_array = make([]interface{}, len(min_array))
+
+		var i int
+		for i = range min_array {
+			if min_array[i] != nil && max_array[i] != nil {
+				range_array[i] = math.Round((max_array[i].(float64)-min_array[i].(float64))*100) / 100
+			}
+		}
+
+		series["band_min"] = min_array
+		series["band_range"] = range_array
+
+		return series
+	}
+
 	loadavg_array = append(loadavg_array, generate_series("loadavg_1m", loadavg_1m_array))
 	loadavg_array = append(loadavg_array, generate_series("loadavg_5m", loadavg_5m_array))
 	loadavg_array = append(loadavg_array, generate_series("loadavg_15m", loadavg_15m_array))
 
-	cpu_usage_array = append(cpu_usage_array, generate_series("cpu_usage", cpu_used_array))
-	cpu_usage_array = append(cpu_usage_array, generate_series("cpu_iowait", cpu_iowait_array))
+	cpu_usage_array = append(cpu_usage_array, generate_band_series("cpu_usage", cpu_used_array, "cpu_used"))
+	cpu_usage_array = append(cpu_usage_array, generate_band_series("cpu_iowait", cpu_iowait_array, "cpu_iowait"))
+	cpu_usage_array = append(cpu_usage_array, generate_series("cpu_steal", cpu_steal_array))
+
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("user", cpu_user_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("nice", cpu_nice_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("system", cpu_system_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("iowait", cpu_iowait_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("irq", cpu_irq_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("softirq", cpu_softirq_array))
+	cpu_breakdown_array = append(cpu_breakdown_array, generate_series("steal", cpu_steal_array))
+
+	{
+		var cores []string
+		var core string
+		for core = range cpu_cores_map {
+			cores = append(cores, core)
+		}
+
+		// cpu2 < cpu10
+		sort.Slice(cores, func(i int, j int) bool {
+			if len(cores[i]) != len(cores[j]) {
+				return len(cores[i]) < len(cores[j])
+			}
+			return cores[i] < cores[j]
+		})
+
+		for _, core = range cores {
+			cpu_cores_array = append(cpu_cores_array, generate_series(core, cpu_cores_map[core]))
+		}
+	}
 
-	mem_usage_array = append(mem_usage_array, generate_series("mem_usage", mem_used_array))
-	mem_usage_array = append(mem_usage_array, generate_series("swap_usage", swap_used_array))
+	pressure_array = append(pressure_array, generate_series("cpu_some", psi_cpu_some_array))
+	pressure_array = append(pressure_array, generate_series("cpu_full", psi_cpu_full_array))
+	pressure_array = append(pressure_array, generate_series("memory_some", psi_memory_some_array))
+	pressure_array = append(pressure_array, generate_series("memory_full", psi_memory_full_array))
+	pressure_array = append(pressure_array, generate_series("io_some", psi_io_some_array))
+	pressure_array = append(pressure_array, generate_series("io_full", psi_io_full_array))
+
+	kernel_cs_array = append(kernel_cs_array, generate_series("ctxt", kernel_ctxt_array))
+	kernel_cs_array = append(kernel_cs_array, generate_series("intr", kernel_intr_array))
+
+	kernel_procs_array = append(kernel_procs_array, generate_series("forks", kernel_forks_array))
+	kernel_procs_array = append(kernel_procs_array, generate_series("procs_running", kernel_procs_running_array))
+	kernel_procs_array = append(kernel_procs_array, generate_series("procs_blocked", kernel_procs_blocked_array))
+
+	kernel_paging_array = append(kernel_paging_array, generate_series("pgpgin", vm_pgpgin_array))
+	kernel_paging_array = append(kernel_paging_array, generate_series("pgpgout", vm_pgpgout_array))
+	kernel_paging_array = append(kernel_paging_array, generate_series("pswpin", vm_pswpin_array))
+	kernel_paging_array = append(kernel_paging_array, generate_series("pswpout", vm_pswpout_array))
+	kernel_paging_array = append(kernel_paging_array, generate_series("pgmajfault", vm_pgmajfault_array))
+
+	mem_usage_array = append(mem_usage_array, generate_band_series("mem_usage", mem_used_array, "mem_used"))
+	mem_usage_array = append(mem_usage_array, generate_band_series("swap_usage", swap_used_array, "swap_used"))
+
+	mem_composition_array = append(mem_composition_array, generate_series("apps", mem_apps_array))
+	mem_composition_array = append(mem_composition_array, generate_series("hugepages_total", mem_hugepages_total_array))
+	mem_composition_array = append(mem_composition_array, generate_series("buffers", mem_buffers_array))
+	mem_composition_array = append(mem_composition_array, generate_series("cached", mem_cached_array))
+	mem_composition_array = append(mem_composition_array, generate_series("shmem", mem_shmem_array))
+	mem_composition_array = append(mem_composition_array, generate_series("slab", mem_slab_array))
+	mem_composition_array = append(mem_composition_array, generate_series("free", mem_free_array))
+
+	mem_others_array = append(mem_others_array, generate_series("available", mem_available_array))
+	mem_others_array = append(mem_others_array, generate_series("committed_as", mem_committed_as_array))
+	mem_others_array = append(mem_others_array, generate_series("slab_reclaimable", mem_slab_reclaimable_array))
+	mem_others_array = append(mem_others_array, generate_series("dirty", mem_dirty_array))
+	mem_others_array = append(mem_others_array, generate_series("writeback", mem_writeback_array))
+	mem_others_array = append(mem_others_array, generate_series("hugepages_used", mem_hugepages_used_array))
 
 	var key string
 	var value interface{}
@@ -772,202 +1440,2593 @@ func SelectHostMetric(db *sql.DB, project string, code string, offset int64, lim
 		disk_usage_array = append(disk_usage_array, generate_series(key, value))
 	}
 
-	disk_io_rate_array = append(disk_io_rate_array, generate_series("read_rate", disk_read_rate_array))
-	disk_io_rate_array = append(disk_io_rate_array, generate_series("write_rate", disk_write_rate_array))
+	disk_io_rate_array = append(disk_io_rate_array, generate_band_series("read_rate", disk_read_rate_array, "disk_read_rate"))
+	disk_io_rate_array = append(disk_io_rate_array, generate_band_series("write_rate", disk_write_rate_array, "disk_write_rate"))
 
-	nic_io_rate_array = append(nic_io_rate_array, generate_series("reveive_rate", nic_receive_rate_array))
-	nic_io_rate_array = append(nic_io_rate_array, generate_series("transmit_rate", nic_transmit_rate_array))
+	nic_io_rate_array = append(nic_io_rate_array, generate_band_series("reveive_rate", nic_receive_rate_array, "nic_receive_rate"))
+	nic_io_rate_array = append(nic_io_rate_array, generate_band_series("transmit_rate", nic_transmit_rate_array, "nic_transmit_rate"))
 
 	tcp_sockets_array = append(tcp_sockets_array, generate_series("inuse", tcp_sockets_inuse_array))
 	tcp_sockets_array = append(tcp_sockets_array, generate_series("tw", tcp_sockets_tw_array))
 
+	{
+		var state string
+		for _, state = range []string{
+			"established",
+			"syn_sent",
+			"syn_recv",
+			"fin_wait1",
+			"fin_wait2",
+			"time_wait",
+			"close",
+			"close_wait",
+			"last_ack",
+			"listen",
+			"closing",
+			"new_syn_recv",
+		} {
+			tcp_states_array = append(tcp_states_array, generate_series(state, tcp_states_map[state]))
+		}
+	}
+
 	misc_array = append(misc_array, generate_series("users", users_array))
 
-	var host_metric map[string]interface{}
-	host_metric = map[string]interface{}{
-		"loadavg_array":        loadavg_array,
-		"cpu_usage_array":      cpu_usage_array,
-		"mem_usage_array":      mem_usage_array,
-		"disk_usage_array":     disk_usage_array,
-		"disk_io_rate_array":   disk_io_rate_array,
-		"nic_io_rate_array":    nic_io_rate_array,
-		"tcp_sockets_array":    tcp_sockets_array,
-		"misc_array":           misc_array,
-		"heartbeat_time_array": heartbeat_time_array,
-	}
+	var disks_iops_array []map[string]interface{}
+	var disks_rate_array []map[string]interface{}
+	var disks_await_array []map[string]interface{}
+	var disks_util_array []map[string]interface{}
 
-	return host_metric
-}
+	disks_iops_array = make([]map[string]interface{}, 0)
+	disks_rate_array = make([]map[string]interface{}, 0)
+	disks_await_array = make([]map[string]interface{}, 0)
+	disks_util_array = make([]map[string]interface{}, 0)
 
-func Index(response http.ResponseWriter, request *http.Request) {
-	if request.URL.Path != "/" {
-		Api(response, 404)
-		return
-	}
+	{
+		var table string
+		table = fmt.Sprintf("t_host_disk_%s", project)
 
-	var err error
+		var columns []string
+		columns = []string{
+			"read_iops", "write_iops", "read_rate", "write_rate",
+			"read_await", "write_await", "util",
+		}
 
-	var project string
-	var id string
-	var offset string
-	var limit string
-	var mode string
+		var names []string
+		var data map[string]map[string][]interface{}
+		names, data = SelectHostDeviceMetric(db, table, code, begin_time, end_time, columns, heartbeat_time_array)
 
-	project = FormValueOf(request, "project")
-	id = FormValueOf(request, "id")
-	offset = FormValueOf(request, "offset")
-	limit = FormValueOf(request, "limit")
-	mode = FormValueOf(request, "mode")
+		var name string
+		for _, name = range names {
+			disks_iops_array = append(disks_iops_array, generate_series(name+" read_iops", data["read_iops"][name]))
+			disks_iops_array = append(disks_iops_array, generate_series(name+" write_iops", data["write_iops"][name]))
 
-	if IsNotInt(id, offset, limit) {
-		Api(response, 400)
-		return
-	}
+			disks_rate_array = append(disks_rate_array, generate_series(name+" read_rate", data["read_rate"][name]))
+			disks_rate_array = append(disks_rate_array, generate_series(name+" write_rate", data["write_rate"][name]))
 
-	if IsNotSet(project) {
-		project = "default"
-	} else {
-		project = strings.ToLower(project)
-	}
+			disks_await_array = append(disks_await_array, generate_series(name+" read_await", data["read_await"][name]))
+			disks_await_array = append(disks_await_array, generate_series(name+" write_await", data["write_await"][name]))
 
-	var offset2 int64
-	if IsNotSet(offset) {
-		offset2 = 240
-	} else {
-		offset2, err = strconv.ParseInt(offset, 10, 64)
-		Skip(err)
+			disks_util_array = append(disks_util_array, generate_series(name, data["util"][name]))
+		}
 	}
 
-	var limit2 int64
-	if IsNotSet(limit) {
-		// 60 * 24 * 31
-		limit2 = 44640
-	} else {
-		limit2, err = strconv.ParseInt(limit, 10, 64)
-		Skip(err)
-		// if limit2 == -1 {
-		// 	// 1,000,000,000
-		// 	limit2 = 1000000000
-		// }
-	}
+	var nics_array []map[string]interface{}
+	var nics_error_array []map[string]interface{}
 
-	if mode != "1" {
-		mode = "0"
-	}
+	nics_array = make([]map[string]interface{}, 0)
+	nics_error_array = make([]map[string]interface{}, 0)
 
-	var db *sql.DB
-	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
-	defer db.Close()
-	Throw(err)
+	{
+		var table string
+		table = fmt.Sprintf("t_host_nic_%s", project)
 
-	var projects []map[string]interface{}
-	projects = SelectProjects(db)
+		var columns []string
+		columns = []string{
+			"receive_rate", "transmit_rate",
+			"receive_errs", "receive_drop", "transmit_errs", "transmit_drop",
+		}
 
-	var host map[string]interface{}
-	var hosts []map[string]interface{}
+		var names []string
+		var data map[string]map[string][]interface{}
+		names, data = SelectHostDeviceMetric(db, table, code, begin_time, end_time, columns, heartbeat_time_array)
 
-	var id2 int64
-	if IsNotSet(id) {
-		hosts = SelectHosts(db, project)
+		var name string
+		for _, name = range names {
+			nics_array = append(nics_array, generate_series(name+" receive_rate", data["receive_rate"][name]))
+			nics_array = append(nics_array, generate_series(name+" transmit_rate", data["transmit_rate"][name]))
 
-		if len(hosts) > 0 {
-			host = hosts[0]
-			id2 = host["id"].(int64)
+			nics_error_array = append(nics_error_array, generate_series(name+" receive_errs", data["receive_errs"][name]))
+			nics_error_array = append(nics_error_array, generate_series(name+" receive_drop", data["receive_drop"][name]))
+			nics_error_array = append(nics_error_array, generate_series(name+" transmit_errs", data["transmit_errs"][name]))
+			nics_error_array = append(nics_error_array, generate_series(name+" transmit_drop", data["transmit_drop"][name]))
 		}
-	} else {
-		id2, err = strconv.ParseInt(id, 10, 64)
-		Skip(err)
-
-		host = SelectHost(db, id2)
-		project = host["project"].(string)
-		hosts = SelectHosts(db, project)
 	}
 
-	// > interface conversion: interface {} is nil, not string
-	// host["code"] could be nil when there is no data
-	var code string
-	code = host["code"].(string)
+	var cgroups_cpu_array []map[string]interface{}
+	var cgroups_throttled_array []map[string]interface{}
+	var cgroups_mem_array []map[string]interface{}
+	var cgroups_io_array []map[string]interface{}
 
-	var host_metric map[string]interface{}
-	host_metric = SelectHostMetric(db, project, code, offset2, limit2)
+	cgroups_cpu_array = make([]map[string]interface{}, 0)
+	cgroups_throttled_array = make([]map[string]interface{}, 0)
+	cgroups_mem_array = make([]map[string]interface{}, 0)
+	cgroups_io_array = make([]map[string]interface{}, 0)
 
-	var state map[string]interface{}
-	state = map[string]interface{}{
-		"offset": offset2,
-		"mode":   mode,
+	{
+		var table string
+		table = fmt.Sprintf("t_host_cgroup_%s", project)
+
+		var columns []string
+		columns = []string{
+			"cpu_used", "cpu_throttled",
+			"mem_current", "mem_max",
+			"io_read_rate", "io_write_rate",
+		}
+
+		var names []string
+		var data map[string]map[string][]interface{}
+		names, data = SelectHostDeviceMetric(db, table, code, begin_time, end_time, columns, heartbeat_time_array)
+
+		var name string
+		for _, name = range names {
+			cgroups_cpu_array = append(cgroups_cpu_array, generate_series(name, data["cpu_used"][name]))
+
+			cgroups_throttled_array = append(cgroups_throttled_array, generate_series(name, data["cpu_throttled"][name]))
+
+			cgroups_mem_array = append(cgroups_mem_array, generate_series(name+" current", data["mem_current"][name]))
+
+			// mem_max is 0 if unlimited
+			var value interface{}
+			for _, value = range data["mem_max"][name] {
+				if value != nil && value.(float64) > 0 {
+					cgroups_mem_array = append(cgroups_mem_array, generate_series(name+" max", data["mem_max"][name]))
+					break
+				}
+			}
+
+			cgroups_io_array = append(cgroups_io_array, generate_series(name+" read_rate", data["io_read_rate"][name]))
+			cgroups_io_array = append(cgroups_io_array, generate_series(name+" write_rate", data["io_write_rate"][name]))
+		}
 	}
 
-	var data struct {
-		Projects   []map[string]interface{}
-		Host       map[string]interface{}
-		Hosts      []map[string]interface{}
-		HostMetric map[string]interface{}
-		State      map[string]interface{}
+	var host_metric map[string]interface{}
+	host_metric = map[string]interface{}{
+		"loadavg_array":           loadavg_array,
+		"cpu_usage_array":         cpu_usage_array,
+		"cpu_breakdown_array":     cpu_breakdown_array,
+		"cpu_cores_array":         cpu_cores_array,
+		"psi_supported":           psi_supported,
+		"pressure_array":          pressure_array,
+		"kernel_cs_array":         kernel_cs_array,
+		"kernel_procs_array":      kernel_procs_array,
+		"kernel_paging_array":     kernel_paging_array,
+		"oom_kill_points":         oom_kill_points,
+		"mem_usage_array":         mem_usage_array,
+		"mem_composition_array":   mem_composition_array,
+		"mem_others_array":        mem_others_array,
+		"disk_usage_array":        disk_usage_array,
+		"disk_io_rate_array":      disk_io_rate_array,
+		"disks_iops_array":        disks_iops_array,
+		"disks_rate_array":        disks_rate_array,
+		"disks_await_array":       disks_await_array,
+		"disks_util_array":        disks_util_array,
+		"nic_io_rate_array":       nic_io_rate_array,
+		"nics_array":              nics_array,
+		"nics_error_array":        nics_error_array,
+		"cgroups_cpu_array":       cgroups_cpu_array,
+		"cgroups_throttled_array": cgroups_throttled_array,
+		"cgroups_mem_array":       cgroups_mem_array,
+		"cgroups_io_array":        cgroups_io_array,
+		"custom_charts":           SelectHostCustomMetric(db, project, code, begin_time, end_time, heartbeat_time_array),
+		"tcp_sockets_array":       tcp_sockets_array,
+		"tcp_states_array":        tcp_states_array,
+		"misc_array":              misc_array,
+		"heartbeat_time_array":    heartbeat_time_array,
 	}
-	data.Projects = projects
-	data.Host = host
-	data.Hosts = hosts
-	data.HostMetric = host_metric
-	data.State = state
 
-	var HTML string
-	// Replace it when packaging static files into a single file
-	HTML = ""
+	return host_metric
+}
+
+// The processes reported at heartbeat_time, or the latest ones before it.
+func SelectHostProcesses(db *sql.DB, project string, code string, heartbeat_time string) []map[string]interface{} {
+	var err error
+
+	log.Println("project:", project)
+	log.Println("code:", code)
+	log.Println("heartbeat_time:", heartbeat_time)
+
+	var query string
+	query = `
+		SELECT
+			pid,
+			name,
+			cmdline,
+			cpu_used,
+			mem_rss,
+			threads,
+			heartbeat_time
+		FROM t_host_process_%s
+		WHERE code=? AND heartbeat_time=(
+			SELECT MAX(heartbeat_time) FROM t_host_process_%s WHERE code=? AND heartbeat_time<=?
+		)
+		ORDER BY cpu_used DESC, mem_rss DESC
+	`
+	query = fmt.Sprintf(query, project, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, code, heartbeat_time)
+	defer rows.Close()
+	Throw(err)
+
+	var processes []map[string]interface{}
+	processes = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var pid int64
+		var name string
+		var cmdline string
+		var cpu_used float64
+		var mem_rss float64
+		var threads int64
+		var heartbeat_time2 time.Time
+
+		err = rows.Scan(
+			&pid,
+			&name,
+			&cmdline,
+			&cpu_used,
+			&mem_rss,
+			&threads,
+			&heartbeat_time2,
+		)
+		Throw(err)
+
+		processes = append(
+			processes,
+			map[string]interface{}{
+				"pid":            pid,
+				"name":           name,
+				"cmdline":        cmdline,
+				"cpu_used":       cpu_used,
+				"mem_rss":        mem_rss,
+				"threads":        threads,
+				"heartbeat_time": heartbeat_time2.Format("2006-01-02 15:04:05"),
+			},
+		)
+	}
+
+	return processes
+}
+
+// The listening ports of a host, a port is new if it appeared after begin_time,
+// except for the first inventory of the host, and gone if it was not in the
+// latest inventory. The ports which had gone before begin_time are omitted.
+func SelectHostPorts(db *sql.DB, project string, code string, begin_time string) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `
+		SELECT
+			port.protocol,
+			port.ip,
+			port.port,
+			port.pid,
+			port.name,
+			port.first_seen,
+			port.last_seen,
+			port.first_seen>(SELECT MIN(first_seen) FROM t_host_port_%s WHERE code=?) AND port.first_seen>=? AS is_new,
+			port.last_seen<(SELECT MAX(last_seen) FROM t_host_port_%s WHERE code=?) AS is_gone
+		FROM t_host_port_%s port
+		WHERE port.code=? AND port.last_seen>=?
+		ORDER BY port.port, port.protocol, port.ip
+	`
+	query = fmt.Sprintf(query, project, project, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, begin_time, code, code, begin_time)
+	defer rows.Close()
+	Throw(err)
+
+	var ports []map[string]interface{}
+	ports = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var protocol string
+		var ip string
+		var port int64
+		var pid int64
+		var name string
+		var first_seen time.Time
+		var last_seen time.Time
+		var is_new bool
+		var is_gone bool
+
+		err = rows.Scan(
+			&protocol,
+			&ip,
+			&port,
+			&pid,
+			&name,
+			&first_seen,
+			&last_seen,
+			&is_new,
+			&is_gone,
+		)
+		Throw(err)
+
+		ports = append(
+			ports,
+			map[string]interface{}{
+				"protocol":   protocol,
+				"ip":         ip,
+				"port":       port,
+				"pid":        pid,
+				"name":       name,
+				"first_seen": first_seen.Format("2006-01-02 15:04:05"),
+				"last_seen":  last_seen.Format("2006-01-02 15:04:05"),
+				"is_new":     is_new,
+				"is_gone":    is_gone,
+			},
+		)
+	}
+
+	return ports
+}
+
+// At most so many of the latest log events of a host are shown
+const HOST_EVENTS_LIMIT = 100
+
+// The latest log events of a host since begin_time, see InsertHostEvent().
+func SelectHostEvents(db *sql.DB, project string, code string, begin_time string) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `
+		SELECT
+			name,
+			path,
+			line,
+			heartbeat_time
+		FROM t_host_event_%s
+		WHERE code=? AND heartbeat_time>=?
+		ORDER BY heartbeat_time DESC, id DESC
+		LIMIT %d
+	`
+	query = fmt.Sprintf(query, project, HOST_EVENTS_LIMIT)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, begin_time)
+	defer rows.Close()
+	Throw(err)
+
+	var events []map[string]interface{}
+	events = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var name string
+		var path string
+		var line string
+		var heartbeat_time time.Time
+
+		err = rows.Scan(&name, &path, &line, &heartbeat_time)
+		Throw(err)
+
+		events = append(
+			events,
+			map[string]interface{}{
+				"name":           name,
+				"path":           path,
+				"line":           line,
+				"heartbeat_time": heartbeat_time.Format("2006-01-02 15:04:05"),
+			},
+		)
+	}
+
+	return events
+}
+
+// The watched processes at the latest heartbeat_time, a process is down when
+// none of it is running, last_seen_time is when it was running at last.
+func SelectHostWatchedProcesses(db *sql.DB, project string, code string) []map[string]interface{} {
+	var err error
+
+	var query string
+	query = `
+		SELECT
+			watch.name,
+			watch.type,
+			watch.pattern,
+			watch.count,
+			watch.cpu_used,
+			watch.mem_rss,
+			watch.threads,
+			watch.fds,
+			watch.start_time,
+			watch.heartbeat_time,
+			(
+				SELECT MAX(watch2.heartbeat_time) FROM t_host_watch_%s watch2
+				WHERE watch2.code=watch.code AND watch2.name=watch.name AND watch2.count>0
+			) AS last_seen_time
+		FROM t_host_watch_%s watch
+		WHERE watch.code=? AND watch.heartbeat_time=(
+			SELECT MAX(heartbeat_time) FROM t_host_watch_%s WHERE code=?
+		)
+		ORDER BY watch.name
+	`
+	query = fmt.Sprintf(query, project, project, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, code)
+	defer rows.Close()
+	Throw(err)
+
+	var watched_processes []map[string]interface{}
+	watched_processes = make([]map[string]interface{}, 0)
+
+	for rows.Next() {
+		var name string
+		var type2 string
+		var pattern string
+		var count int64
+		var cpu_used float64
+		var mem_rss float64
+		var threads int64
+		var fds int64
+		var start_time string
+		var heartbeat_time time.Time
+		var last_seen_time sql.NullString
+
+		err = rows.Scan(
+			&name,
+			&type2,
+			&pattern,
+			&count,
+			&cpu_used,
+			&mem_rss,
+			&threads,
+			&fds,
+			&start_time,
+			&heartbeat_time,
+			&last_seen_time,
+		)
+		Throw(err)
+
+		// MAX() returns the value as stored instead of a time.Time
+		var last_seen_time2 string
+		if last_seen_time.Valid {
+			var last_seen_time3 time.Time
+			last_seen_time3, err = time.Parse(time.RFC3339, last_seen_time.String)
+			if err == nil {
+				last_seen_time2 = last_seen_time3.Format("2006-01-02 15:04:05")
+			} else {
+				last_seen_time2 = last_seen_time.String
+			}
+		}
+
+		watched_processes = append(
+			watched_processes,
+			map[string]interface{}{
+				"name":           name,
+				"type":           type2,
+				"pattern":        pattern,
+				"count":          count,
+				"cpu_used":       cpu_used,
+				"mem_rss":        mem_rss,
+				"threads":        threads,
+				"fds":            fds,
+				"start_time":     start_time,
+				"heartbeat_time": heartbeat_time.Format("2006-01-02 15:04:05"),
+				"last_seen_time": last_seen_time2,
+				"is_down":        count == 0,
+			},
+		)
+	}
+
+	return watched_processes
+}
+
+// The custom metrics of a host, one chart per name with one series per set of
+// labels, aligned with heartbeat_time_array of t_host_metric_%s as in
+// SelectHostDeviceMetric().
+//
+// custom_charts: name, series (name, data)
+func SelectHostCustomMetric(db *sql.DB, project string, code string, begin_time string, end_time string, heartbeat_time_array []string) []map[string]interface{} {
+	var err error
+
+	var indexes map[string]int
+	indexes = make(map[string]int)
+
+	{
+		var index int
+		var heartbeat_time string
+		for index, heartbeat_time = range heartbeat_time_array {
+			indexes[heartbeat_time] = index
+		}
+	}
+
+	var query string
+	query = `
+		SELECT
+			name,
+			labels,
+			value,
+			heartbeat_time
+		FROM t_host_custom_%s
+		WHERE code=? AND heartbeat_time>=? AND heartbeat_time<=?
+		ORDER BY name, labels
+	`
+	query = fmt.Sprintf(query, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, begin_time, end_time)
+	defer rows.Close()
+	Throw(err)
+
+	var charts []map[string]interface{}
+	charts = make([]map[string]interface{}, 0)
+
+	var series []map[string]interface{}
+	var data []interface{}
+	var last_name string
+	var last_labels string
+
+	for rows.Next() {
+		var name string
+		var labels string
+		var value float64
+		var heartbeat_time time.Time
+
+		err = rows.Scan(&name, &labels, &value, &heartbeat_time)
+		Throw(err)
+
+		var index int
+		var ok bool
+		index, ok = indexes[heartbeat_time.Format("2006-01-02 15:04:05")]
+		if !ok {
+			continue
+		}
+
+		if len(charts) == 0 || name != last_name {
+			series = make([]map[string]interface{}, 0)
+			charts = append(charts, map[string]interface{}{"name": name, "series": series})
+			last_name = name
+			last_labels = ""
+			data = nil
+		}
+
+		if data == nil || labels != last_labels {
+			var series_name string
+			series_name = labels
+			if series_name == "" {
+				series_name = name
+			}
+
+			data = make([]interface{}, len(heartbeat_time_array))
+			series = append(series, map[string]interface{}{"name": series_name, "data": data})
+			charts[len(charts)-1]["series"] = series
+			last_labels = labels
+		}
+
+		data[index] = value
+	}
+
+	return charts
+}
+
+// The rates derived from the counters of a host, one per step minutes, which
+// are calculated from the raw counters again, so they are exact over any step
+// and not averages of averages. The window of a rate never spans a reboot,
+// the sample after which is returned with is_reset and without any rate.
+func SelectHostCounters(db *sql.DB, project string, code string, begin_time string, end_time string, step int64) []map[string]interface{} {
+	var err error
+
+	log.Println("project:", project)
+	log.Println("code:", code)
+	log.Println("begin_time:", begin_time)
+	log.Println("end_time:", end_time)
+	log.Println("step:", step)
+
+	var query string
+	query = `
+		SELECT
+			%s,
+			heartbeat_time
+		FROM t_host_counter_%s
+		WHERE code=? AND heartbeat_time>=? AND heartbeat_time<=?
+		ORDER BY heartbeat_time
+	`
+	query = fmt.Sprintf(query, strings.Join(COUNTER_COLUMNS, ", "), project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query, code, begin_time, end_time)
+	defer rows.Close()
+	Throw(err)
+
+	var points []map[string]interface{}
+	points = make([]map[string]interface{}, 0)
+
+	// The previous sample and the one at the beginning of the step
+	var previous map[string]float64
+	var anchor map[string]float64
+	var anchor_bucket int64
+
+	for rows.Next() {
+		var values []float64
+		values = make([]float64, len(COUNTER_COLUMNS))
+
+		var dest []interface{}
+		var i int
+		for i = range values {
+			dest = append(dest, &values[i])
+		}
+
+		var heartbeat_time time.Time
+		dest = append(dest, &heartbeat_time)
+
+		err = rows.Scan(dest...)
+		Throw(err)
+
+		var current map[string]float64
+		current = make(map[string]float64)
+		for i = range COUNTER_COLUMNS {
+			current[COUNTER_COLUMNS[i]] = values[i]
+		}
+
+		var bucket int64
+		bucket = heartbeat_time.Unix() / (step * 60)
+
+		if previous == nil {
+			previous = current
+			anchor = current
+			anchor_bucket = bucket
+			continue
+		}
+
+		var is_reset bool
+		var point map[string]interface{}
+		_, is_reset, point = DeriveCounterRates(previous, current)
+		previous = current
+
+		if !is_reset && bucket == anchor_bucket {
+			continue
+		}
+
+		if is_reset {
+			point["elapsed"] = nil
+		} else {
+			var elapsed float64
+			elapsed, _, point = DeriveCounterRates(anchor, current)
+			point["elapsed"] = elapsed
+		}
+		point["is_reset"] = is_reset
+		point["heartbeat_time"] = heartbeat_time.Format("2006-01-02 15:04:05")
+
+		points = append(points, point)
+
+		anchor = current
+		anchor_bucket = bucket
+	}
+
+	return points
+}
+
+func Index(response http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		Api(response, 404)
+		return
+	}
+
+	var err error
+
+	var project string
+	var id string
+	var offset string
+	var limit string
+	var mode string
+
+	project = FormValueOf(request, "project")
+	id = FormValueOf(request, "id")
+	offset = FormValueOf(request, "offset")
+	limit = FormValueOf(request, "limit")
+	mode = FormValueOf(request, "mode")
+
+	if IsNotInt(id, offset, limit) {
+		Api(response, 400)
+		return
+	}
+
+	if IsNotSet(project) {
+		project = "default"
+	} else {
+		project = strings.ToLower(project)
+	}
+
+	var offset2 int64
+	if IsNotSet(offset) {
+		offset2 = 240
+	} else {
+		offset2, err = strconv.ParseInt(offset, 10, 64)
+		Skip(err)
+	}
+
+	var limit2 int64
+	if IsNotSet(limit) {
+		// 60 * 24 * 31
+		limit2 = 44640
+	} else {
+		limit2, err = strconv.ParseInt(limit, 10, 64)
+		Skip(err)
+		// if limit2 == -1 {
+		// 	// 1,000,000,000
+		// 	limit2 = 1000000000
+		// }
+	}
+
+	if mode != "1" {
+		mode = "0"
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var projects []map[string]interface{}
+	projects = SelectProjects(db)
+
+	var host map[string]interface{}
+	var hosts []map[string]interface{}
+
+	var id2 int64
+	if IsNotSet(id) {
+		hosts = SelectHosts(db, project)
+
+		if len(hosts) > 0 {
+			host = hosts[0]
+			id2 = host["id"].(int64)
+		}
+	} else {
+		id2, err = strconv.ParseInt(id, 10, 64)
+		Skip(err)
+
+		host = SelectHost(db, id2)
+		project = host["project"].(string)
+		hosts = SelectHosts(db, project)
+	}
+
+	// > interface conversion: interface {} is nil, not string
+	// host["code"] could be nil when there is no data
+	var code string
+	code = host["code"].(string)
+
+	var host_metric map[string]interface{}
+	host_metric = SelectHostMetric(db, project, code, offset2, limit2)
+
+	var watched_processes []map[string]interface{}
+	watched_processes = SelectHostWatchedProcesses(db, project, code)
+
+	var begin_time string
+	begin_time = time.Now().Add(-(time.Duration(offset2) * time.Minute)).Format("2006-01-02 15:04:05")
+
+	var ports []map[string]interface{}
+	ports = SelectHostPorts(db, project, code, begin_time)
+
+	var events []map[string]interface{}
+	events = SelectHostEvents(db, project, code, begin_time)
+
+	var state map[string]interface{}
+	state = map[string]interface{}{
+		"offset": offset2,
+		"mode":   mode,
+	}
+
+	var data struct {
+		Projects         []map[string]interface{}
+		Host             map[string]interface{}
+		Hosts            []map[string]interface{}
+		HostMetric       map[string]interface{}
+		WatchedProcesses []map[string]interface{}
+		Ports            []map[string]interface{}
+		Events           []map[string]interface{}
+		State            map[string]interface{}
+	}
+	data.Projects = projects
+	data.Host = host
+	data.Hosts = hosts
+	data.HostMetric = host_metric
+	data.WatchedProcesses = watched_processes
+	data.Ports = ports
+	data.Events = events
+	data.State = state
+
+	var HTML string
+	// Replace it when packaging static files into a single file
+	HTML = ""
 
 	var tpl *template.Template
 	if HTML == "" {
 		tpl, err = template.ParseFiles("template/index.html")
 		Skip(err)
 	} else {
-		tpl, err = template.New("X").Parse(HTML)
-		Skip(err)
+		tpl, err = template.New("X").Parse(HTML)
+		Skip(err)
+	}
+	tpl.Execute(response, data)
+}
+
+func ReportHost(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var body []byte
+	body, err = ReadBody(response, request)
+	if err == ERR_BODY_TOO_LARGE {
+		Api(response, 413)
+		return
+	}
+	log.Println(string(body))
+	Throw(err)
+
+	var data map[string]interface{}
+	json.Unmarshal(body, &data)
+
+	if len(data) == 0 {
+		Api(response, 400)
+		return
+	}
+
+	var code string
+	var legacy_code string
+	var hostname string
+	var ip string
+	var interfaces string
+	var labels string
+	var os_type string
+	var architecture string
+	var cpu_processors int64
+	var mem_size int64
+	var swap_size int64
+	var disk_size int64
+	var uptime float64
+	var heartbeat_time string
+	var project string
+	var version string
+
+	code = data["code"].(string)
+	legacy_code = StringValueOf(data, "legacy_code")
+	hostname = data["hostname"].(string)
+	ip = data["ip"].(string)
+	interfaces = StringValueOf(data, "interfaces")
+	labels = StringValueOf(data, "labels")
+	os_type = data["os_type"].(string)
+	architecture = data["architecture"].(string)
+	cpu_processors = int64(data["cpu_processors"].(float64))
+	mem_size = int64(data["mem_size"].(float64))
+	swap_size = int64(data["swap_size"].(float64))
+	disk_size = int64(data["disk_size"].(float64))
+	uptime = data["uptime"].(float64)
+	heartbeat_time = data["heartbeat_time"].(string)
+	project = data["project"].(string)
+	version = data["version"].(string)
+
+	project = strings.ToLower(project)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	// First report of an agent with the machine id, the history recorded with
+	// md5(hostname) goes along. Only if the old row stopped reporting before,
+	// as a clone with the same hostname may still report with an older
+	// lnxmoncli, which is left to /api/link_host.
+	if legacy_code != "" && legacy_code != code {
+		var count int64
+		err = db.QueryRow("SELECT COUNT(1) FROM t_host WHERE project=? AND code=?", project, code).Scan(&count)
+		Throw(err)
+
+		var legacy_count int64
+		err = db.QueryRow("SELECT COUNT(1) FROM t_host WHERE project=? AND code=? AND heartbeat_time<?", project, legacy_code, heartbeat_time).Scan(&legacy_count)
+		Throw(err)
+
+		if count == 0 && legacy_count > 0 {
+			UpdateHostCode(db, project, legacy_code, code)
+		}
+	}
+
+	var rows_affected int64
+
+	{
+		var query string
+		query = `
+			UPDATE t_host
+			SET
+				hostname=?, ip=?, os_type=?, architecture=?, cpu_processors=?,
+				mem_size=?, swap_size=?, disk_size=?, uptime=?, heartbeat_time=?, version=?,
+				interfaces=?, labels=?
+			WHERE project=? AND code=?
+		`
+
+		var result sql.Result
+		result, err = db.Exec(
+			query,
+			hostname, ip, os_type, architecture, cpu_processors,
+			mem_size, swap_size, disk_size, uptime, heartbeat_time, version,
+			interfaces, labels,
+			project, code,
+		)
+		Throw(err)
+
+		rows_affected, err = result.RowsAffected()
+		log.Println("rows_affected:", rows_affected)
+		Throw(err)
+	}
+
+	if rows_affected == 0 {
+		var query string
+		query = `
+			INSERT INTO t_host (
+				code, hostname, ip, os_type, architecture, cpu_processors,
+				mem_size, swap_size, disk_size, uptime, heartbeat_time, project, version,
+				interfaces, labels
+			) VALUES (
+				?,?,?,?,?,?,?,?,?,?,?,?,?,?,?
+			)
+		`
+
+		_, err = db.Exec(
+			query,
+			code, hostname, ip, os_type, architecture, cpu_processors,
+			mem_size, swap_size, disk_size, uptime, heartbeat_time, project, version,
+			interfaces, labels,
+		)
+		Throw(err)
+	}
+
+	Api(response, 200)
+}
+
+func ReportHostMetric(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var body []byte
+	body, err = ReadBody(response, request)
+	if err == ERR_BODY_TOO_LARGE {
+		Api(response, 413)
+		return
+	}
+	log.Println(string(body))
+	Throw(err)
+
+	var data map[string]interface{}
+	json.Unmarshal(body, &data)
+
+	if len(data) == 0 {
+		Api(response, 400)
+		return
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var tx *sql.Tx
+	tx, err = db.Begin()
+	defer tx.Rollback()
+	Throw(err)
+
+	InsertHostMetric(tx, data)
+
+	err = tx.Commit()
+	Throw(err)
+	log.Println("tx committed")
+
+	Api(response, 200)
+}
+
+// A batch of samples as a JSON array, e.g. the backlog of lnxmoncli, which is
+// inserted in a single transaction.
+func ReportHostMetrics(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var body []byte
+	body, err = ReadBody(response, request)
+	if err == ERR_BODY_TOO_LARGE {
+		Api(response, 413)
+		return
+	}
+	log.Println("body bytes:", len(body))
+	Throw(err)
+
+	var samples []map[string]interface{}
+	json.Unmarshal(body, &samples)
+
+	if len(samples) == 0 {
+		Api(response, 400)
+		return
+	}
+
+	// Created beforehand, since InitProject() cannot write while the
+	// transaction holds the lock
+	var projects map[string]bool
+	projects = make(map[string]bool)
+
+	var sample map[string]interface{}
+	for _, sample = range samples {
+		if len(sample) == 0 {
+			Api(response, 400)
+			return
+		}
+
+		var project string
+		project = strings.ToLower(StringValueOf(sample, "project"))
+
+		if !projects[project] {
+			InitProject(project)
+			projects[project] = true
+		}
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var tx *sql.Tx
+	tx, err = db.Begin()
+	defer tx.Rollback()
+	Throw(err)
+
+	for _, sample = range samples {
+		InsertHostMetric(tx, sample)
+	}
+
+	err = tx.Commit()
+	Throw(err)
+	log.Printf("tx committed, %d samples\n", len(samples))
+
+	Api(response, 200)
+}
+
+// Inserts a sample of lnxmoncli into t_host_metric_%s and the related tables
+func InsertHostMetric(tx *sql.Tx, data map[string]interface{}) {
+	var err error
+
+	var code string
+	var hostname string
+	var ip string
+	var loadavg_1m float64
+	var loadavg_5m float64
+	var loadavg_15m float64
+	var cpu_used float64
+	var cpu_iowait float64
+	var cpu_user float64
+	var cpu_nice float64
+	var cpu_system float64
+	var cpu_idle float64
+	var cpu_irq float64
+	var cpu_softirq float64
+	var cpu_steal float64
+	var cpu_guest float64
+	var cpu_guest_nice float64
+	var cpu_cores string
+	var psi_supported bool
+	var psi_cpu_some_avg10 float64
+	var psi_cpu_some_avg60 float64
+	var psi_cpu_some_total float64
+	var psi_cpu_full_avg10 float64
+	var psi_cpu_full_avg60 float64
+	var psi_cpu_full_total float64
+	var psi_memory_some_avg10 float64
+	var psi_memory_some_avg60 float64
+	var psi_memory_some_total float64
+	var psi_memory_full_avg10 float64
+	var psi_memory_full_avg60 float64
+	var psi_memory_full_total float64
+	var psi_io_some_avg10 float64
+	var psi_io_some_avg60 float64
+	var psi_io_some_total float64
+	var psi_io_full_avg10 float64
+	var psi_io_full_avg60 float64
+	var psi_io_full_total float64
+	var kernel_ctxt float64
+	var kernel_intr float64
+	var kernel_forks float64
+	var kernel_procs_running float64
+	var kernel_procs_blocked float64
+	var vm_pgpgin float64
+	var vm_pgpgout float64
+	var vm_pswpin float64
+	var vm_pswpout float64
+	var vm_pgmajfault float64
+	var vm_oom_kill float64
+	var mem_used float64
+	var swap_used float64
+	var mem_apps float64
+	var mem_hugepages_total float64
+	var mem_buffers float64
+	var mem_cached float64
+	var mem_shmem float64
+	var mem_slab float64
+	var mem_free float64
+	var mem_available float64
+	var mem_committed_as float64
+	var mem_slab_reclaimable float64
+	var mem_dirty float64
+	var mem_writeback float64
+	var mem_hugepages_used float64
+	var disk_usage string
+	var disk_used float64
+	var inode_used float64
+	var disk_read_rate float64
+	var disk_write_rate float64
+	var disk_ios float64
+	var nic_receive_rate float64
+	var nic_receive_packets float64
+	var nic_transmit_rate float64
+	var nic_transmit_packets float64
+	var tcp_sockets_inuse float64
+	var tcp_sockets_tw float64
+	var tcp_established float64
+	var tcp_syn_sent float64
+	var tcp_syn_recv float64
+	var tcp_fin_wait1 float64
+	var tcp_fin_wait2 float64
+	var tcp_time_wait float64
+	var tcp_close float64
+	var tcp_close_wait float64
+	var tcp_last_ack float64
+	var tcp_listen float64
+	var tcp_closing float64
+	var tcp_new_syn_recv float64
+	var users float64
+	var heartbeat_time string
+	var project string
+
+	code = data["code"].(string)
+	hostname = data["hostname"].(string)
+	ip = data["ip"].(string)
+	loadavg_1m = data["loadavg_1m"].(float64)
+	loadavg_5m = data["loadavg_5m"].(float64)
+	loadavg_15m = data["loadavg_15m"].(float64)
+	cpu_used = data["cpu_used"].(float64)
+	cpu_iowait = data["cpu_iowait"].(float64)
+	cpu_user = FloatValueOf(data, "cpu_user")
+	cpu_nice = FloatValueOf(data, "cpu_nice")
+	cpu_system = FloatValueOf(data, "cpu_system")
+	cpu_idle = FloatValueOf(data, "cpu_idle")
+	cpu_irq = FloatValueOf(data, "cpu_irq")
+	cpu_softirq = FloatValueOf(data, "cpu_softirq")
+	cpu_steal = FloatValueOf(data, "cpu_steal")
+	cpu_guest = FloatValueOf(data, "cpu_guest")
+	cpu_guest_nice = FloatValueOf(data, "cpu_guest_nice")
+	cpu_cores = StringValueOf(data, "cpu_cores")
+	psi_supported, _ = data["psi_supported"].(bool)
+	psi_cpu_some_avg10 = FloatValueOf(data, "psi_cpu_some_avg10")
+	psi_cpu_some_avg60 = FloatValueOf(data, "psi_cpu_some_avg60")
+	psi_cpu_some_total = FloatValueOf(data, "psi_cpu_some_total")
+	psi_cpu_full_avg10 = FloatValueOf(data, "psi_cpu_full_avg10")
+	psi_cpu_full_avg60 = FloatValueOf(data, "psi_cpu_full_avg60")
+	psi_cpu_full_total = FloatValueOf(data, "psi_cpu_full_total")
+	psi_memory_some_avg10 = FloatValueOf(data, "psi_memory_some_avg10")
+	psi_memory_some_avg60 = FloatValueOf(data, "psi_memory_some_avg60")
+	psi_memory_some_total = FloatValueOf(data, "psi_memory_some_total")
+	psi_memory_full_avg10 = FloatValueOf(data, "psi_memory_full_avg10")
+	psi_memory_full_avg60 = FloatValueOf(data, "psi_memory_full_avg60")
+	psi_memory_full_total = FloatValueOf(data, "psi_memory_full_total")
+	psi_io_some_avg10 = FloatValueOf(data, "psi_io_some_avg10")
+	psi_io_some_avg60 = FloatValueOf(data, "psi_io_some_avg60")
+	psi_io_some_total = FloatValueOf(data, "psi_io_some_total")
+	psi_io_full_avg10 = FloatValueOf(data, "psi_io_full_avg10")
+	psi_io_full_avg60 = FloatValueOf(data, "psi_io_full_avg60")
+	psi_io_full_total = FloatValueOf(data, "psi_io_full_total")
+	kernel_ctxt = FloatValueOf(data, "kernel_ctxt")
+	kernel_intr = FloatValueOf(data, "kernel_intr")
+	kernel_forks = FloatValueOf(data, "kernel_forks")
+	kernel_procs_running = FloatValueOf(data, "kernel_procs_running")
+	kernel_procs_blocked = FloatValueOf(data, "kernel_procs_blocked")
+	vm_pgpgin = FloatValueOf(data, "vm_pgpgin")
+	vm_pgpgout = FloatValueOf(data, "vm_pgpgout")
+	vm_pswpin = FloatValueOf(data, "vm_pswpin")
+	vm_pswpout = FloatValueOf(data, "vm_pswpout")
+	vm_pgmajfault = FloatValueOf(data, "vm_pgmajfault")
+	vm_oom_kill = FloatValueOf(data, "vm_oom_kill")
+	mem_used = data["mem_used"].(float64)
+	swap_used = data["swap_used"].(float64)
+	mem_apps = FloatValueOf(data, "mem_apps")
+	mem_hugepages_total = FloatValueOf(data, "mem_hugepages_total")
+	mem_buffers = FloatValueOf(data, "mem_buffers")
+	mem_cached = FloatValueOf(data, "mem_cached")
+	mem_shmem = FloatValueOf(data, "mem_shmem")
+	mem_slab = FloatValueOf(data, "mem_slab")
+	mem_free = FloatValueOf(data, "mem_free")
+	mem_available = FloatValueOf(data, "mem_available")
+	mem_committed_as = FloatValueOf(data, "mem_committed_as")
+	mem_slab_reclaimable = FloatValueOf(data, "mem_slab_reclaimable")
+	mem_dirty = FloatValueOf(data, "mem_dirty")
+	mem_writeback = FloatValueOf(data, "mem_writeback")
+	mem_hugepages_used = FloatValueOf(data, "mem_hugepages_used")
+	disk_usage = data["disk_usage"].(string)
+	disk_used = data["disk_used"].(float64)
+	inode_used = data["inode_used"].(float64)
+	disk_read_rate = data["disk_read_rate"].(float64)
+	disk_write_rate = data["disk_write_rate"].(float64)
+	disk_ios = data["disk_ios"].(float64)
+	nic_receive_rate = data["nic_receive_rate"].(float64)
+	nic_receive_packets = data["nic_receive_packets"].(float64)
+	nic_transmit_rate = data["nic_transmit_rate"].(float64)
+	nic_transmit_packets = data["nic_transmit_packets"].(float64)
+	tcp_sockets_inuse = data["tcp_sockets_inuse"].(float64)
+	tcp_sockets_tw = data["tcp_sockets_tw"].(float64)
+	tcp_established = FloatValueOf(data, "tcp_established")
+	tcp_syn_sent = FloatValueOf(data, "tcp_syn_sent")
+	tcp_syn_recv = FloatValueOf(data, "tcp_syn_recv")
+	tcp_fin_wait1 = FloatValueOf(data, "tcp_fin_wait1")
+	tcp_fin_wait2 = FloatValueOf(data, "tcp_fin_wait2")
+	tcp_time_wait = FloatValueOf(data, "tcp_time_wait")
+	tcp_close = FloatValueOf(data, "tcp_close")
+	tcp_close_wait = FloatValueOf(data, "tcp_close_wait")
+	tcp_last_ack = FloatValueOf(data, "tcp_last_ack")
+	tcp_listen = FloatValueOf(data, "tcp_listen")
+	tcp_closing = FloatValueOf(data, "tcp_closing")
+	tcp_new_syn_recv = FloatValueOf(data, "tcp_new_syn_recv")
+	users = data["users"].(float64)
+	heartbeat_time = data["heartbeat_time"].(string)
+	project = data["project"].(string)
+
+	project = strings.ToLower(project)
+
+	var last_insert_id int64
+
+	{
+		var query string
+		query = `
+			INSERT INTO t_host_metric_%s (
+				code,
+				hostname,
+				ip,
+				loadavg_1m, loadavg_5m, loadavg_15m,
+				cpu_used, cpu_iowait,
+				cpu_user, cpu_nice, cpu_system, cpu_idle, cpu_irq, cpu_softirq, cpu_steal, cpu_guest, cpu_guest_nice,
+				cpu_cores,
+				psi_supported,
+				psi_cpu_some_avg10, psi_cpu_some_avg60, psi_cpu_some_total, psi_cpu_full_avg10, psi_cpu_full_avg60, psi_cpu_full_total,
+				psi_memory_some_avg10, psi_memory_some_avg60, psi_memory_some_total, psi_memory_full_avg10, psi_memory_full_avg60, psi_memory_full_total,
+				psi_io_some_avg10, psi_io_some_avg60, psi_io_some_total, psi_io_full_avg10, psi_io_full_avg60, psi_io_full_total,
+				kernel_ctxt, kernel_intr, kernel_forks, kernel_procs_running, kernel_procs_blocked,
+				vm_pgpgin, vm_pgpgout, vm_pswpin, vm_pswpout, vm_pgmajfault, vm_oom_kill,
+				mem_used, swap_used,
+				mem_apps, mem_hugepages_total, mem_buffers, mem_cached, mem_shmem, mem_slab, mem_free,
+				mem_available, mem_committed_as, mem_slab_reclaimable, mem_dirty, mem_writeback, mem_hugepages_used,
+				disk_usage, disk_used, inode_used,
+				disk_read_rate, disk_write_rate, disk_ios,
+				nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets,
+				tcp_sockets_inuse, tcp_sockets_tw,
+				tcp_established, tcp_syn_sent, tcp_syn_recv, tcp_fin_wait1, tcp_fin_wait2, tcp_time_wait,
+				tcp_close, tcp_close_wait, tcp_last_ack, tcp_listen, tcp_closing, tcp_new_syn_recv,
+				users,
+				heartbeat_time
+			) VALUES (
+				?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,
+				?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,
+				?,?,?,?,?,?,?,?,?,?,?,?,
+				?,?,?,?,?,?,?,?,?,?,?,
+				?,?,?,?,?,?,?,?,?,?,?,?,?
+			)
+		`
+		query = fmt.Sprintf(query, project)
+
+		var stmt *sql.Stmt
+		stmt, err = tx.Prepare(query)
+		defer stmt.Close()
+		if err != nil {
+			Skip(err)
+			log.Println(err.Error())
+			if strings.Contains(err.Error(), "no such table") || strings.Contains(err.Error(), "has no column named") {
+				InitProject(project)
+			}
+			stmt, err = tx.Prepare(query)
+			Throw(err)
+		}
+
+		var result sql.Result
+		result, err = stmt.Exec(
+			code,
+			hostname,
+			ip,
+			loadavg_1m, loadavg_5m, loadavg_15m,
+			cpu_used, cpu_iowait,
+			cpu_user, cpu_nice, cpu_system, cpu_idle, cpu_irq, cpu_softirq, cpu_steal, cpu_guest, cpu_guest_nice,
+			cpu_cores,
+			psi_supported,
+			psi_cpu_some_avg10, psi_cpu_some_avg60, psi_cpu_some_total, psi_cpu_full_avg10, psi_cpu_full_avg60, psi_cpu_full_total,
+			psi_memory_some_avg10, psi_memory_some_avg60, psi_memory_some_total, psi_memory_full_avg10, psi_memory_full_avg60, psi_memory_full_total,
+			psi_io_some_avg10, psi_io_some_avg60, psi_io_some_total, psi_io_full_avg10, psi_io_full_avg60, psi_io_full_total,
+			kernel_ctxt, kernel_intr, kernel_forks, kernel_procs_running, kernel_procs_blocked,
+			vm_pgpgin, vm_pgpgout, vm_pswpin, vm_pswpout, vm_pgmajfault, vm_oom_kill,
+			mem_used, swap_used,
+			mem_apps, mem_hugepages_total, mem_buffers, mem_cached, mem_shmem, mem_slab, mem_free,
+			mem_available, mem_committed_as, mem_slab_reclaimable, mem_dirty, mem_writeback, mem_hugepages_used,
+			disk_usage, disk_used, inode_used,
+			disk_read_rate, disk_write_rate, disk_ios,
+			nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets,
+			tcp_sockets_inuse, tcp_sockets_tw,
+			tcp_established, tcp_syn_sent, tcp_syn_recv, tcp_fin_wait1, tcp_fin_wait2, tcp_time_wait,
+			tcp_close, tcp_close_wait, tcp_last_ack, tcp_listen, tcp_closing, tcp_new_syn_recv,
+			users,
+			heartbeat_time,
+		)
+		Throw(err)
+
+		last_insert_id, err = result.LastInsertId()
+		log.Println("last_insert_id:", last_insert_id)
+		Throw(err)
+	}
+
+	{
+		var query string
+		query = "UPDATE t_host SET host_metric_id=?, heartbeat_time=?, errors=? WHERE project=? AND code=?"
+		_, err = tx.Exec(query, last_insert_id, heartbeat_time, FormatCollectorErrors(data["errors"]), project, code)
+		Throw(err)
+	}
+
+	InsertHostDeviceMetric(
+		tx,
+		fmt.Sprintf("t_host_nic_%s", project),
+		code,
+		heartbeat_time,
+		[]string{
+			"receive_rate", "receive_packets", "receive_errs", "receive_drop",
+			"transmit_rate", "transmit_packets", "transmit_errs", "transmit_drop",
+		},
+		data["nics"],
+	)
+
+	InsertHostDeviceMetric(
+		tx,
+		fmt.Sprintf("t_host_disk_%s", project),
+		code,
+		heartbeat_time,
+		[]string{
+			"read_iops", "write_iops", "read_rate", "write_rate",
+			"read_await", "write_await", "util",
+		},
+		data["disks"],
+	)
+
+	InsertHostDeviceMetric(
+		tx,
+		fmt.Sprintf("t_host_cgroup_%s", project),
+		code,
+		heartbeat_time,
+		[]string{
+			"cpu_used", "cpu_throttled", "cpu_throttled_time",
+			"mem_current", "mem_max",
+			"io_read_rate", "io_write_rate", "io_read_iops", "io_write_iops",
+		},
+		data["cgroups"],
+	)
+
+	InsertHostDeviceMetric(
+		tx,
+		fmt.Sprintf("t_host_metric_agg_%s", project),
+		code,
+		heartbeat_time,
+		[]string{"min_value", "max_value", "avg_value", "last_value"},
+		data["aggregates"],
+	)
+
+	InsertHostCounter(tx, project, code, heartbeat_time, data["counters"])
+
+	InsertHostCustomMetric(tx, project, code, heartbeat_time, data["custom_metrics"])
+
+	InsertHostEvent(tx, project, code, heartbeat_time, data["log_events"])
+
+	// Reported by an older lnxmoncli if not present
+	var processes []interface{}
+	processes, _ = data["processes"].([]interface{})
+
+	if len(processes) > 0 {
+		var query string
+		query = `
+			INSERT INTO t_host_process_%s (
+				code,
+				pid, name, cmdline,
+				cpu_used, mem_rss, threads,
+				heartbeat_time
+			) VALUES (
+				?,?,?,?,?,?,?,?
+			)
+		`
+		query = fmt.Sprintf(query, project)
+
+		var stmt *sql.Stmt
+		stmt, err = tx.Prepare(query)
+		Throw(err)
+		defer stmt.Close()
+
+		var value interface{}
+		for _, value = range processes {
+			var process map[string]interface{}
+			process, _ = value.(map[string]interface{})
+
+			_, err = stmt.Exec(
+				code,
+				int64(FloatValueOf(process, "pid")),
+				StringValueOf(process, "name"),
+				StringValueOf(process, "cmdline"),
+				FloatValueOf(process, "cpu_used"),
+				FloatValueOf(process, "mem_rss"),
+				int64(FloatValueOf(process, "threads")),
+				heartbeat_time,
+			)
+			Throw(err)
+		}
+	}
+
+	// Reported by an older lnxmoncli if not present
+	var watched_processes []interface{}
+	watched_processes, _ = data["watched_processes"].([]interface{})
+
+	if len(watched_processes) > 0 {
+		var query string
+		query = `
+			INSERT INTO t_host_watch_%s (
+				code,
+				name, type, pattern,
+				count, cpu_used, mem_rss, threads, fds, start_time,
+				heartbeat_time
+			) VALUES (
+				?,?,?,?,?,?,?,?,?,?,?
+			)
+		`
+		query = fmt.Sprintf(query, project)
+
+		var stmt *sql.Stmt
+		stmt, err = tx.Prepare(query)
+		Throw(err)
+		defer stmt.Close()
+
+		var value interface{}
+		for _, value = range watched_processes {
+			var watched_process map[string]interface{}
+			watched_process, _ = value.(map[string]interface{})
+
+			_, err = stmt.Exec(
+				code,
+				StringValueOf(watched_process, "name"),
+				StringValueOf(watched_process, "type"),
+				StringValueOf(watched_process, "pattern"),
+				int64(FloatValueOf(watched_process, "count")),
+				FloatValueOf(watched_process, "cpu_used"),
+				FloatValueOf(watched_process, "mem_rss"),
+				int64(FloatValueOf(watched_process, "threads")),
+				int64(FloatValueOf(watched_process, "fds")),
+				StringValueOf(watched_process, "start_time"),
+				heartbeat_time,
+			)
+			Throw(err)
+		}
+	}
+
+	// Reported by an older lnxmoncli if not present
+	var listening_ports []interface{}
+	var ok bool
+	listening_ports, ok = data["listening_ports"].([]interface{})
+
+	if ok {
+		var query string
+		query = "UPDATE t_host_port_%s SET pid=?, name=?, last_seen=? WHERE code=? AND protocol=? AND ip=? AND port=?"
+		query = fmt.Sprintf(query, project)
+
+		var query2 string
+		query2 = `
+			INSERT INTO t_host_port_%s (
+				code,
+				protocol, ip, port,
+				pid, name,
+				first_seen, last_seen
+			) VALUES (
+				?,?,?,?,?,?,?,?
+			)
+		`
+		query2 = fmt.Sprintf(query2, project)
+
+		var value interface{}
+		for _, value = range listening_ports {
+			var listening_port map[string]interface{}
+			listening_port, _ = value.(map[string]interface{})
+
+			var protocol string
+			var ip string
+			var port int64
+			var pid int64
+			var name string
+
+			protocol = StringValueOf(listening_port, "protocol")
+			ip = StringValueOf(listening_port, "ip")
+			port = int64(FloatValueOf(listening_port, "port"))
+			pid = int64(FloatValueOf(listening_port, "pid"))
+			name = StringValueOf(listening_port, "name")
+
+			var result sql.Result
+			result, err = tx.Exec(query, pid, name, heartbeat_time, code, protocol, ip, port)
+			Throw(err)
+
+			var rows_affected int64
+			rows_affected, err = result.RowsAffected()
+			Throw(err)
+
+			if rows_affected == 0 {
+				_, err = tx.Exec(query2, code, protocol, ip, port, pid, name, heartbeat_time, heartbeat_time)
+				Throw(err)
+			}
+		}
+	}
+}
+
+// The collectors which failed in a sample, one per line, e.g.
+// users: open /var/run/utmp: no such file or directory. Empty if reported by
+// an older lnxmoncli.
+func FormatCollectorErrors(collector_errors interface{}) string {
+	var collector_errors2 map[string]interface{}
+	collector_errors2, _ = collector_errors.(map[string]interface{})
+
+	var lines []string
+	var name string
+	for name = range collector_errors2 {
+		// One line per collector, which SelectHosts() counts, although a
+		// panic or the output of a custom script spans several
+		var message string
+		message = strings.Join(strings.Fields(StringValueOf(collector_errors2, name)), " ")
+		lines = append(lines, fmt.Sprintf("%s: %s", name, message))
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n")
+}
+
+// Inserts the per-device metrics, e.g. data["nics"], into a table such as
+// t_host_nic_%s. Nothing is inserted if reported by an older lnxmoncli.
+func InsertHostDeviceMetric(tx *sql.Tx, table string, code string, heartbeat_time string, columns []string, devices interface{}) {
+	var err error
+
+	var devices2 []interface{}
+	devices2, _ = devices.([]interface{})
+
+	if len(devices2) == 0 {
+		return
+	}
+
+	var query string
+	query = `
+		INSERT INTO %s (
+			code,
+			name,
+			%s,
+			heartbeat_time
+		) VALUES (
+			?,?,%s?
+		)
+	`
+	query = fmt.Sprintf(query, table, strings.Join(columns, ", "), strings.Repeat("?,", len(columns)))
+
+	var stmt *sql.Stmt
+	stmt, err = tx.Prepare(query)
+	Throw(err)
+	defer stmt.Close()
+
+	var value interface{}
+	for _, value = range devices2 {
+		var device map[string]interface{}
+		device, _ = value.(map[string]interface{})
+
+		var args []interface{}
+		args = []interface{}{code, StringValueOf(device, "name")}
+
+		var column string
+		for _, column = range columns {
+			args = append(args, FloatValueOf(device, column))
+		}
+
+		args = append(args, heartbeat_time)
+
+		_, err = stmt.Exec(args...)
+		Throw(err)
+	}
+}
+
+// Inserts the custom metrics of the scripts and the textfile directory of
+// lnxmoncli, each of which is a name, its labels and a value. Nothing is
+// inserted if reported by an older lnxmoncli.
+func InsertHostCustomMetric(tx *sql.Tx, project string, code string, heartbeat_time string, custom_metrics interface{}) {
+	var err error
+
+	var custom_metrics2 []interface{}
+	custom_metrics2, _ = custom_metrics.([]interface{})
+
+	if len(custom_metrics2) == 0 {
+		return
+	}
+
+	var query string
+	query = "INSERT INTO t_host_custom_%s (code, name, labels, value, heartbeat_time) VALUES (?,?,?,?,?)"
+	query = fmt.Sprintf(query, project)
+
+	var stmt *sql.Stmt
+	stmt, err = tx.Prepare(query)
+	Throw(err)
+	defer stmt.Close()
+
+	var value interface{}
+	for _, value = range custom_metrics2 {
+		var custom_metric map[string]interface{}
+		custom_metric, _ = value.(map[string]interface{})
+
+		var name string
+		name = StringValueOf(custom_metric, "name")
+		if name == "" {
+			continue
+		}
+
+		_, err = stmt.Exec(code, name, StringValueOf(custom_metric, "labels"), FloatValueOf(custom_metric, "value"), heartbeat_time)
+		Throw(err)
+	}
+}
+
+// Inserts the lines of the log files matching a --log-watch of lnxmoncli,
+// which are kept with --log-samples. Nothing is inserted if reported by an
+// older lnxmoncli.
+func InsertHostEvent(tx *sql.Tx, project string, code string, heartbeat_time string, log_events interface{}) {
+	var err error
+
+	var log_events2 []interface{}
+	log_events2, _ = log_events.([]interface{})
+
+	if len(log_events2) == 0 {
+		return
+	}
+
+	var query string
+	query = "INSERT INTO t_host_event_%s (code, name, path, line, heartbeat_time) VALUES (?,?,?,?,?)"
+	query = fmt.Sprintf(query, project)
+
+	var stmt *sql.Stmt
+	stmt, err = tx.Prepare(query)
+	Throw(err)
+	defer stmt.Close()
+
+	var value interface{}
+	for _, value = range log_events2 {
+		var log_event map[string]interface{}
+		log_event, _ = value.(map[string]interface{})
+
+		var name string
+		name = StringValueOf(log_event, "name")
+		if name == "" {
+			continue
+		}
+
+		_, err = stmt.Exec(code, name, StringValueOf(log_event, "path"), StringValueOf(log_event, "line"), heartbeat_time)
+		Throw(err)
+	}
+}
+
+// The cumulative counters reported with --raw-counters, see GetCounters() of
+// lnxmoncli
+var COUNTER_COLUMNS = []string{
+	"boot_time", "uptime", "devices",
+	"cpu_jiffies", "cpu_used_jiffies", "cpu_idle_jiffies", "cpu_iowait_jiffies", "cpu_steal_jiffies",
+	"disk_reads", "disk_read_sectors", "disk_writes", "disk_write_sectors",
+	"nic_receive_bytes", "nic_receive_packets", "nic_transmit_bytes", "nic_transmit_packets",
+}
+
+// The rates derived from the counters, named as in t_host_metric_%s, except
+// for the packets whose names are taken by the counters
+var COUNTER_RATE_COLUMNS = []string{
+	"cpu_used", "cpu_iowait", "cpu_steal",
+	"disk_read_rate", "disk_write_rate", "disk_ios",
+	"nic_receive_rate", "nic_receive_packets_rate", "nic_transmit_rate", "nic_transmit_packets_rate",
+}
+
+// Columns added after the first release of t_host_counter_%s, see UpgradeTable()
+var HOST_COUNTER_COLUMNS = []string{
+	"devices INTEGER NOT NULL DEFAULT 0",
+}
+
+// The boot time is derived from the wall clock, so it moves by a second or so
+// when the clock is adjusted
+const BOOT_TIME_TOLERANCE = 60
+
+// Returns nil instead of a rate if the counter went backwards, e.g. a 32-bit
+// counter of a NIC which wrapped around, or a device which was replaced.
+func CalculateCounterRate(delta float64, divisor float64) interface{} {
+	if delta < 0 || divisor <= 0 {
+		return nil
+	}
+
+	return math.Round(delta/divisor*100) / 100
+}
+
+// Derives the rates between two samples of the counters, the elapsed time is
+// the difference of the uptimes, which is not affected by the wall clock. The
+// counters are reset if the host has rebooted in between, or if the devices
+// summed up have changed, in which case there is no rate at all.
+func DeriveCounterRates(counters map[string]float64, counters2 map[string]float64) (float64, bool, map[string]interface{}) {
+	var rates map[string]interface{}
+	rates = make(map[string]interface{})
+
+	var column string
+	for _, column = range COUNTER_RATE_COLUMNS {
+		rates[column] = nil
+	}
+
+	var elapsed float64
+	elapsed = counters2["uptime"] - counters["uptime"]
+
+	if elapsed <= 0 || math.Abs(counters2["boot_time"]-counters["boot_time"]) > BOOT_TIME_TOLERANCE || counters2["devices"] != counters["devices"] {
+		return 0, true, rates
+	}
+
+	var deltas map[string]float64
+	deltas = make(map[string]float64)
+	for _, column = range COUNTER_COLUMNS {
+		deltas[column] = counters2[column] - counters[column]
+	}
+
+	if deltas["cpu_jiffies"] >= 0 {
+		rates["cpu_used"] = CalculateCounterRate(deltas["cpu_used_jiffies"]*100, deltas["cpu_jiffies"])
+		rates["cpu_iowait"] = CalculateCounterRate(deltas["cpu_iowait_jiffies"]*100, deltas["cpu_jiffies"])
+		rates["cpu_steal"] = CalculateCounterRate(deltas["cpu_steal_jiffies"]*100, deltas["cpu_jiffies"])
+	}
+
+	// KiB/s, a sector is 512 bytes
+	rates["disk_read_rate"] = CalculateCounterRate(deltas["disk_read_sectors"]*512, elapsed*1024)
+	rates["disk_write_rate"] = CalculateCounterRate(deltas["disk_write_sectors"]*512, elapsed*1024)
+	if deltas["disk_reads"] >= 0 && deltas["disk_writes"] >= 0 {
+		rates["disk_ios"] = CalculateCounterRate(deltas["disk_reads"]+deltas["disk_writes"], elapsed)
+	}
+
+	// KiB/s
+	rates["nic_receive_rate"] = CalculateCounterRate(deltas["nic_receive_bytes"], elapsed*1024)
+	rates["nic_receive_packets_rate"] = CalculateCounterRate(deltas["nic_receive_packets"], elapsed)
+	rates["nic_transmit_rate"] = CalculateCounterRate(deltas["nic_transmit_bytes"], elapsed*1024)
+	rates["nic_transmit_packets_rate"] = CalculateCounterRate(deltas["nic_transmit_packets"], elapsed)
+
+	return math.Round(elapsed*100) / 100, false, rates
+}
+
+// Stores the counters along with the rates since the previous sample of the
+// host. Samples arrive in order, also from the spool of lnxmoncli, so the
+// previous one is already in the table, or earlier in the same transaction.
+// Nothing is inserted if reported without --raw-counters.
+func InsertHostCounter(tx *sql.Tx, project string, code string, heartbeat_time string, counters interface{}) {
+	var err error
+
+	var counters2 map[string]interface{}
+	var ok bool
+	counters2, ok = counters.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	var current map[string]float64
+	current = make(map[string]float64)
+
+	var column string
+	for _, column = range COUNTER_COLUMNS {
+		current[column] = FloatValueOf(counters2, column)
+	}
+
+	var query string
+	query = "SELECT %s FROM t_host_counter_%s WHERE code=? AND heartbeat_time<? ORDER BY heartbeat_time DESC LIMIT 1"
+	query = fmt.Sprintf(query, strings.Join(COUNTER_COLUMNS, ", "), project)
+
+	var values []float64
+	values = make([]float64, len(COUNTER_COLUMNS))
+
+	var dest []interface{}
+	var i int
+	for i = range values {
+		dest = append(dest, &values[i])
+	}
+
+	var elapsed interface{}
+	var is_reset bool
+	var rates map[string]interface{}
+
+	err = tx.QueryRow(query, code, heartbeat_time).Scan(dest...)
+	if err == sql.ErrNoRows {
+		// The first sample of the host
+		rates = make(map[string]interface{})
+	} else {
+		Throw(err)
+
+		var previous map[string]float64
+		previous = make(map[string]float64)
+		for i = range COUNTER_COLUMNS {
+			previous[COUNTER_COLUMNS[i]] = values[i]
+		}
+
+		var elapsed2 float64
+		elapsed2, is_reset, rates = DeriveCounterRates(previous, current)
+		if !is_reset {
+			elapsed = elapsed2
+		}
+	}
+
+	var query2 string
+	query2 = `
+		INSERT INTO t_host_counter_%s (
+			code,
+			%s,
+			elapsed, is_reset,
+			%s,
+			heartbeat_time
+		) VALUES (
+			?,%s?,?,%s?
+		)
+	`
+	query2 = fmt.Sprintf(
+		query2,
+		project,
+		strings.Join(COUNTER_COLUMNS, ", "),
+		strings.Join(COUNTER_RATE_COLUMNS, ", "),
+		strings.Repeat("?,", len(COUNTER_COLUMNS)),
+		strings.Repeat("?,", len(COUNTER_RATE_COLUMNS)),
+	)
+
+	var args []interface{}
+	args = []interface{}{code}
+	for _, column = range COUNTER_COLUMNS {
+		args = append(args, current[column])
+	}
+	args = append(args, elapsed, is_reset)
+	for _, column = range COUNTER_RATE_COLUMNS {
+		args = append(args, rates[column])
+	}
+	args = append(args, heartbeat_time)
+
+	_, err = tx.Exec(query2, args...)
+	Throw(err)
+
+	if is_reset {
+		log.Printf("counters of %s reset at %s\n", code, heartbeat_time)
+	}
+}
+
+// Links the history of a host to its new code, e.g. after a reinstall which
+// changed /etc/machine-id.
+func LinkHost(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var project string
+	var old_code string
+	var new_code string
+
+	project = FormValueOf(request, "project")
+	old_code = FormValueOf(request, "old_code")
+	new_code = FormValueOf(request, "new_code")
+
+	if IsNotSet(project, old_code, new_code) || old_code == "" || new_code == "" || old_code == new_code {
+		Api(response, 400)
+		return
+	}
+
+	project = strings.ToLower(project)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	if !UpdateHostCode(db, project, old_code, new_code) {
+		Api(response, 404)
+		return
+	}
+
+	Api(response, 200)
+}
+
+// Per-project tables of the history of a host, see UpdateHostCode()
+var HOST_HISTORY_TABLES = []string{
+	"t_host_metric_%s",
+	"t_host_metric_agg_%s",
+	"t_host_counter_%s",
+	"t_host_custom_%s",
+	"t_host_event_%s",
+	"t_host_nic_%s",
+	"t_host_disk_%s",
+	"t_host_cgroup_%s",
+	"t_host_process_%s",
+	"t_host_watch_%s",
+}
+
+// Moves the host and its history from old_code to new_code. If the host has
+// already reported with new_code, that row is kept and only the alias of the
+// old one is carried over. Returns false if old_code is unknown.
+func UpdateHostCode(db *sql.DB, project string, old_code string, new_code string) bool {
+	var err error
+
+	var count int64
+	err = db.QueryRow("SELECT COUNT(1) FROM t_host WHERE project=? AND code=?", project, old_code).Scan(&count)
+	Throw(err)
+
+	if count == 0 {
+		return false
+	}
+
+	var tx *sql.Tx
+	tx, err = db.Begin()
+	defer tx.Rollback()
+	Throw(err)
+
+	var table string
+	for _, table = range HOST_HISTORY_TABLES {
+		var query string
+		query = "UPDATE %s SET code=? WHERE code=?"
+		query = fmt.Sprintf(query, fmt.Sprintf(table, project))
+		_, err = tx.Exec(query, new_code, old_code)
+		Throw(err)
+	}
+
+	// Unique by port, the ones seen with both codes keep the earliest first_seen
+	{
+		var query string
+		query = `
+			UPDATE t_host_port_%[1]s
+			SET first_seen=MIN(first_seen, COALESCE((
+				SELECT old.first_seen FROM t_host_port_%[1]s AS old
+				WHERE old.code=? AND old.protocol=t_host_port_%[1]s.protocol AND old.ip=t_host_port_%[1]s.ip AND old.port=t_host_port_%[1]s.port
+			), first_seen))
+			WHERE code=?
+		`
+		query = fmt.Sprintf(query, project)
+		_, err = tx.Exec(query, old_code, new_code)
+		Throw(err)
+
+		query = "UPDATE OR IGNORE t_host_port_%s SET code=? WHERE code=?"
+		query = fmt.Sprintf(query, project)
+		_, err = tx.Exec(query, new_code, old_code)
+		Throw(err)
+
+		query = "DELETE FROM t_host_port_%s WHERE code=?"
+		query = fmt.Sprintf(query, project)
+		_, err = tx.Exec(query, old_code)
+		Throw(err)
+	}
+
+	{
+		var count2 int64
+		err = tx.QueryRow("SELECT COUNT(1) FROM t_host WHERE project=? AND code=?", project, new_code).Scan(&count2)
+		Throw(err)
+
+		if count2 == 0 {
+			_, err = tx.Exec("UPDATE t_host SET code=? WHERE project=? AND code=?", new_code, project, old_code)
+			Throw(err)
+		} else {
+			var query string
+			query = `
+				UPDATE t_host
+				SET alias=(SELECT alias FROM t_host WHERE project=? AND code=?)
+				WHERE project=? AND code=? AND alias IS NULL
+			`
+			_, err = tx.Exec(query, project, old_code, project, new_code)
+			Throw(err)
+
+			_, err = tx.Exec("DELETE FROM t_host WHERE project=? AND code=?", project, old_code)
+			Throw(err)
+		}
+	}
+
+	err = tx.Commit()
+	Throw(err)
+
+	log.Printf("linked host %v to %v in project %v\n", old_code, new_code, project)
+
+	return true
+}
+
+func GetProjects(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var projects []map[string]interface{}
+	projects = SelectProjects(db)
+
+	Api(response, 200, projects)
+}
+
+func GetHosts(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var project string
+	project = FormValueOf(request, "project")
+
+	if IsNotSet(project) {
+		project = "default"
+	} else {
+		project = strings.ToLower(project)
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var hosts []map[string]interface{}
+	hosts = SelectHosts(db, project)
+
+	Api(response, 200, hosts)
+}
+
+func GetHost(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var id string
+	id = FormValueOf(request, "id")
+
+	if IsNotSet(id) || IsNotInt(id) {
+		Api(response, 400)
+		return
+	}
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	Skip(err)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var host map[string]interface{}
+	host = SelectHost(db, id2)
+
+	Api(response, 200, host)
+}
+
+func GetHostMetric(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var id string
+	var offset string
+	var limit string
+
+	id = FormValueOf(request, "id")
+	offset = FormValueOf(request, "offset")
+	limit = FormValueOf(request, "limit")
+
+	if IsNotSet(id) || IsNotInt(id, offset, limit) {
+		Api(response, 400)
+		return
+	}
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	Skip(err)
+
+	var offset2 int64
+	if IsNotSet(offset) {
+		offset2 = 240
+	} else {
+		offset2, err = strconv.ParseInt(offset, 10, 64)
+		Skip(err)
+	}
+
+	var limit2 int64
+	if IsNotSet(limit) {
+		// 60 * 24 * 31
+		limit2 = 44640
+	} else {
+		limit2, err = strconv.ParseInt(limit, 10, 64)
+		Skip(err)
+		// if limit2 == -1 {
+		// 	// 1,000,000,000
+		// 	limit2 = 1000000000
+		// }
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var host map[string]interface{}
+	host = SelectHost(db, id2)
+
+	var host_metric map[string]interface{}
+	host_metric = SelectHostMetric(db, host["project"].(string), host["code"].(string), offset2, limit2)
+
+	Api(response, 200, host_metric)
+}
+
+func GetHostProcesses(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var id string
+	var heartbeat_time string
+
+	id = FormValueOf(request, "id")
+	heartbeat_time = FormValueOf(request, "time")
+
+	if IsNotSet(id) || IsNotInt(id) {
+		Api(response, 400)
+		return
+	}
+
+	if IsNotSet(heartbeat_time) {
+		heartbeat_time = time.Now().Format("2006-01-02 15:04:05")
+	} else {
+		_, err = time.Parse("2006-01-02 15:04:05", heartbeat_time)
+		if err != nil {
+			Api(response, 400)
+			return
+		}
+	}
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	Skip(err)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var host map[string]interface{}
+	host = SelectHost(db, id2)
+
+	var processes []map[string]interface{}
+	processes = SelectHostProcesses(db, host["project"].(string), host["code"].(string), heartbeat_time)
+
+	Api(response, 200, processes)
+}
+
+func GetHostCounters(response http.ResponseWriter, request *http.Request) {
+	var err error
+
+	var id string
+	var offset string
+	var limit string
+	var step string
+
+	id = FormValueOf(request, "id")
+	offset = FormValueOf(request, "offset")
+	limit = FormValueOf(request, "limit")
+	step = FormValueOf(request, "step")
+
+	if IsNotSet(id) || IsNotInt(id, offset, limit, step) {
+		Api(response, 400)
+		return
+	}
+
+	var id2 int64
+	id2, err = strconv.ParseInt(id, 10, 64)
+	Skip(err)
+
+	var offset2 int64
+	if IsNotSet(offset) {
+		offset2 = 240
+	} else {
+		offset2, err = strconv.ParseInt(offset, 10, 64)
+		Skip(err)
+	}
+
+	var limit2 int64
+	if IsNotSet(limit) {
+		// 60 * 24 * 31
+		limit2 = 44640
+	} else {
+		limit2, err = strconv.ParseInt(limit, 10, 64)
+		Skip(err)
+	}
+
+	// Minutes
+	var step2 int64
+	if IsNotSet(step) {
+		step2 = 1
+	} else {
+		step2, err = strconv.ParseInt(step, 10, 64)
+		Skip(err)
+	}
+
+	if step2 < 1 {
+		Api(response, 400)
+		return
+	}
+
+	var now time.Time
+	now = time.Now()
+
+	var begin_time string
+	begin_time = now.Add(-(time.Duration(offset2) * time.Minute)).Format("2006-01-02 15:04:05")
+
+	var end_time string
+	if offset2 <= limit2 || limit2 == -1 {
+		end_time = now.Format("2006-01-02 15:04:05")
+	} else {
+		end_time = now.Add(-(time.Duration(offset2-limit2) * time.Minute)).Format("2006-01-02 15:04:05")
+	}
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var host map[string]interface{}
+	host = SelectHost(db, id2)
+
+	var counters []map[string]interface{}
+	counters = SelectHostCounters(db, host["project"].(string), host["code"].(string), begin_time, end_time, step2)
+
+	Api(response, 200, counters)
+}
+
+func CreateTableHost() {
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var query string
+	query = "SELECT 1 FROM t_host"
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		var query2 string
+		// query2 = `
+		// 	CREATE TABLE t_host (
+		// 		id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+		// 		code               VARCHAR(32)   NOT NULL,
+		// 		hostname           VARCHAR(64)   DEFAULT NULL,
+		// 		alias              VARCHAR(64)   DEFAULT NULL,
+		// 		ip                 VARCHAR(100)  DEFAULT NULL,
+		// 		os_type            VARCHAR(64)   DEFAULT NULL,
+		// 		architecture       VARCHAR(64)   DEFAULT NULL,
+		// 		cpu_processors     INTEGER       DEFAULT NULL,
+		// 		mem_size           INTEGER       DEFAULT NULL,
+		// 		swap_size          INTEGER       DEFAULT NULL,
+		// 		disk_size          INTEGER       DEFAULT NULL,
+		// 		uptime             DECIMAL(10,2) DEFAULT NULL,
+		// 		heartbeat_time     DATETIME      DEFAULT NULL,
+		// 		max_host_metric_id INTEGER       DEFAULT NULL,
+		// 		project            VARCHAR(32)   NOT NULL,
+		// 		version            VARCHAR(16)   DEFAULT NULL,
+		// 		UNIQUE(project, code)
+		// 	)
+		// `
+		query2 = `
+			CREATE TABLE t_host (
+				id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+				code               VARCHAR(32)   NOT NULL,
+				hostname           VARCHAR(64)   NOT NULL,
+				alias              VARCHAR(64)   DEFAULT NULL,
+				ip                 VARCHAR(100)  NOT NULL,
+				os_type            VARCHAR(64)   NOT NULL,
+				architecture       VARCHAR(64)   NOT NULL,
+				cpu_processors     INTEGER       NOT NULL,
+				mem_size           INTEGER       NOT NULL,
+				swap_size          INTEGER       NOT NULL,
+				disk_size          INTEGER       NOT NULL,
+				uptime             DECIMAL(10,2) NOT NULL,
+				heartbeat_time     DATETIME      NOT NULL,
+				host_metric_id     INTEGER       DEFAULT NULL,
+				project            VARCHAR(32)   NOT NULL,
+				version            VARCHAR(16)   NOT NULL,
+				interfaces         TEXT          NOT NULL DEFAULT '',
+				labels             TEXT          NOT NULL DEFAULT '',
+				errors             TEXT          NOT NULL DEFAULT '',
+				UNIQUE(project, code)
+			)
+		`
+
+		_, err = db.Exec(query2)
+		Throw(err)
+
+		log.Println("created table t_host")
+	} else {
+		rows.Close()
+		UpgradeTable(db, "t_host", HOST_COLUMNS)
 	}
-	tpl.Execute(response, data)
 }
 
-func ReportHost(response http.ResponseWriter, request *http.Request) {
+// Columns added after the first release of t_host, see UpgradeTable()
+var HOST_COLUMNS = []string{
+	"interfaces TEXT NOT NULL DEFAULT ''",
+	"labels     TEXT NOT NULL DEFAULT ''",
+	"errors     TEXT NOT NULL DEFAULT ''",
+}
+
+// Columns added after the first release of t_host_metric_%s, see UpgradeTable()
+var HOST_METRIC_COLUMNS = []string{
+	"cpu_user       DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_nice       DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_system     DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_idle       DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_irq        DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_softirq    DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_steal      DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_guest      DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_guest_nice DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"cpu_cores      TEXT          NOT NULL DEFAULT ''",
+	"psi_supported         INTEGER       NOT NULL DEFAULT 0",
+	"psi_cpu_some_avg10    DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_cpu_some_avg60    DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_cpu_some_total    INTEGER       NOT NULL DEFAULT 0",
+	"psi_cpu_full_avg10    DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_cpu_full_avg60    DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_cpu_full_total    INTEGER       NOT NULL DEFAULT 0",
+	"psi_memory_some_avg10 DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_memory_some_avg60 DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_memory_some_total INTEGER       NOT NULL DEFAULT 0",
+	"psi_memory_full_avg10 DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_memory_full_avg60 DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_memory_full_total INTEGER       NOT NULL DEFAULT 0",
+	"psi_io_some_avg10     DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_io_some_avg60     DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_io_some_total     INTEGER       NOT NULL DEFAULT 0",
+	"psi_io_full_avg10     DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_io_full_avg60     DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"psi_io_full_total     INTEGER       NOT NULL DEFAULT 0",
+	"tcp_established       INTEGER       NOT NULL DEFAULT 0",
+	"tcp_syn_sent          INTEGER       NOT NULL DEFAULT 0",
+	"tcp_syn_recv          INTEGER       NOT NULL DEFAULT 0",
+	"tcp_fin_wait1         INTEGER       NOT NULL DEFAULT 0",
+	"tcp_fin_wait2         INTEGER       NOT NULL DEFAULT 0",
+	"tcp_time_wait         INTEGER       NOT NULL DEFAULT 0",
+	"tcp_close             INTEGER       NOT NULL DEFAULT 0",
+	"tcp_close_wait        INTEGER       NOT NULL DEFAULT 0",
+	"tcp_last_ack          INTEGER       NOT NULL DEFAULT 0",
+	"tcp_listen            INTEGER       NOT NULL DEFAULT 0",
+	"tcp_closing           INTEGER       NOT NULL DEFAULT 0",
+	"tcp_new_syn_recv      INTEGER       NOT NULL DEFAULT 0",
+	"kernel_ctxt           DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"kernel_intr           DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"kernel_forks          DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"kernel_procs_running  DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"kernel_procs_blocked  DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_pgpgin             DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_pgpgout            DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_pswpin             DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_pswpout            DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_pgmajfault         DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"vm_oom_kill           DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_apps              DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_hugepages_total   DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_buffers           DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_cached            DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_shmem             DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_slab              DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_free              DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_available         DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_committed_as      DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_slab_reclaimable  DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_dirty             DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_writeback         DECIMAL(10,2) NOT NULL DEFAULT 0",
+	"mem_hugepages_used    DECIMAL(10,2) NOT NULL DEFAULT 0",
+}
+
+// Adds the missing columns to a table created by an older lnxmonsrv.
+func UpgradeTable(db *sql.DB, table string, columns []string) {
 	var err error
 
-	var body []byte
-	body, err = ioutil.ReadAll(request.Body)
-	log.Println(string(body))
+	var names map[string]bool
+	names = make(map[string]bool)
+
+	{
+		var query string
+		query = fmt.Sprintf("PRAGMA table_info(%s)", table)
+
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		defer rows.Close()
+		Throw(err)
+
+		for rows.Next() {
+			var cid int64
+			var name string
+			var type_ string
+			var notnull int64
+			var dflt_value sql.NullString
+			var pk int64
+
+			err = rows.Scan(&cid, &name, &type_, &notnull, &dflt_value, &pk)
+			Throw(err)
+
+			names[name] = true
+		}
+		rows.Close()
+	}
+
+	var column string
+	for _, column = range columns {
+		var name string
+		name = strings.Fields(column)[0]
+
+		if names[name] {
+			continue
+		}
+
+		var query string
+		query = fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)
+		_, err = db.Exec(query)
+		Throw(err)
+
+		log.Printf("added column %v.%v\n", table, name)
+	}
+}
+
+func CreateTableHostMetric(project string) {
+	var err error
+
+	project = strings.ToLower(project)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
 	Throw(err)
 
-	var data map[string]interface{}
-	json.Unmarshal(body, &data)
+	var query string
+	query = "SELECT 1 FROM t_host_metric_%s"
+	query = fmt.Sprintf(query, project)
 
-	if len(data) == 0 {
-		Api(response, 400)
-		return
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
 	}
+	Skip(err)
 
-	var code string
-	var hostname string
-	var ip string
-	var os_type string
-	var architecture string
-	var cpu_processors int64
-	var mem_size int64
-	var swap_size int64
-	var disk_size int64
-	var uptime float64
-	var heartbeat_time string
-	var project string
-	var version string
+	if rows == nil {
+		{
+			var query2 string
+			// query2 = `
+			// 	CREATE TABLE t_host_metric_%s (
+			// 		id			   INTEGER PRIMARY KEY AUTOINCREMENT,
+			// 		code           VARCHAR(32)  NOT NULL,
+			// 		hostname       VARCHAR(64)  DEFAULT NULL,
+			// 		ip             VARCHAR(100) DEFAULT NULL,
+			// 		loadavg        VARCHAR(20)  DEFAULT NULL,
+			// 		cpu_usage      VARCHAR(20)  DEFAULT NULL,
+			// 		mem_usage      VARCHAR(20)  DEFAULT NULL,
+			// 		disk_usage     VARCHAR(255) DEFAULT NULL,
+			// 		disk_io_rate   VARCHAR(32)  DEFAULT NULL,
+			// 		nic_io_rate    VARCHAR(32)  DEFAULT NULL,
+			// 		tcp_sockets    VARCHAR(20)  DEFAULT NULL,
+			// 		users          INTEGER      DEFAULT NULL,
+			// 		heartbeat_time DATETIME     DEFAULT NULL
+			// 	)
+			// `
+			query2 = `
+				CREATE TABLE t_host_metric_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					hostname                  VARCHAR(64)   NOT NULL,
+					ip                        VARCHAR(100)  NOT NULL,
+					loadavg_1m                DECIMAL(10,2) NOT NULL,
+					loadavg_5m                DECIMAL(10,2) NOT NULL,
+					loadavg_15m               DECIMAL(10,2) NOT NULL,
+					cpu_used                  DECIMAL(10,2) NOT NULL,
+					cpu_iowait                DECIMAL(10,2) NOT NULL,
+					cpu_user                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_nice                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_system                DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_idle                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_irq                   DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_softirq               DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_steal                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_guest                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_guest_nice            DECIMAL(10,2) NOT NULL DEFAULT 0,
+					cpu_cores                 TEXT          NOT NULL DEFAULT '',
+					psi_supported             INTEGER       NOT NULL DEFAULT 0,
+					psi_cpu_some_avg10        DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_cpu_some_avg60        DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_cpu_some_total        INTEGER       NOT NULL DEFAULT 0,
+					psi_cpu_full_avg10        DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_cpu_full_avg60        DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_cpu_full_total        INTEGER       NOT NULL DEFAULT 0,
+					psi_memory_some_avg10     DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_memory_some_avg60     DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_memory_some_total     INTEGER       NOT NULL DEFAULT 0,
+					psi_memory_full_avg10     DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_memory_full_avg60     DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_memory_full_total     INTEGER       NOT NULL DEFAULT 0,
+					psi_io_some_avg10         DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_io_some_avg60         DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_io_some_total         INTEGER       NOT NULL DEFAULT 0,
+					psi_io_full_avg10         DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_io_full_avg60         DECIMAL(10,2) NOT NULL DEFAULT 0,
+					psi_io_full_total         INTEGER       NOT NULL DEFAULT 0,
+					kernel_ctxt               DECIMAL(10,2) NOT NULL DEFAULT 0,
+					kernel_intr               DECIMAL(10,2) NOT NULL DEFAULT 0,
+					kernel_forks              DECIMAL(10,2) NOT NULL DEFAULT 0,
+					kernel_procs_running      DECIMAL(10,2) NOT NULL DEFAULT 0,
+					kernel_procs_blocked      DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_pgpgin                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_pgpgout                DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_pswpin                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_pswpout                DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_pgmajfault             DECIMAL(10,2) NOT NULL DEFAULT 0,
+					vm_oom_kill               DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_used                  DECIMAL(10,2) NOT NULL,
+					swap_used                 DECIMAL(10,2) NOT NULL,
+					mem_apps                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_hugepages_total       DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_buffers               DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_cached                DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_shmem                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_slab                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_free                  DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_available             DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_committed_as          DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_slab_reclaimable      DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_dirty                 DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_writeback             DECIMAL(10,2) NOT NULL DEFAULT 0,
+					mem_hugepages_used        DECIMAL(10,2) NOT NULL DEFAULT 0,
+					disk_usage                VARCHAR(255)  NOT NULL,
+					disk_used                 DECIMAL(10,2) NOT NULL,
+					inode_used                DECIMAL(10,2) NOT NULL,
+					disk_read_rate            DECIMAL(10,2) NOT NULL,
+					disk_write_rate           DECIMAL(10,2) NOT NULL,
+					disk_ios                  INTEGER       NOT NULL,
+					nic_receive_rate          DECIMAL(10,2) NOT NULL,
+					nic_receive_packets       INTEGER       NOT NULL,
+					nic_transmit_rate         DECIMAL(10,2) NOT NULL,
+					nic_transmit_packets      INTEGER       NOT NULL,
+					tcp_sockets_inuse         INTEGER       NOT NULL,
+					tcp_sockets_tw            INTEGER       NOT NULL,
+					tcp_established           INTEGER       NOT NULL DEFAULT 0,
+					tcp_syn_sent              INTEGER       NOT NULL DEFAULT 0,
+					tcp_syn_recv              INTEGER       NOT NULL DEFAULT 0,
+					tcp_fin_wait1             INTEGER       NOT NULL DEFAULT 0,
+					tcp_fin_wait2             INTEGER       NOT NULL DEFAULT 0,
+					tcp_time_wait             INTEGER       NOT NULL DEFAULT 0,
+					tcp_close                 INTEGER       NOT NULL DEFAULT 0,
+					tcp_close_wait            INTEGER       NOT NULL DEFAULT 0,
+					tcp_last_ack              INTEGER       NOT NULL DEFAULT 0,
+					tcp_listen                INTEGER       NOT NULL DEFAULT 0,
+					tcp_closing               INTEGER       NOT NULL DEFAULT 0,
+					tcp_new_syn_recv          INTEGER       NOT NULL DEFAULT 0,
+					users                     INTEGER       NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-	code = data["code"].(string)
-	hostname = data["hostname"].(string)
-	ip = data["ip"].(string)
-	os_type = data["os_type"].(string)
-	architecture = data["architecture"].(string)
-	cpu_processors = int64(data["cpu_processors"].(float64))
-	mem_size = int64(data["mem_size"].(float64))
-	swap_size = int64(data["swap_size"].(float64))
-	disk_size = int64(data["disk_size"].(float64))
-	uptime = data["uptime"].(float64)
-	heartbeat_time = data["heartbeat_time"].(string)
-	project = data["project"].(string)
-	version = data["version"].(string)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_metric_%s__heartbeat_time ON t_host_metric_%s (heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_metric_%v\n", project)
+	} else {
+		rows.Close()
+		UpgradeTable(db, fmt.Sprintf("t_host_metric_%s", project), HOST_METRIC_COLUMNS)
+	}
+}
+
+func CreateTableHostNic(project string) {
+	var err error
 
 	project = strings.ToLower(project)
 
@@ -976,121 +4035,169 @@ func ReportHost(response http.ResponseWriter, request *http.Request) {
 	defer db.Close()
 	Throw(err)
 
-	var rows_affected int64
+	var query string
+	query = "SELECT 1 FROM t_host_nic_%s"
+	query = fmt.Sprintf(query, project)
 
-	{
-		var query string
-		query = `
-			UPDATE t_host
-			SET
-				hostname=?, ip=?, os_type=?, architecture=?, cpu_processors=?,
-				mem_size=?, swap_size=?, disk_size=?, uptime=?, heartbeat_time=?, version=?
-			WHERE project=? AND code=?
-		`
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-		var result sql.Result
-		result, err = db.Exec(
-			query,
-			hostname, ip, os_type, architecture, cpu_processors,
-			mem_size, swap_size, disk_size, uptime, heartbeat_time, version,
-			project, code,
-		)
-		Throw(err)
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_nic_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(32)   NOT NULL,
+					receive_rate              DECIMAL(10,2) NOT NULL,
+					receive_packets           INTEGER       NOT NULL,
+					receive_errs              INTEGER       NOT NULL,
+					receive_drop              INTEGER       NOT NULL,
+					transmit_rate             DECIMAL(10,2) NOT NULL,
+					transmit_packets          INTEGER       NOT NULL,
+					transmit_errs             INTEGER       NOT NULL,
+					transmit_drop             INTEGER       NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-		rows_affected, err = result.RowsAffected()
-		log.Println("rows_affected:", rows_affected)
-		Throw(err)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_nic_%s__code__heartbeat_time ON t_host_nic_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_nic_%v\n", project)
 	}
+}
 
-	if rows_affected == 0 {
-		var query string
-		query = `
-			INSERT INTO t_host (
-				code, hostname, ip, os_type, architecture, cpu_processors,
-				mem_size, swap_size, disk_size, uptime, heartbeat_time, project, version
-			) VALUES (
-				?,?,?,?,?,?,?,?,?,?,?,?,?
-			)
-		`
+func CreateTableHostDisk(project string) {
+	var err error
 
-		_, err = db.Exec(
-			query,
-			code, hostname, ip, os_type, architecture, cpu_processors,
-			mem_size, swap_size, disk_size, uptime, heartbeat_time, project, version,
-		)
-		Throw(err)
+	project = strings.ToLower(project)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var query string
+	query = "SELECT 1 FROM t_host_disk_%s"
+	query = fmt.Sprintf(query, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
 	}
+	Skip(err)
 
-	Api(response, 200)
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_disk_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(64)   NOT NULL,
+					read_iops                 DECIMAL(10,2) NOT NULL,
+					write_iops                DECIMAL(10,2) NOT NULL,
+					read_rate                 DECIMAL(10,2) NOT NULL,
+					write_rate                DECIMAL(10,2) NOT NULL,
+					read_await                DECIMAL(10,2) NOT NULL,
+					write_await               DECIMAL(10,2) NOT NULL,
+					util                      DECIMAL(10,2) NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
+
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_disk_%s__code__heartbeat_time ON t_host_disk_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_disk_%v\n", project)
+	}
 }
 
-func ReportHostMetric(response http.ResponseWriter, request *http.Request) {
+// The min, max, avg and last of the metrics sampled more often than they are
+// reported, one row per metric, e.g. cpu_used
+func CreateTableHostMetricAgg(project string) {
 	var err error
 
-	var body []byte
-	body, err = ioutil.ReadAll(request.Body)
-	log.Println(string(body))
+	project = strings.ToLower(project)
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
 	Throw(err)
 
-	var data map[string]interface{}
-	json.Unmarshal(body, &data)
+	var query string
+	query = "SELECT 1 FROM t_host_metric_agg_%s"
+	query = fmt.Sprintf(query, project)
 
-	if len(data) == 0 {
-		Api(response, 400)
-		return
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
 	}
+	Skip(err)
 
-	var code string
-	var hostname string
-	var ip string
-	var loadavg_1m float64
-	var loadavg_5m float64
-	var loadavg_15m float64
-	var cpu_used float64
-	var cpu_iowait float64
-	var mem_used float64
-	var swap_used float64
-	var disk_usage string
-	var disk_used float64
-	var inode_used float64
-	var disk_read_rate float64
-	var disk_write_rate float64
-	var disk_ios float64
-	var nic_receive_rate float64
-	var nic_receive_packets float64
-	var nic_transmit_rate float64
-	var nic_transmit_packets float64
-	var tcp_sockets_inuse float64
-	var tcp_sockets_tw float64
-	var users float64
-	var heartbeat_time string
-	var project string
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_metric_agg_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(64)   NOT NULL,
+					min_value                 DECIMAL(10,2) NOT NULL,
+					max_value                 DECIMAL(10,2) NOT NULL,
+					avg_value                 DECIMAL(10,2) NOT NULL,
+					last_value                DECIMAL(10,2) NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-	code = data["code"].(string)
-	hostname = data["hostname"].(string)
-	ip = data["ip"].(string)
-	loadavg_1m = data["loadavg_1m"].(float64)
-	loadavg_5m = data["loadavg_5m"].(float64)
-	loadavg_15m = data["loadavg_15m"].(float64)
-	cpu_used = data["cpu_used"].(float64)
-	cpu_iowait = data["cpu_iowait"].(float64)
-	mem_used = data["mem_used"].(float64)
-	swap_used = data["swap_used"].(float64)
-	disk_usage = data["disk_usage"].(string)
-	disk_used = data["disk_used"].(float64)
-	inode_used = data["inode_used"].(float64)
-	disk_read_rate = data["disk_read_rate"].(float64)
-	disk_write_rate = data["disk_write_rate"].(float64)
-	disk_ios = data["disk_ios"].(float64)
-	nic_receive_rate = data["nic_receive_rate"].(float64)
-	nic_receive_packets = data["nic_receive_packets"].(float64)
-	nic_transmit_rate = data["nic_transmit_rate"].(float64)
-	nic_transmit_packets = data["nic_transmit_packets"].(float64)
-	tcp_sockets_inuse = data["tcp_sockets_inuse"].(float64)
-	tcp_sockets_tw = data["tcp_sockets_tw"].(float64)
-	users = data["users"].(float64)
-	heartbeat_time = data["heartbeat_time"].(string)
-	project = data["project"].(string)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_metric_agg_%s__code__heartbeat_time ON t_host_metric_agg_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_metric_agg_%v\n", project)
+	}
+}
+
+func CreateTableHostCounter(project string) {
+	var err error
 
 	project = strings.ToLower(project)
 
@@ -1099,211 +4206,307 @@ func ReportHostMetric(response http.ResponseWriter, request *http.Request) {
 	defer db.Close()
 	Throw(err)
 
-	var tx *sql.Tx
-	tx, err = db.Begin()
-	defer tx.Rollback()
-	Throw(err)
+	var query string
+	query = "SELECT 1 FROM t_host_counter_%s"
+	query = fmt.Sprintf(query, project)
 
-	var last_insert_id int64
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-	{
-		var query string
-		query = `
-			INSERT INTO t_host_metric_%s (
-				code,
-				hostname,
-				ip,
-				loadavg_1m, loadavg_5m, loadavg_15m,
-				cpu_used, cpu_iowait,
-				mem_used, swap_used,
-				disk_usage, disk_used, inode_used,
-				disk_read_rate, disk_write_rate, disk_ios,
-				nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets,
-				tcp_sockets_inuse, tcp_sockets_tw,
-				users,
-				heartbeat_time
-			) VALUES (
-				?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?
-			)
-		`
-		query = fmt.Sprintf(query, project)
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_counter_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					boot_time                 INTEGER       NOT NULL,
+					uptime                    DECIMAL(12,2) NOT NULL,
+					devices                   INTEGER       NOT NULL DEFAULT 0,
+					cpu_jiffies               INTEGER       NOT NULL,
+					cpu_used_jiffies          INTEGER       NOT NULL,
+					cpu_idle_jiffies          INTEGER       NOT NULL,
+					cpu_iowait_jiffies        INTEGER       NOT NULL,
+					cpu_steal_jiffies         INTEGER       NOT NULL,
+					disk_reads                INTEGER       NOT NULL,
+					disk_read_sectors         INTEGER       NOT NULL,
+					disk_writes               INTEGER       NOT NULL,
+					disk_write_sectors        INTEGER       NOT NULL,
+					nic_receive_bytes         INTEGER       NOT NULL,
+					nic_receive_packets       INTEGER       NOT NULL,
+					nic_transmit_bytes        INTEGER       NOT NULL,
+					nic_transmit_packets      INTEGER       NOT NULL,
+					elapsed                   DECIMAL(10,2) DEFAULT NULL,
+					is_reset                  INTEGER       NOT NULL DEFAULT 0,
+					cpu_used                  DECIMAL(10,2) DEFAULT NULL,
+					cpu_iowait                DECIMAL(10,2) DEFAULT NULL,
+					cpu_steal                 DECIMAL(10,2) DEFAULT NULL,
+					disk_read_rate            DECIMAL(10,2) DEFAULT NULL,
+					disk_write_rate           DECIMAL(10,2) DEFAULT NULL,
+					disk_ios                  DECIMAL(10,2) DEFAULT NULL,
+					nic_receive_rate          DECIMAL(10,2) DEFAULT NULL,
+					nic_receive_packets_rate  DECIMAL(10,2) DEFAULT NULL,
+					nic_transmit_rate         DECIMAL(10,2) DEFAULT NULL,
+					nic_transmit_packets_rate DECIMAL(10,2) DEFAULT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-		var stmt *sql.Stmt
-		stmt, err = tx.Prepare(query)
-		defer stmt.Close()
-		if err != nil {
-			Skip(err)
-			log.Println(err.Error())
-			if strings.Contains(err.Error(), "no such table") {
-				CreateTableHostMetric(project)
-			}
-			stmt, err = tx.Prepare(query)
+			_, err = db.Exec(query2)
 			Throw(err)
 		}
 
-		var result sql.Result
-		result, err = stmt.Exec(
-			code,
-			hostname,
-			ip,
-			loadavg_1m, loadavg_5m, loadavg_15m,
-			cpu_used, cpu_iowait,
-			mem_used, swap_used,
-			disk_usage, disk_used, inode_used,
-			disk_read_rate, disk_write_rate, disk_ios,
-			nic_receive_rate, nic_receive_packets, nic_transmit_rate, nic_transmit_packets,
-			tcp_sockets_inuse, tcp_sockets_tw,
-			users,
-			heartbeat_time,
-		)
-		Throw(err)
-
-		last_insert_id, err = result.LastInsertId()
-		log.Println("last_insert_id:", last_insert_id)
-		Throw(err)
-	}
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_counter_%s__code__heartbeat_time ON t_host_counter_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-	{
-		var query string
-		query = "UPDATE t_host SET host_metric_id=?, heartbeat_time=? WHERE project=? AND code=?"
-		_, err = tx.Exec(query, last_insert_id, heartbeat_time, project, code)
-		Throw(err)
+		log.Printf("created table t_host_counter_%v\n", project)
+	} else {
+		rows.Close()
+		UpgradeTable(db, fmt.Sprintf("t_host_counter_%s", project), HOST_COUNTER_COLUMNS)
 	}
-
-	tx.Commit()
-	log.Println("tx committed")
-
-	Api(response, 200)
 }
 
-func GetProjects(response http.ResponseWriter, request *http.Request) {
+func CreateTableHostCustom(project string) {
 	var err error
 
+	project = strings.ToLower(project)
+
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Throw(err)
 
-	var projects []map[string]interface{}
-	projects = SelectProjects(db)
+	var query string
+	query = "SELECT 1 FROM t_host_custom_%s"
+	query = fmt.Sprintf(query, project)
 
-	Api(response, 200, projects)
-}
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-func GetHosts(response http.ResponseWriter, request *http.Request) {
-	var err error
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_custom_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(128)  NOT NULL,
+					labels                    VARCHAR(255)  NOT NULL DEFAULT '',
+					value                     REAL          NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-	var project string
-	project = FormValueOf(request, "project")
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-	if IsNotSet(project) {
-		project = "default"
-	} else {
-		project = strings.ToLower(project)
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_custom_%s__code__heartbeat_time ON t_host_custom_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_custom_%v\n", project)
 	}
+}
+
+func CreateTableHostEvent(project string) {
+	var err error
+
+	project = strings.ToLower(project)
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Throw(err)
 
-	var hosts []map[string]interface{}
-	hosts = SelectHosts(db, project)
+	var query string
+	query = "SELECT 1 FROM t_host_event_%s"
+	query = fmt.Sprintf(query, project)
+
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
+
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_event_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(128)  NOT NULL,
+					path                      VARCHAR(255)  NOT NULL,
+					line                      TEXT          NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
+
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_event_%s__code__heartbeat_time ON t_host_event_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-	Api(response, 200, hosts)
+		log.Printf("created table t_host_event_%v\n", project)
+	}
 }
 
-func GetHost(response http.ResponseWriter, request *http.Request) {
+func CreateTableHostCgroup(project string) {
 	var err error
 
-	var id string
-	id = FormValueOf(request, "id")
-
-	if IsNotSet(id) || IsNotInt(id) {
-		Api(response, 400)
-		return
-	}
-
-	var id2 int64
-	id2, err = strconv.ParseInt(id, 10, 64)
-	Skip(err)
+	project = strings.ToLower(project)
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Throw(err)
 
-	var host map[string]interface{}
-	host = SelectHost(db, id2)
+	var query string
+	query = "SELECT 1 FROM t_host_cgroup_%s"
+	query = fmt.Sprintf(query, project)
 
-	Api(response, 200, host)
-}
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-func GetHostMetric(response http.ResponseWriter, request *http.Request) {
-	var err error
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_cgroup_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					name                      VARCHAR(255)  NOT NULL,
+					cpu_used                  DECIMAL(10,2) NOT NULL,
+					cpu_throttled             DECIMAL(10,2) NOT NULL,
+					cpu_throttled_time        DECIMAL(10,2) NOT NULL,
+					mem_current               DECIMAL(10,2) NOT NULL,
+					mem_max                   DECIMAL(10,2) NOT NULL,
+					io_read_rate              DECIMAL(10,2) NOT NULL,
+					io_write_rate             DECIMAL(10,2) NOT NULL,
+					io_read_iops              DECIMAL(10,2) NOT NULL,
+					io_write_iops             DECIMAL(10,2) NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-	var id string
-	var offset string
-	var limit string
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-	id = FormValueOf(request, "id")
-	offset = FormValueOf(request, "offset")
-	limit = FormValueOf(request, "limit")
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_cgroup_%s__code__heartbeat_time ON t_host_cgroup_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-	if IsNotSet(id) || IsNotInt(id, offset, limit) {
-		Api(response, 400)
-		return
+		log.Printf("created table t_host_cgroup_%v\n", project)
 	}
+}
 
-	var id2 int64
-	id2, err = strconv.ParseInt(id, 10, 64)
-	Skip(err)
-
-	var offset2 int64
-	if IsNotSet(offset) {
-		offset2 = 240
-	} else {
-		offset2, err = strconv.ParseInt(offset, 10, 64)
-		Skip(err)
-	}
+func CreateTableHostPort(project string) {
+	var err error
 
-	var limit2 int64
-	if IsNotSet(limit) {
-		// 60 * 24 * 31
-		limit2 = 44640
-	} else {
-		limit2, err = strconv.ParseInt(limit, 10, 64)
-		Skip(err)
-		// if limit2 == -1 {
-		// 	// 1,000,000,000
-		// 	limit2 = 1000000000
-		// }
-	}
+	project = strings.ToLower(project)
 
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Throw(err)
 
-	var host map[string]interface{}
-	host = SelectHost(db, id2)
+	var query string
+	query = "SELECT 1 FROM t_host_port_%s"
+	query = fmt.Sprintf(query, project)
 
-	var host_metric map[string]interface{}
-	host_metric = SelectHostMetric(db, host["project"].(string), host["code"].(string), offset2, limit2)
+	var rows *sql.Rows
+	rows, err = db.Query(query)
+	if rows != nil {
+		defer rows.Close()
+	}
+	Skip(err)
 
-	Api(response, 200, host_metric)
+	if rows == nil {
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_port_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					protocol                  VARCHAR(8)    NOT NULL,
+					ip                        VARCHAR(64)   NOT NULL,
+					port                      INTEGER       NOT NULL,
+					pid                       INTEGER       NOT NULL,
+					name                      VARCHAR(64)   NOT NULL,
+					first_seen                DATETIME      NOT NULL,
+					last_seen                 DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
+
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		{
+			var query2 string
+			query2 = "CREATE UNIQUE INDEX idx__t_host_port_%s__code__protocol__ip__port ON t_host_port_%s (code, protocol, ip, port)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_port_%v\n", project)
+	}
 }
 
-func CreateTableHost() {
+func CreateTableHostProcess(project string) {
 	var err error
 
+	project = strings.ToLower(project)
+
 	var db *sql.DB
 	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
 	defer db.Close()
 	Throw(err)
 
 	var query string
-	query = "SELECT 1 FROM t_host"
+	query = "SELECT 1 FROM t_host_process_%s"
+	query = fmt.Sprintf(query, project)
 
 	var rows *sql.Rows
 	rows, err = db.Query(query)
@@ -1313,58 +4516,40 @@ func CreateTableHost() {
 	Skip(err)
 
 	if rows == nil {
-		var query2 string
-		// query2 = `
-		// 	CREATE TABLE t_host (
-		// 		id                 INTEGER PRIMARY KEY AUTOINCREMENT,
-		// 		code               VARCHAR(32)   NOT NULL,
-		// 		hostname           VARCHAR(64)   DEFAULT NULL,
-		// 		alias              VARCHAR(64)   DEFAULT NULL,
-		// 		ip                 VARCHAR(100)  DEFAULT NULL,
-		// 		os_type            VARCHAR(64)   DEFAULT NULL,
-		// 		architecture       VARCHAR(64)   DEFAULT NULL,
-		// 		cpu_processors     INTEGER       DEFAULT NULL,
-		// 		mem_size           INTEGER       DEFAULT NULL,
-		// 		swap_size          INTEGER       DEFAULT NULL,
-		// 		disk_size          INTEGER       DEFAULT NULL,
-		// 		uptime             DECIMAL(10,2) DEFAULT NULL,
-		// 		heartbeat_time     DATETIME      DEFAULT NULL,
-		// 		max_host_metric_id INTEGER       DEFAULT NULL,
-		// 		project            VARCHAR(32)   NOT NULL,
-		// 		version            VARCHAR(16)   DEFAULT NULL,
-		// 		UNIQUE(project, code)
-		// 	)
-		// `
-		query2 = `
-			CREATE TABLE t_host (
-				id                 INTEGER PRIMARY KEY AUTOINCREMENT,
-				code               VARCHAR(32)   NOT NULL,
-				hostname           VARCHAR(64)   NOT NULL,
-				alias              VARCHAR(64)   DEFAULT NULL,
-				ip                 VARCHAR(100)  NOT NULL,
-				os_type            VARCHAR(64)   NOT NULL,
-				architecture       VARCHAR(64)   NOT NULL,
-				cpu_processors     INTEGER       NOT NULL,
-				mem_size           INTEGER       NOT NULL,
-				swap_size          INTEGER       NOT NULL,
-				disk_size          INTEGER       NOT NULL,
-				uptime             DECIMAL(10,2) NOT NULL,
-				heartbeat_time     DATETIME      NOT NULL,
-				host_metric_id     INTEGER       DEFAULT NULL,
-				project            VARCHAR(32)   NOT NULL,
-				version            VARCHAR(16)   NOT NULL,
-				UNIQUE(project, code)
-			)
-		`
+		{
+			var query2 string
+			query2 = `
+				CREATE TABLE t_host_process_%s (
+					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
+					code                      VARCHAR(32)   NOT NULL,
+					pid                       INTEGER       NOT NULL,
+					name                      VARCHAR(64)   NOT NULL,
+					cmdline                   VARCHAR(255)  NOT NULL,
+					cpu_used                  DECIMAL(10,2) NOT NULL,
+					mem_rss                   DECIMAL(10,2) NOT NULL,
+					threads                   INTEGER       NOT NULL,
+					heartbeat_time            DATETIME      NOT NULL
+				)
+			`
+			query2 = fmt.Sprintf(query2, project)
 
-		_, err = db.Exec(query2)
-		Throw(err)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
 
-		log.Println("created table t_host")
+		{
+			var query2 string
+			query2 = "CREATE INDEX idx__t_host_process_%s__code__heartbeat_time ON t_host_process_%s (code, heartbeat_time)"
+			query2 = fmt.Sprintf(query2, project, project)
+			_, err = db.Exec(query2)
+			Throw(err)
+		}
+
+		log.Printf("created table t_host_process_%v\n", project)
 	}
 }
 
-func CreateTableHostMetric(project string) {
+func CreateTableHostWatch(project string) {
 	var err error
 
 	project = strings.ToLower(project)
@@ -1375,7 +4560,7 @@ func CreateTableHostMetric(project string) {
 	Throw(err)
 
 	var query string
-	query = "SELECT 1 FROM t_host_metric_%s"
+	query = "SELECT 1 FROM t_host_watch_%s"
 	query = fmt.Sprintf(query, project)
 
 	var rows *sql.Rows
@@ -1388,49 +4573,19 @@ func CreateTableHostMetric(project string) {
 	if rows == nil {
 		{
 			var query2 string
-			// query2 = `
-			// 	CREATE TABLE t_host_metric_%s (
-			// 		id			   INTEGER PRIMARY KEY AUTOINCREMENT,
-			// 		code           VARCHAR(32)  NOT NULL,
-			// 		hostname       VARCHAR(64)  DEFAULT NULL,
-			// 		ip             VARCHAR(100) DEFAULT NULL,
-			// 		loadavg        VARCHAR(20)  DEFAULT NULL,
-			// 		cpu_usage      VARCHAR(20)  DEFAULT NULL,
-			// 		mem_usage      VARCHAR(20)  DEFAULT NULL,
-			// 		disk_usage     VARCHAR(255) DEFAULT NULL,
-			// 		disk_io_rate   VARCHAR(32)  DEFAULT NULL,
-			// 		nic_io_rate    VARCHAR(32)  DEFAULT NULL,
-			// 		tcp_sockets    VARCHAR(20)  DEFAULT NULL,
-			// 		users          INTEGER      DEFAULT NULL,
-			// 		heartbeat_time DATETIME     DEFAULT NULL
-			// 	)
-			// `
 			query2 = `
-				CREATE TABLE t_host_metric_%s (
+				CREATE TABLE t_host_watch_%s (
 					id                        INTEGER PRIMARY KEY AUTOINCREMENT,
 					code                      VARCHAR(32)   NOT NULL,
-					hostname                  VARCHAR(64)   NOT NULL,
-					ip                        VARCHAR(100)  NOT NULL,
-					loadavg_1m                DECIMAL(10,2) NOT NULL,
-					loadavg_5m                DECIMAL(10,2) NOT NULL,
-					loadavg_15m               DECIMAL(10,2) NOT NULL,
+					name                      VARCHAR(64)   NOT NULL,
+					type                      VARCHAR(16)   NOT NULL,
+					pattern                   VARCHAR(255)  NOT NULL,
+					count                     INTEGER       NOT NULL,
 					cpu_used                  DECIMAL(10,2) NOT NULL,
-					cpu_iowait                DECIMAL(10,2) NOT NULL,
-					mem_used                  DECIMAL(10,2) NOT NULL,
-					swap_used                 DECIMAL(10,2) NOT NULL,
-					disk_usage                VARCHAR(255)  NOT NULL,
-					disk_used                 DECIMAL(10,2) NOT NULL,
-					inode_used                DECIMAL(10,2) NOT NULL,
-					disk_read_rate            DECIMAL(10,2) NOT NULL,
-					disk_write_rate           DECIMAL(10,2) NOT NULL,
-					disk_ios                  INTEGER       NOT NULL,
-					nic_receive_rate          DECIMAL(10,2) NOT NULL,
-					nic_receive_packets       INTEGER       NOT NULL,
-					nic_transmit_rate         DECIMAL(10,2) NOT NULL,
-					nic_transmit_packets      INTEGER       NOT NULL,
-					tcp_sockets_inuse         INTEGER       NOT NULL,
-					tcp_sockets_tw            INTEGER       NOT NULL,
-					users                     INTEGER       NOT NULL,
+					mem_rss                   DECIMAL(10,2) NOT NULL,
+					threads                   INTEGER       NOT NULL,
+					fds                       INTEGER       NOT NULL,
+					start_time                VARCHAR(32)   NOT NULL,
 					heartbeat_time            DATETIME      NOT NULL
 				)
 			`
@@ -1442,19 +4597,49 @@ func CreateTableHostMetric(project string) {
 
 		{
 			var query2 string
-			query2 = "CREATE INDEX idx__t_host_metric_%s__heartbeat_time ON t_host_metric_%s (heartbeat_time)"
+			query2 = "CREATE INDEX idx__t_host_watch_%s__code__heartbeat_time ON t_host_watch_%s (code, heartbeat_time)"
 			query2 = fmt.Sprintf(query2, project, project)
 			_, err = db.Exec(query2)
 			Throw(err)
 		}
 
-		log.Printf("created table t_host_metric_%v\n", project)
+		log.Printf("created table t_host_watch_%v\n", project)
 	}
 }
 
+// Creates the tables of a project, t_host_metric_%s and the per-device ones.
+func InitProject(project string) {
+	CreateTableHostMetric(project)
+	CreateTableHostMetricAgg(project)
+	CreateTableHostCounter(project)
+	CreateTableHostCustom(project)
+	CreateTableHostEvent(project)
+	CreateTableHostNic(project)
+	CreateTableHostDisk(project)
+	CreateTableHostCgroup(project)
+	CreateTableHostProcess(project)
+	CreateTableHostPort(project)
+	CreateTableHostWatch(project)
+}
+
 func InitDb() {
 	CreateTableHost()
-	CreateTableHostMetric("DEFAULT")
+	InitProject("DEFAULT")
+
+	var err error
+
+	var db *sql.DB
+	db, err = sql.Open("sqlite3", SETTINGS.DATA_SOURCE_NAME)
+	defer db.Close()
+	Throw(err)
+
+	var projects []map[string]interface{}
+	projects = SelectProjects(db)
+
+	var project map[string]interface{}
+	for _, project = range projects {
+		InitProject(project["code"].(string))
+	}
 }
 
 func main() {
@@ -1495,10 +4680,14 @@ func main() {
 	http.HandleFunc("/favicon.ico", MakeHandler(HttpStatusOk))
 	http.HandleFunc("/api/report_host", MakeHandler(ReportHost))
 	http.HandleFunc("/api/report_host_metric", MakeHandler(ReportHostMetric))
+	http.HandleFunc("/api/report_host_metrics", MakeHandler(ReportHostMetrics))
+	http.HandleFunc("/api/link_host", MakeHandler(LinkHost))
 	http.HandleFunc("/api/get_projects", MakeHandler(GetProjects))
 	http.HandleFunc("/api/get_hosts", MakeHandler(GetHosts))
 	http.HandleFunc("/api/get_host", MakeHandler(GetHost))
 	http.HandleFunc("/api/get_host_metric", MakeHandler(MakeGzipHandler(GetHostMetric)))
+	http.HandleFunc("/api/get_host_processes", MakeHandler(MakeGzipHandler(GetHostProcesses)))
+	http.HandleFunc("/api/get_host_counters", MakeHandler(MakeGzipHandler(GetHostCounters)))
 
 	var fileServerHandler http.Handler
 	fileServerHandler = http.FileServer(http.Dir("./static/"))